@@ -0,0 +1,12 @@
+// Package bindata embeds the default manifests into the kubeipfixed binary
+package bindata
+
+import "embed"
+
+// CNIConfig holds the default NetworkAttachmentDefinition templates, manifests/cni-config/<cniType>-cni-config.yaml
+//
+//go:embed manifests/cni-config/*.yaml
+var CNIConfig embed.FS
+
+// CNIConfigDir is the directory of the NetworkAttachmentDefinition templates inside CNIConfig
+const CNIConfigDir = "manifests/cni-config"
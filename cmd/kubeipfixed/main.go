@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/wenwenxiong/kubeipfixed/pkg/cli"
+	ip_manager "github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+)
+
+// kubeipfixed inspects and manages the fixed ip allocations, installed as kubectl-kubeipfixed it runs as a kubectl plugin
+func main() {
+	var managerNamespace string
+	var verbose bool
+
+	flag.StringVar(&managerNamespace, "manager-namespace", "kubeipfixed-system", "The namespace of the kubeipfixed manager.")
+	flag.BoolVar(&verbose, "verbose", false, "Log how the allocation state is rebuilt.")
+	commandLine := cli.NewCLI(os.Stdout, func(readOnly bool) (*ip_manager.IPManager, error) {
+		return cli.NewClusterIPManager(managerNamespace, readOnly)
+	})
+	flag.Usage = func() {
+		commandLine.Usage()
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if verbose {
+		ctrl.SetLogger(zap.New(zap.UseDevMode(true), zap.WriteTo(os.Stderr)))
+	}
+
+	err := commandLine.Run(flag.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -1,4 +1,4 @@
-package manager
+package main
 
 import (
 	"flag"
@@ -18,10 +18,12 @@ func main() {
 func runKubeipfixedManager() {
 	var logType, metricsAddr string
 	var waitingTime int
+	var leaderElection bool
 
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&logType, "v", "production", "Log type (debug/production).")
-	flag.IntVar(&waitingTime, names.WAIT_TIME_ARG, 600, "waiting time to release the mac if object was not created")
+	flag.IntVar(&waitingTime, names.WAIT_TIME_ARG, 600, "waiting time to release the ip if object was not created")
+	flag.BoolVar(&leaderElection, names.LEADER_ELECT_ARG, true, "Elect a leader running the controllers, the webhooks are served by all the replicas.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(logType != "production")))
@@ -40,11 +42,11 @@ func runKubeipfixedManager() {
 		os.Exit(1)
 	}
 
-	kubeippoolManager := manager.NewKubeIPPoolManager(podNamespace, podName, metricsAddr, waitingTime)
+	kubeippoolManager := manager.NewKubeIPPoolManager(podNamespace, podName, metricsAddr, waitingTime, leaderElection)
 
-	err = kubeippoolManager.Run()
+	err := kubeippoolManager.Run()
 	if err != nil {
-		log.Error(err, "Failed to run the kubemacpool manager")
+		log.Error(err, "Failed to run the kubeipfixed manager")
 		os.Exit(1)
 	}
 
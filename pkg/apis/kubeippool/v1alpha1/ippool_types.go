@@ -0,0 +1,133 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// IPRange is an inclusive range of allocatable addresses inside the pool subnet
+type IPRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// MACRange is an inclusive range of allocatable MAC addresses, e.g. 02:00:00:00:00:00-02:00:00:00:ff:ff
+type MACRange struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Route is a static route configured on the interface of the pool addresses
+type Route struct {
+	// Dst in CIDR notation, e.g. 10.10.0.0/16
+	Dst string `json:"dst"`
+	// Gw is the next hop, the route goes through the interface gateway when empty
+	// +optional
+	Gw string `json:"gw,omitempty"`
+}
+
+// NetAttDefMode selects how the NetworkAttachmentDefinitions of a pool are rendered
+type NetAttDefMode string
+
+const (
+	// NetAttDefModePerAddress renders one NetworkAttachmentDefinition with a static ipam per address
+	NetAttDefModePerAddress NetAttDefMode = "PerAddress"
+	// NetAttDefModeShared renders one NetworkAttachmentDefinition for the pool, workloads pass their address at runtime
+	// through the ips of their multus network selection element
+	NetAttDefModeShared NetAttDefMode = "Shared"
+)
+
+// CNIType is the CNI plugin attaching the interface of the pool addresses
+type CNIType string
+
+const (
+	CNITypeSriov      CNIType = "sriov"
+	CNITypeMacvlan    CNIType = "macvlan"
+	CNITypeIPVlan     CNIType = "ipvlan"
+	CNITypeHostDevice CNIType = "host-device"
+	CNITypeOvs        CNIType = "ovs"
+)
+
+// IPPoolSpec defines the subnet kubeipfixed allocates fixed addresses from
+type IPPoolSpec struct {
+	// Subnet in CIDR notation, e.g. 100.100.100.0/24
+	Subnet string `json:"subnet"`
+	// Ranges of allocatable addresses, every usable host of Subnet when empty
+	// +optional
+	Ranges []IPRange `json:"ranges,omitempty"`
+	// +optional
+	Gateway string `json:"gateway,omitempty"`
+	// Subnet6 is the IPv6 subnet of a dual-stack pool in CIDR notation, e.g. fd00:100::/64. Every allocation then
+	// gets one address of Subnet and one of Subnet6 on the same interface.
+	// +optional
+	Subnet6 string `json:"subnet6,omitempty"`
+	// Ranges6 of allocatable addresses of Subnet6, every usable host of Subnet6 when empty
+	// +optional
+	Ranges6 []IPRange `json:"ranges6,omitempty"`
+	// +optional
+	Gateway6 string `json:"gateway6,omitempty"`
+	// +optional
+	Nameservers []string `json:"nameservers,omitempty"`
+	// Search domains of the resolver
+	// +optional
+	Search []string `json:"search,omitempty"`
+	// Routes are the static routes added next to the default route through the gateway
+	// +optional
+	Routes []Route `json:"routes,omitempty"`
+	// ResourceName is the device plugin resource backing the pool, e.g. mecdev.com/intel2v2nics. Only the cni
+	// types attaching a device of the node need one, i.e. sriov and host-device.
+	// +optional
+	ResourceName string `json:"resourceName,omitempty"`
+	// CNIType is sriov when empty
+	// +kubebuilder:validation:Enum=sriov;macvlan;ipvlan;host-device;ovs
+	// +optional
+	CNIType CNIType `json:"cniType,omitempty"`
+	// Master is the parent interface of the macvlan and ipvlan types, the device moved into the pod by host-device
+	// +optional
+	Master string `json:"master,omitempty"`
+	// Mode of the macvlan (bridge, private, vepa, passthru) and ipvlan (l2, l3, l3s) types
+	// +optional
+	Mode string `json:"mode,omitempty"`
+	// Bridge is the OVS bridge of the ovs type
+	// +optional
+	Bridge string `json:"bridge,omitempty"`
+	// +optional
+	Vlan int `json:"vlan,omitempty"`
+	// MACRange gives every address of the pool a fixed MAC address taken from the range, the interface of the
+	// sriov, macvlan and ovs types is set to it. The interfaces keep the MAC address they get from the CNI otherwise.
+	// +optional
+	MACRange *MACRange `json:"macRange,omitempty"`
+	// NetworkNamespace is the namespace the rendered NetworkAttachmentDefinitions are created in,
+	// the namespace of the workload when empty
+	// +optional
+	NetworkNamespace string `json:"networkNamespace,omitempty"`
+	// NetAttDefMode is PerAddress when empty
+	// +kubebuilder:validation:Enum=PerAddress;Shared
+	// +optional
+	NetAttDefMode NetAttDefMode `json:"netAttDefMode,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:printcolumn:name="Subnet",type=string,JSONPath=`.spec.subnet`
+// +kubebuilder:printcolumn:name="ResourceName",type=string,JSONPath=`.spec.resourceName`
+
+// IPPool is the Schema for the ippools API
+type IPPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec IPPoolSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// IPPoolList contains a list of IPPool
+type IPPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IPPool `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&IPPool{}, &IPPoolList{})
+}
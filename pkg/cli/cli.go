@@ -0,0 +1,315 @@
+// Package cli implements the kubeipfixed command line. It rebuilds the allocation state the manager works on from the
+// pools, NetworkAttachmentDefinitions, pods and virtual machines of the cluster, then inspects or changes it.
+package cli
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/yaml"
+
+	ip_manager "github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+)
+
+// command is a sub command of the kubeipfixed command line
+type command struct {
+	usage       string
+	description string
+	run         func(c *CLI, flags *flag.FlagSet, args []string) error
+	flags       func(flags *flag.FlagSet)
+}
+
+var commands = map[string]command{
+	"pools": {
+		usage:       "pools",
+		description: "List the pools with their total, allocated and free addresses",
+		run:         (*CLI).pools,
+	},
+	"allocations": {
+		usage:       "allocations [--pool <name>]",
+		description: "List the allocated addresses and their holders",
+		run:         (*CLI).allocations,
+		flags: func(flags *flag.FlagSet) {
+			flags.String("pool", "", "Only list the addresses of this pool")
+		},
+	},
+	"whois": {
+		usage:       "whois <ip>",
+		description: "Tell who holds an address",
+		run:         (*CLI).whois,
+	},
+	"reserve": {
+		usage:       "reserve --name <name> [--namespace <namespace>] (--subnet <cidr> [--resourcename <name>] [--ip <ip>] | --sriovnetworks <annotation>)",
+		description: "Keep addresses out of the pools without any workload",
+		run:         (*CLI).reserve,
+		flags: func(flags *flag.FlagSet) {
+			flags.String("name", "", "Name of the reservation and of the NetworkAttachmentDefinition of a requested ip")
+			flags.String("namespace", "default", "Namespace of the reservation")
+			flags.String("subnet", "", "Subnet of the pool to reserve from")
+			flags.String("resourcename", "", "Resource name of the pool to reserve from")
+			flags.String("ip", "", "Address to reserve, the next free address of the pool when empty")
+			flags.String("sriovnetworks", "", "sriovnetworks annotation requesting the addresses to reserve")
+		},
+	},
+	"release": {
+		usage:       "release <ip>",
+		description: "Release a reserved address, or the address of an orphaned NetworkAttachmentDefinition",
+		run:         (*CLI).release,
+	},
+	"render": {
+		usage:       "render [--namespace <namespace>] <annotation | ->",
+		description: "Print the NetworkAttachmentDefinitions a sriovnetworks annotation gets, - reads it from stdin",
+		run:         (*CLI).render,
+		flags: func(flags *flag.FlagSet) {
+			flags.String("namespace", "default", "Namespace of the workload carrying the annotation")
+		},
+	},
+}
+
+// CLI runs the sub commands against the allocation state of an IPManager
+type CLI struct {
+	out          io.Writer
+	in           io.Reader
+	newIPManager func(readOnly bool) (*ip_manager.IPManager, error)
+}
+
+// NewCLI returns a CLI writing to out, newIPManager returns an IPManager with the allocation state already loaded, the
+// commands only inspecting the allocations ask for a readOnly one that does not write the allocation ledger
+func NewCLI(out io.Writer, newIPManager func(readOnly bool) (*ip_manager.IPManager, error)) *CLI {
+	return &CLI{out: out, in: os.Stdin, newIPManager: newIPManager}
+}
+
+// Run runs the sub command named by the first argument
+func (c *CLI) Run(args []string) error {
+	if len(args) == 0 {
+		c.Usage()
+		return fmt.Errorf("missing command")
+	}
+	cmd, exist := commands[args[0]]
+	if !exist {
+		c.Usage()
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(c.out)
+	flags.Usage = func() {
+		fmt.Fprintf(c.out, "Usage: kubeipfixed %s\n\n%s\n", cmd.usage, cmd.description)
+		flags.PrintDefaults()
+	}
+	if cmd.flags != nil {
+		cmd.flags(flags)
+	}
+	err := flags.Parse(args[1:])
+	if err == flag.ErrHelp {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return cmd.run(c, flags, flags.Args())
+}
+
+// Usage prints the sub commands
+func (c *CLI) Usage() {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(c.out, "Usage: kubeipfixed [--kubeconfig <path>] <command> [flags]")
+	fmt.Fprintln(c.out, "\nCommands:")
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", name, commands[name].description)
+	}
+	w.Flush()
+}
+
+func (c *CLI) pools(_ *flag.FlagSet, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("pools takes no argument")
+	}
+	ipManager, err := c.newIPManager(true)
+	if err != nil {
+		return err
+	}
+	usages, err := ipManager.PoolsUsage()
+	if err != nil {
+		return errors.Wrap(err, "failed to list the ip pools")
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tFAMILY\tSUBNET\tTOTAL\tALLOCATED\tFREE")
+	for _, usage := range usages {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", usage.Name, usage.Family, usage.Subnet, usage.Total, usage.Allocated, usage.Free())
+	}
+	return w.Flush()
+}
+
+func (c *CLI) allocations(flags *flag.FlagSet, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("allocations takes no argument")
+	}
+	ipManager, err := c.newIPManager(true)
+	if err != nil {
+		return err
+	}
+	return c.printAllocations(ipManager.Allocations(flags.Lookup("pool").Value.String()))
+}
+
+func (c *CLI) whois(_ *flag.FlagSet, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("whois takes an ip")
+	}
+	ipManager, err := c.newIPManager(true)
+	if err != nil {
+		return err
+	}
+	allocation, err := ipManager.Whois(args[0])
+	if err != nil {
+		return err
+	}
+	if allocation == nil {
+		fmt.Fprintf(c.out, "%s is free\n", args[0])
+		return nil
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(w, "IP:\t%s\n", allocation.IP)
+	fmt.Fprintf(w, "Holder:\t%s\n", allocation.Holder)
+	fmt.Fprintf(w, "Pool:\t%s\n", orNone(allocation.Pool))
+	fmt.Fprintf(w, "NetworkAttachmentDefinition:\t%s\n", orNone(allocation.NetAttDef))
+	fmt.Fprintf(w, "MAC:\t%s\n", orNone(allocation.MAC))
+	fmt.Fprintf(w, "Interface:\t%s\n", orNone(allocation.Interface))
+	fmt.Fprintf(w, "Observed MAC:\t%s\n", orNone(allocation.ObservedMAC))
+	fmt.Fprintf(w, "State:\t%s\n", allocationState(allocation))
+	return w.Flush()
+}
+
+func (c *CLI) reserve(flags *flag.FlagSet, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("reserve takes no argument")
+	}
+	value := func(name string) string { return flags.Lookup(name).Value.String() }
+	name := types.NamespacedName{Namespace: value("namespace"), Name: value("name")}
+	if name.Name == "" {
+		return fmt.Errorf("reserve needs a --name")
+	}
+
+	sriovNetworks := value("sriovnetworks")
+	switch {
+	case sriovNetworks != "" && (value("subnet") != "" || value("ip") != ""):
+		return fmt.Errorf("--sriovnetworks can not be combined with --subnet nor --ip")
+	case sriovNetworks == "":
+		request := map[string]interface{}{"subnet": value("subnet"), "resourcename": value("resourcename")}
+		if value("ip") != "" {
+			request["ippool"] = []map[string]string{{"name": name.Name, "address": value("ip")}}
+		}
+		raw, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		sriovNetworks = string(raw)
+	}
+
+	ipManager, err := c.newIPManager(false)
+	if err != nil {
+		return err
+	}
+	reserved, err := ipManager.Reserve(name, sriovNetworks)
+	if err != nil {
+		return err
+	}
+	return c.printAllocations(reserved)
+}
+
+func (c *CLI) release(_ *flag.FlagSet, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("release takes an ip")
+	}
+	ipManager, err := c.newIPManager(false)
+	if err != nil {
+		return err
+	}
+	released, err := ipManager.Release(args[0])
+	if err != nil {
+		return err
+	}
+	for _, allocation := range released {
+		fmt.Fprintf(c.out, "released %s held by %s\n", allocation.IP, allocation.Holder)
+	}
+	return nil
+}
+
+func (c *CLI) render(flags *flag.FlagSet, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("render takes a sriovnetworks annotation")
+	}
+	sriovNetworks := args[0]
+	if sriovNetworks == "-" {
+		raw, err := ioutil.ReadAll(c.in)
+		if err != nil {
+			return err
+		}
+		sriovNetworks = string(raw)
+	}
+
+	ipManager, err := c.newIPManager(true)
+	if err != nil {
+		return err
+	}
+	netAttDefs, err := ipManager.RenderNetworks(flags.Lookup("namespace").Value.String(), strings.TrimSpace(sriovNetworks))
+	if err != nil {
+		return err
+	}
+	for i, netAttDef := range netAttDefs {
+		netAttDef.SetGroupVersionKind(netattdefv1.SchemeGroupVersion.WithKind("NetworkAttachmentDefinition"))
+		raw, err := yaml.Marshal(netAttDef)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(c.out, "---")
+		}
+		fmt.Fprint(c.out, string(raw))
+	}
+	return nil
+}
+
+func (c *CLI) printAllocations(allocations []ip_manager.Allocation) error {
+	w := tabwriter.NewWriter(c.out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "IP\tPOOL\tHOLDER\tNETWORKATTACHMENTDEFINITION\tMAC\tINTERFACE\tOBSERVED-MAC\tSTATE")
+	for i := range allocations {
+		allocation := &allocations[i]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", allocation.IP, orNone(allocation.Pool), allocation.Holder,
+			orNone(allocation.NetAttDef), orNone(allocation.MAC), orNone(allocation.Interface), orNone(allocation.ObservedMAC),
+			allocationState(allocation))
+	}
+	return w.Flush()
+}
+
+func allocationState(allocation *ip_manager.Allocation) string {
+	if allocation.Pending {
+		return "pending"
+	}
+	return "committed"
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "<none>"
+	}
+	return value
+}
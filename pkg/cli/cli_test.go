@@ -0,0 +1,139 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+	ip_manager "github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+)
+
+var _ = Describe("CLI", func() {
+	var out *bytes.Buffer
+	var commandLine *CLI
+	var fakeClient client.Client
+
+	BeforeEach(func() {
+		scheme := runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(appsv1.AddToScheme(scheme)).To(Succeed())
+		Expect(netattdefv1.AddToScheme(scheme)).To(Succeed())
+		Expect(ippoolv1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		pool := &ippoolv1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "sriov-n3"},
+			Spec: ippoolv1alpha1.IPPoolSpec{
+				Subnet:       "100.100.100.0/24",
+				Ranges:       []ippoolv1alpha1.IPRange{{Start: "100.100.100.100", End: "100.100.100.109"}},
+				Gateway:      "100.100.100.1",
+				ResourceName: "mecdev.com/intel2v2nics",
+			},
+		}
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod-1", Namespace: "default", Annotations: map[string]string{
+			"k8s.v1.cni.cncf.io/sriovnetworks": `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics",` +
+				` "ippool": [{"name": "sriov-n3-static-100-100-100-100", "address": "100.100.100.100/24"}]}`,
+		}}}
+		fakeClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects([]client.Object{pool, pod}...).Build()
+
+		out = &bytes.Buffer{}
+		// every command rebuilds the state from the cluster, like the kubeipfixed binary does
+		commandLine = NewCLI(out, func(readOnly bool) (*ip_manager.IPManager, error) {
+			ipManager, err := ip_manager.NewIPManager(fakeClient, fakeClient, "kubeipfixed-system", false, 600, scheme, nil)
+			if err != nil {
+				return nil, err
+			}
+			return ipManager, ipManager.LoadState(readOnly)
+		})
+	})
+
+	run := func(args ...string) string {
+		out.Reset()
+		ExpectWithOffset(1, commandLine.Run(args)).To(Succeed())
+		return out.String()
+	}
+
+	// rows splits the table printed by a command into its cells
+	rows := func(table string) [][]string {
+		cells := [][]string{}
+		for _, line := range strings.Split(strings.TrimSpace(table), "\n") {
+			cells = append(cells, strings.Fields(line))
+		}
+		return cells
+	}
+
+	It("should list the pools and the allocations", func() {
+		Expect(rows(run("pools"))).To(Equal([][]string{
+			{"NAME", "FAMILY", "SUBNET", "TOTAL", "ALLOCATED", "FREE"},
+			{"sriov-n3", "ipv4", "100.100.100.0/24", "10", "1", "9"},
+		}))
+		Expect(rows(run("allocations", "--pool", "sriov-n3"))).To(Equal([][]string{
+			{"IP", "POOL", "HOLDER", "NETWORKATTACHMENTDEFINITION", "MAC", "INTERFACE", "OBSERVED-MAC", "STATE"},
+			{"100.100.100.100", "sriov-n3", "pod/default/pod-1", "default/sriov-n3-static-100-100-100-100", "<none>", "<none>", "<none>", "committed"},
+		}))
+		Expect(rows(run("allocations", "--pool", "other"))).To(HaveLen(1))
+	})
+
+	It("should tell who holds an address", func() {
+		Expect(rows(run("whois", "100.100.100.100"))).To(ContainElement([]string{"Holder:", "pod/default/pod-1"}))
+		Expect(run("whois", "100.100.100.101")).To(Equal("100.100.100.101 is free\n"))
+	})
+
+	It("should reserve and release an address", func() {
+		Expect(rows(run("reserve", "--name", "keep-n3", "--subnet", "100.100.100.0/24", "--resourcename", "mecdev.com/intel2v2nics"))[1]).
+			To(Equal([]string{"100.100.100.101", "sriov-n3", "reservation/default/keep-n3", "default/sriov-n3-static-100-100-100-101", "<none>", "<none>", "<none>", "committed"}))
+		Expect(run("whois", "100.100.100.101")).To(ContainSubstring("reservation/default/keep-n3"))
+
+		Expect(commandLine.Run([]string{"release", "100.100.100.100"})).To(MatchError(
+			"address 100.100.100.100 is held by pod/default/pod-1, it is released with its workload"))
+		Expect(run("release", "100.100.100.101")).To(Equal("released 100.100.100.101 held by reservation/default/keep-n3\n"))
+		Expect(run("whois", "100.100.100.101")).To(Equal("100.100.100.101 is free\n"))
+	})
+
+	It("should inspect the allocations without writing the ledger", func() {
+		run("reserve", "--name", "keep-n3", "--subnet", "100.100.100.0/24", "--resourcename", "mecdev.com/intel2v2nics")
+		ledger := &corev1.ConfigMapList{}
+		Expect(fakeClient.List(context.TODO(), ledger, client.InNamespace("kubeipfixed-system"))).To(Succeed())
+		Expect(ledger.Items).To(HaveLen(1))
+
+		// a pod admitted while the manager was down is missing from the ledger
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod-2", Namespace: "default", Annotations: map[string]string{
+			"k8s.v1.cni.cncf.io/sriovnetworks": `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics",` +
+				` "ippool": [{"name": "sriov-n3-static-100-100-100-105", "address": "100.100.100.105/24"}]}`,
+		}}}
+		Expect(fakeClient.Create(context.TODO(), pod)).To(Succeed())
+		Expect(run("whois", "100.100.100.105")).To(ContainSubstring("pod/default/pod-2"))
+		Expect(rows(run("pools"))[1]).To(Equal([]string{"sriov-n3", "ipv4", "100.100.100.0/24", "10", "3", "7"}))
+		Expect(rows(run("allocations"))).To(HaveLen(4))
+
+		recorded := &corev1.ConfigMapList{}
+		Expect(fakeClient.List(context.TODO(), recorded, client.InNamespace("kubeipfixed-system"))).To(Succeed())
+		Expect(recorded.Items).To(Equal(ledger.Items))
+	})
+
+	It("should render the NetworkAttachmentDefinition of an annotation", func() {
+		commandLine.in = strings.NewReader(`{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+		rendered := run("render", "--namespace", "web", "-")
+		Expect(rendered).To(ContainSubstring("kind: NetworkAttachmentDefinition\n"))
+		Expect(rendered).To(ContainSubstring("name: sriov-n3-static-100-100-100-101\n"))
+		Expect(rendered).To(ContainSubstring("namespace: web\n"))
+		Expect(run("whois", "100.100.100.101")).To(Equal("100.100.100.101 is free\n"))
+	})
+
+	It("should reject unknown commands and bad arguments", func() {
+		Expect(commandLine.Run([]string{"status"})).To(MatchError(`unknown command "status"`))
+		Expect(commandLine.Run([]string{"whois"})).To(MatchError("whois takes an ip"))
+		Expect(commandLine.Run([]string{"reserve", "--subnet", "100.100.100.0/24"})).To(MatchError("reserve needs a --name"))
+	})
+})
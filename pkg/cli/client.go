@@ -0,0 +1,57 @@
+package cli
+
+import (
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	kubevirt_api "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/config"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+	ip_manager "github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+)
+
+// NewClusterIPManager returns an IPManager working on the cluster of the kubeconfig, its allocation state is rebuilt
+// the same way the manager does on start, without writing the allocation ledger when readOnly is set.
+// managerNamespace is the namespace of the manager, where the NetworkAttachmentDefinition templates of the pools are.
+func NewClusterIPManager(managerNamespace string, readOnly bool) (*ip_manager.IPManager, error) {
+	cfg, err := config.GetConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to set up client config")
+	}
+
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, kubevirt_api.AddToScheme, netattdefv1.AddToScheme, ippoolv1alpha1.AddToScheme} {
+		err = addToScheme(scheme)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to register the schemes")
+		}
+	}
+
+	kubeClient, err := client.New(cfg, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed creating the client")
+	}
+
+	// the virtual machines hold addresses only when kubevirt is installed
+	_, err = kubeClient.RESTMapper().RESTMapping(schema.GroupKind{Group: kubevirt_api.GroupVersion.Group, Kind: "VirtualMachine"})
+	if err != nil && !meta.IsNoMatchError(err) {
+		return nil, errors.Wrap(err, "failed to check for kubevirt")
+	}
+	isKubevirtInstalled := err == nil
+
+	// the cli records no Events
+	ipManager, err := ip_manager.NewIPManager(kubeClient, kubeClient, managerNamespace, isKubevirtInstalled, 0, scheme, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = ipManager.LoadState(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return ipManager, nil
+}
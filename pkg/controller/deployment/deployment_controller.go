@@ -0,0 +1,80 @@
+package deployment
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+)
+
+var log = logf.Log.WithName("Deployment Controller")
+
+// Add creates a new Deployment Controller and adds it to the Manager. The Manager will set fields on the Controller
+// and Start it when the Manager is Started.
+func Add(mgr manager.Manager, poolManager *ip_manager.IPManager) error {
+	return add(mgr, newReconciler(mgr, poolManager))
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, poolManager *ip_manager.IPManager) reconcile.Reconciler {
+	return &ReconcilePolicy{Client: mgr.GetClient(), scheme: mgr.GetScheme(), poolManager: poolManager}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler) error {
+	// Create a new controller
+	c, err := controller.New("deployment-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to Deployment, the status changes tell when the pods of a scale down are gone
+	err = c.Watch(&source.Kind{Type: &appsv1.Deployment{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+var _ reconcile.Reconciler = &ReconcilePolicy{}
+
+// ReconcilePolicy reconciles a Deployment object
+type ReconcilePolicy struct {
+	client.Client
+	scheme      *runtime.Scheme
+	poolManager *ip_manager.IPManager
+}
+
+// Reconcile shrinks the ip set of the Deployment to its replicas and releases it once the Deployment is deleted
+func (r *ReconcilePolicy) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	logger := log.WithName("Reconcile").WithValues("deploymentName", request.Name, "deploymentNamespace", request.Namespace)
+	logger.V(1).Info("got a deployment event in the controller")
+
+	deployment := &appsv1.Deployment{}
+	err := r.Get(ctx, request.NamespacedName, deployment)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			logger.Error(err, "failed to get deployment")
+			return reconcile.Result{}, err
+		}
+		// the deployment was deleted, release its whole ip set
+		deployment = nil
+	}
+
+	err = r.poolManager.ReleaseDeploymentIPs(request.NamespacedName, deployment)
+	if err != nil {
+		logger.Error(err, "failed to release the deployment ip set")
+	}
+	return reconcile.Result{}, err
+}
@@ -0,0 +1,93 @@
+package netattdef
+
+import (
+	"context"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+)
+
+var log = logf.Log.WithName("NetworkAttachmentDefinition Controller")
+
+// Add creates a new NetworkAttachmentDefinition Controller tracking the reservations and adds it to the Manager.
+// The Manager will set fields on the Controller and Start it when the Manager is Started.
+func Add(mgr manager.Manager, poolManager *ip_manager.IPManager) error {
+	return add(mgr, newReconciler(mgr, poolManager))
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, poolManager *ip_manager.IPManager) reconcile.Reconciler {
+	return &ReconcilePolicy{
+		Client:      mgr.GetClient(),
+		scheme:      mgr.GetScheme(),
+		recorder:    mgr.GetEventRecorderFor("kubeipfixed"),
+		poolManager: poolManager,
+	}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler) error {
+	// Create a new controller
+	c, err := controller.New("netattdef-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to the NetworkAttachmentDefinitions rendered by kubeipfixed only
+	err = c.Watch(&source.Kind{Type: &netattdefv1.NetworkAttachmentDefinition{}}, &handler.EnqueueRequestForObject{},
+		predicate.NewPredicateFuncs(ip_manager.IsManagedNetAttDef))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+var _ reconcile.Reconciler = &ReconcilePolicy{}
+
+// ReconcilePolicy reconciles a NetworkAttachmentDefinition object
+type ReconcilePolicy struct {
+	client.Client
+	scheme      *runtime.Scheme
+	recorder    record.EventRecorder
+	poolManager *ip_manager.IPManager
+}
+
+// Reconcile reserves the addresses of the reservations made by the kubeipfixed CLI and releases them once their
+// NetworkAttachmentDefinition is deleted. A reservation of an address held by a workload is reported by a warning Event.
+func (r *ReconcilePolicy) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	logger := log.WithName("Reconcile").WithValues("netAttDefName", request.Name, "netAttDefNamespace", request.Namespace)
+	logger.V(1).Info("got a network attachment definition event in the controller")
+
+	netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+	err := r.Get(ctx, request.NamespacedName, netAttDef)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			logger.Error(err, "failed to get network attachment definition")
+			return reconcile.Result{}, err
+		}
+		netAttDef = nil
+	}
+
+	err = r.poolManager.SyncReservation(request.NamespacedName, netAttDef)
+	if err != nil {
+		logger.Error(err, "failed to sync the reservation")
+		if netAttDef != nil {
+			r.recorder.Eventf(netAttDef, corev1.EventTypeWarning, "IPConflict", "reservation failed: %v", err)
+		}
+	}
+	return reconcile.Result{}, err
+}
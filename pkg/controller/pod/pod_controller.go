@@ -19,6 +19,7 @@ package pod
 import (
 	"context"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
@@ -29,6 +30,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	"github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+	"github.com/wenwenxiong/kubeipfixed/pkg/utils"
 )
 
 var log = logf.Log.WithName("Pod Controller")
@@ -75,5 +77,60 @@ func (r *ReconcilePolicy) Reconcile(ctx context.Context, request reconcile.Reque
 	logger := log.WithName("Reconcile").WithValues("podName", request.Name, "podNamespace", request.Namespace)
 	logger.V(1).Info("got a pod event in the controller")
 
+	pod := &corev1.Pod{}
+	err := r.Get(ctx, request.NamespacedName, pod)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// the pod is already gone, release whatever is still recorded under its name or used by it in an ip set
+			pod.Name = request.Name
+			pod.Namespace = request.Namespace
+			return reconcile.Result{}, r.poolManager.ReleasePodIPs(pod)
+		}
+		logger.Error(err, "failed to get pod")
+		return reconcile.Result{}, err
+	}
+
+	if pod.ObjectMeta.DeletionTimestamp.IsZero() {
+		// the pod exists, commit the allocation the webhook left pending
+		err = r.poolManager.MarkPodAsReady(pod)
+		if err != nil {
+			logger.Error(err, "failed to commit the pod fixed ips")
+			return reconcile.Result{}, err
+		}
+
+		// record the interfaces, MACs and ips the pod got once multus attached its networks
+		changed, err := r.poolManager.UpdatePodNetworkStatus(pod)
+		if err != nil {
+			logger.Error(err, "failed to update the pod network status")
+			return reconcile.Result{}, err
+		}
+		if changed {
+			err = r.Update(ctx, pod)
+			if err != nil {
+				logger.Error(err, "failed to update the pod status annotation")
+				return reconcile.Result{}, err
+			}
+		}
+		return reconcile.Result{}, nil
+	}
+
+	if !utils.ContainsString(pod.ObjectMeta.Finalizers, ip_manager.ReleaseIPFinalizer) {
+		return reconcile.Result{}, nil
+	}
+
+	logger.Info("pod is being deleted, releasing its fixed ips")
+	err = r.poolManager.ReleasePodIPs(pod)
+	if err != nil {
+		logger.Error(err, "failed to release the pod fixed ips")
+		return reconcile.Result{}, err
+	}
+
+	pod.ObjectMeta.Finalizers = utils.RemoveString(pod.ObjectMeta.Finalizers, ip_manager.ReleaseIPFinalizer)
+	err = r.Update(ctx, pod)
+	if err != nil {
+		logger.Error(err, "failed to remove the finalizer from the pod")
+		return reconcile.Result{}, err
+	}
+
 	return reconcile.Result{}, nil
 }
@@ -0,0 +1,92 @@
+package statefulset
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+)
+
+var log = logf.Log.WithName("StatefulSet Controller")
+
+// Add creates a new StatefulSet Controller and adds it to the Manager. The Manager will set fields on the Controller
+// and Start it when the Manager is Started.
+func Add(mgr manager.Manager, poolManager *ip_manager.IPManager) error {
+	return add(mgr, newReconciler(mgr, poolManager))
+}
+
+// newReconciler returns a new reconcile.Reconciler
+func newReconciler(mgr manager.Manager, poolManager *ip_manager.IPManager) reconcile.Reconciler {
+	return &ReconcilePolicy{Client: mgr.GetClient(), scheme: mgr.GetScheme(), poolManager: poolManager}
+}
+
+// add adds a new Controller to mgr with r as the reconcile.Reconciler
+func add(mgr manager.Manager, r reconcile.Reconciler) error {
+	// Create a new controller
+	c, err := controller.New("statefulset-controller", mgr, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to StatefulSet, the replicas and status changes tell when ordinals are removed
+	err = c.Watch(&source.Kind{Type: &appsv1.StatefulSet{}}, &handler.EnqueueRequestForObject{})
+	if err != nil {
+		return err
+	}
+
+	// Watch for changes to the pods of the StatefulSets, the address of a removed ordinal is released once its pod is gone
+	err = c.Watch(&source.Kind{Type: &corev1.Pod{}}, ownedPodsHandler())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ownedPodsHandler enqueues the StatefulSet controlling a pod
+func ownedPodsHandler() handler.EventHandler {
+	return &handler.EnqueueRequestForOwner{OwnerType: &appsv1.StatefulSet{}, IsController: true}
+}
+
+var _ reconcile.Reconciler = &ReconcilePolicy{}
+
+// ReconcilePolicy reconciles a StatefulSet object
+type ReconcilePolicy struct {
+	client.Client
+	scheme      *runtime.Scheme
+	poolManager *ip_manager.IPManager
+}
+
+// Reconcile releases the sticky ips of the StatefulSet ordinals that are gone
+func (r *ReconcilePolicy) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	logger := log.WithName("Reconcile").WithValues("statefulSetName", request.Name, "statefulSetNamespace", request.Namespace)
+	logger.V(1).Info("got a statefulset event in the controller")
+
+	statefulSet := &appsv1.StatefulSet{}
+	err := r.Get(ctx, request.NamespacedName, statefulSet)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			logger.Error(err, "failed to get statefulset")
+			return reconcile.Result{}, err
+		}
+		// the statefulset was deleted, release all the ips of its ordinals
+		statefulSet = nil
+	}
+
+	err = r.poolManager.ReleaseStatefulSetIPs(request.NamespacedName, statefulSet)
+	if err != nil {
+		logger.Error(err, "failed to release the statefulset sticky ips")
+	}
+	return reconcile.Result{}, err
+}
@@ -0,0 +1,125 @@
+package statefulset
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+	ip_manager "github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+)
+
+var _ = Describe("StatefulSet Controller", func() {
+	var scheme *runtime.Scheme
+	var fakeClient client.Client
+	var ipManager *ip_manager.IPManager
+	var reconciler *ReconcilePolicy
+	var statefulSet *appsv1.StatefulSet
+	request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "web"}}
+
+	newPod := func(name string) *corev1.Pod {
+		isController := true
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Annotations: map[string]string{
+				"k8s.v1.cni.cncf.io/sriovnetworks": `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`,
+			},
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "web", UID: "uid-1", Controller: &isController}},
+		}}
+	}
+
+	BeforeEach(func() {
+		scheme = runtime.NewScheme()
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		Expect(appsv1.AddToScheme(scheme)).To(Succeed())
+		Expect(netattdefv1.AddToScheme(scheme)).To(Succeed())
+		Expect(ippoolv1alpha1.AddToScheme(scheme)).To(Succeed())
+
+		pool := &ippoolv1alpha1.IPPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "sriov-n3"},
+			Spec: ippoolv1alpha1.IPPoolSpec{
+				Subnet:       "100.100.100.0/24",
+				Ranges:       []ippoolv1alpha1.IPRange{{Start: "100.100.100.100", End: "100.100.100.109"}},
+				Gateway:      "100.100.100.1",
+				ResourceName: "mecdev.com/intel2v2nics",
+			},
+		}
+		replicas := int32(2)
+		statefulSet = &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "uid-1"},
+			Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+		}
+		fakeClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(pool, statefulSet).Build()
+
+		var err error
+		ipManager, err = ip_manager.NewIPManager(fakeClient, fakeClient, "kubeipfixed-system", false, 600, scheme, &record.FakeRecorder{})
+		Expect(err).ToNot(HaveOccurred())
+		reconciler = &ReconcilePolicy{Client: fakeClient, scheme: scheme, poolManager: ipManager}
+
+		transactionTimestamp := ip_manager.CreateTransactionTimestamp()
+		for _, name := range []string{"web-0", "web-1"} {
+			pod := newPod(name)
+			Expect(ipManager.AllocatePodIP(pod, &transactionTimestamp, true)).To(Succeed())
+			Expect(ipManager.MarkPodAsReady(pod)).To(Succeed())
+			Expect(fakeClient.Create(context.TODO(), pod)).To(Succeed())
+		}
+	})
+
+	It("should release the ip of a removed ordinal once its pod is gone", func() {
+		replicas := int32(1)
+		statefulSet.Spec.Replicas = &replicas
+		Expect(fakeClient.Update(context.TODO(), statefulSet)).To(Succeed())
+
+		// the pod of the removed ordinal is still terminating when the scale down is reconciled
+		pod := &corev1.Pod{}
+		Expect(fakeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "web-1"}, pod)).To(Succeed())
+		Expect(fakeClient.Delete(context.TODO(), pod)).To(Succeed())
+		Expect(reconciler.Reconcile(context.TODO(), request)).To(Equal(reconcile.Result{}))
+		allocation, err := ipManager.Whois("100.100.100.101")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(allocation).ToNot(BeNil())
+
+		// the pod is gone once the pod controller removed its finalizer, the removal enqueues its StatefulSet
+		Expect(fakeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "web-1"}, pod)).To(Succeed())
+		Expect(ipManager.ReleasePodIPs(pod)).To(Succeed())
+		pod.Finalizers = nil
+		Expect(fakeClient.Update(context.TODO(), pod)).To(Succeed())
+		Expect(fakeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "web-1"}, &corev1.Pod{})).ToNot(Succeed())
+		mapper := meta.NewDefaultRESTMapper(nil)
+		mapper.Add(appsv1.SchemeGroupVersion.WithKind("StatefulSet"), meta.RESTScopeNamespace)
+		podsHandler := ownedPodsHandler()
+		Expect(podsHandler.(*handler.EnqueueRequestForOwner).InjectScheme(scheme)).To(Succeed())
+		Expect(podsHandler.(*handler.EnqueueRequestForOwner).InjectMapper(mapper)).To(Succeed())
+		queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+		defer queue.ShutDown()
+		podsHandler.Delete(event.DeleteEvent{Object: pod}, queue)
+		Expect(queue.Len()).To(Equal(1))
+		item, _ := queue.Get()
+		Expect(item).To(Equal(request))
+
+		Expect(reconciler.Reconcile(context.TODO(), item.(reconcile.Request))).To(Equal(reconcile.Result{}))
+		allocation, err = ipManager.Whois("100.100.100.101")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(allocation).To(BeNil())
+		allocation, err = ipManager.Whois("100.100.100.100")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(allocation.Holder).To(Equal("statefulset/default/web (pod web-0)"))
+	})
+})
@@ -0,0 +1,13 @@
+package statefulset
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestStatefulSet(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "StatefulSet Controller Suite")
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"math/rand"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	kubevirt "kubevirt.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -32,6 +33,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	ip_manager "github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+	"github.com/wenwenxiong/kubeipfixed/pkg/utils"
 )
 
 var log = logf.Log.WithName("VirtualMachine Controller")
@@ -86,6 +88,43 @@ func (r *ReconcilePolicy) Reconcile(ctx context.Context, request reconcile.Reque
 
 	instance := &kubevirt.VirtualMachine{}
 	err := r.Get(ctx, request.NamespacedName, instance)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// the virtual machine is already gone, release whatever is still recorded under its name
+			instance.Name = request.Name
+			instance.Namespace = request.Namespace
+			return reconcile.Result{}, r.poolManager.ReleaseVirtualMachineIPs(instance)
+		}
+		logger.Error(err, "failed to get virtual machine")
+		return reconcile.Result{}, err
+	}
+
+	if instance.ObjectMeta.DeletionTimestamp.IsZero() {
+		// the virtual machine exists, commit the allocation the webhook left pending
+		err = r.poolManager.MarkVMAsReady(instance)
+		if err != nil {
+			logger.Error(err, "failed to commit the virtual machine fixed ips")
+		}
+		return reconcile.Result{}, err
+	}
+
+	if !utils.ContainsString(instance.ObjectMeta.Finalizers, ip_manager.ReleaseIPFinalizer) {
+		return reconcile.Result{}, nil
+	}
+
+	logger.Info("virtual machine is being deleted, releasing its fixed ips")
+	err = r.poolManager.ReleaseVirtualMachineIPs(instance)
+	if err != nil {
+		logger.Error(err, "failed to release the virtual machine fixed ips")
+		return reconcile.Result{}, err
+	}
+
+	instance.ObjectMeta.Finalizers = utils.RemoveString(instance.ObjectMeta.Finalizers, ip_manager.ReleaseIPFinalizer)
+	err = r.Update(ctx, instance)
+	if err != nil {
+		logger.Error(err, "failed to remove the finalizer from the virtual machine")
+		return reconcile.Result{}, err
+	}
 
-	return reconcile.Result{}, err
+	return reconcile.Result{}, nil
 }
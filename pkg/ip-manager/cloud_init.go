@@ -0,0 +1,192 @@
+package ip_manager
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+	kubevirt "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const cloudInitNetworkVolumeName = "kubeipfixed-cloudinit"
+
+// netplanEthernets returns the netplan v2 ethernets configuring the fixed addresses inside the guest.
+// The SR-IOV NIC is matched by its MAC address when the virtual machine interface has one, otherwise
+// by the guest interface name requested in the annotation.
+func netplanEthernets(networks *sriovNetwork, interfaces []kubevirt.Interface, vmNetworks []kubevirt.Network) map[string]interface{} {
+	ethernets := map[string]interface{}{}
+	for _, network := range networks.IPPool {
+		vmNetworkName := attachedNetworkName(vmNetworks, fmt.Sprintf("%s/%s", network.Namespace, network.Name))
+		if vmNetworkName == "" {
+			continue
+		}
+
+		ethernet := map[string]interface{}{
+			"addresses": network.addresses(),
+			"nameservers": map[string]interface{}{
+				"addresses": []string(network.Nameservers),
+				"search":    append([]string{}, network.Search...),
+			},
+		}
+		if len(network.Routes) != 0 {
+			routes := []map[string]interface{}{}
+			for _, route := range network.Routes {
+				netplanRoute := map[string]interface{}{"to": route.Dst}
+				if route.Gw != "" {
+					netplanRoute["via"] = route.Gw
+				}
+				routes = append(routes, netplanRoute)
+			}
+			ethernet["routes"] = routes
+		}
+		for _, gateway := range []string{network.Gateway, network.Gateway6} {
+			switch ip := net.ParseIP(gateway); {
+			case gateway == "":
+			case ip != nil && ip.To4() == nil:
+				ethernet["gateway6"] = gateway
+			default:
+				ethernet["gateway4"] = gateway
+			}
+		}
+
+		id := vmNetworkName
+		macAddress := interfaceMacAddress(interfaces, vmNetworkName)
+		switch {
+		case macAddress != "":
+			ethernet["match"] = map[string]interface{}{"macaddress": macAddress}
+			ethernet["set-name"] = vmNetworkName
+			if network.Interface != "" {
+				ethernet["set-name"] = network.Interface
+			}
+		case network.Interface != "":
+			id = network.Interface
+		default:
+			log.Info("the sriov interface has neither a mac address nor a guest interface name, the guest can not match it",
+				"vmNetworkName", vmNetworkName)
+		}
+		ethernets[id] = ethernet
+	}
+	return ethernets
+}
+
+func attachedNetworkName(vmNetworks []kubevirt.Network, multusNetworkName string) string {
+	for _, vmNetwork := range vmNetworks {
+		if vmNetwork.Multus != nil && vmNetwork.Multus.NetworkName == multusNetworkName {
+			return vmNetwork.Name
+		}
+	}
+	return ""
+}
+
+func interfaceMacAddress(interfaces []kubevirt.Interface, name string) string {
+	for _, iface := range interfaces {
+		if iface.Name == name {
+			return iface.MacAddress
+		}
+	}
+	return ""
+}
+
+// mergeNetworkData adds the ethernets to a netplan v2 network data document, replacing the ones with the same id.
+// Both the bare form and the one wrapped into a top level network key are supported.
+func mergeNetworkData(networkData string, ethernets map[string]interface{}) (string, error) {
+	document := map[string]interface{}{}
+	if networkData != "" {
+		err := yaml.Unmarshal([]byte(networkData), &document)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to parse the cloud-init network data")
+		}
+	}
+
+	root := document
+	if wrapped, ok := document["network"].(map[string]interface{}); ok {
+		root = wrapped
+	}
+	if version, ok := root["version"]; ok && fmt.Sprint(version) != "2" {
+		return "", fmt.Errorf("only netplan version 2 cloud-init network data can be merged, got version %v", version)
+	}
+	root["version"] = 2
+
+	existing, ok := root["ethernets"].(map[string]interface{})
+	if !ok {
+		existing = map[string]interface{}{}
+	}
+	for id, ethernet := range ethernets {
+		existing[id] = ethernet
+	}
+	root["ethernets"] = existing
+
+	merged, err := yaml.Marshal(document)
+	if err != nil {
+		return "", err
+	}
+	return string(merged), nil
+}
+
+// mergeCloudInitNetworkData writes the ethernets into the network data of the cloudInitNoCloud or cloudInitConfigDrive
+// volume of the template, adding a cloudInitNoCloud volume when there is none. It returns the updated volumes and disks,
+// nil volumes when the network data is kept in a secret the webhook can not update.
+func mergeCloudInitNetworkData(spec *kubevirt.VirtualMachineInstanceSpec, ethernets map[string]interface{}) ([]kubevirt.Volume, []kubevirt.Disk, error) {
+	volumes := make([]kubevirt.Volume, len(spec.Volumes))
+	for i := range spec.Volumes {
+		spec.Volumes[i].DeepCopyInto(&volumes[i])
+	}
+	disks := append([]kubevirt.Disk{}, spec.Domain.Devices.Disks...)
+
+	for i := range volumes {
+		var networkData, networkDataBase64 *string
+		var networkDataSecretRef bool
+		switch {
+		case volumes[i].CloudInitNoCloud != nil:
+			source := volumes[i].CloudInitNoCloud
+			networkData, networkDataBase64, networkDataSecretRef = &source.NetworkData, &source.NetworkDataBase64, source.NetworkDataSecretRef != nil
+		case volumes[i].CloudInitConfigDrive != nil:
+			source := volumes[i].CloudInitConfigDrive
+			networkData, networkDataBase64, networkDataSecretRef = &source.NetworkData, &source.NetworkDataBase64, source.NetworkDataSecretRef != nil
+		default:
+			continue
+		}
+
+		if networkDataSecretRef {
+			log.Info("the cloud-init network data is stored in a secret, the fixed ips have to be configured there",
+				"volumeName", volumes[i].Name)
+			return nil, nil, nil
+		}
+
+		if *networkDataBase64 != "" {
+			decoded, err := base64.StdEncoding.DecodeString(*networkDataBase64)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "failed to decode the cloud-init network data of volume %s", volumes[i].Name)
+			}
+			merged, err := mergeNetworkData(string(decoded), ethernets)
+			if err != nil {
+				return nil, nil, err
+			}
+			*networkDataBase64 = base64.StdEncoding.EncodeToString([]byte(merged))
+			return volumes, disks, nil
+		}
+
+		merged, err := mergeNetworkData(*networkData, ethernets)
+		if err != nil {
+			return nil, nil, err
+		}
+		*networkData = merged
+		return volumes, disks, nil
+	}
+
+	networkData, err := mergeNetworkData("", ethernets)
+	if err != nil {
+		return nil, nil, err
+	}
+	volumes = append(volumes, kubevirt.Volume{
+		Name:         cloudInitNetworkVolumeName,
+		VolumeSource: kubevirt.VolumeSource{CloudInitNoCloud: &kubevirt.CloudInitNoCloudSource{NetworkData: networkData}},
+	})
+	disks = append(disks, kubevirt.Disk{
+		Name:       cloudInitNetworkVolumeName,
+		DiskDevice: kubevirt.DiskDevice{Disk: &kubevirt.DiskTarget{Bus: "virtio"}},
+	})
+	return volumes, disks, nil
+}
@@ -0,0 +1,148 @@
+package ip_manager
+
+import (
+	"encoding/base64"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	kubevirt "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+var _ = Describe("Cloud-init network data", func() {
+	networks := &sriovNetwork{
+		IPPool: []sriovIpAddress{{
+			Name:        "sriov-n3-static-100-100-100-100",
+			Namespace:   "default",
+			Address:     "100.100.100.100/24",
+			Gateway:     "100.100.100.1",
+			Nameservers: nameserverList{"114.114.114.114"},
+		}},
+	}
+	vmNetworks := []kubevirt.Network{{
+		Name:          "sriov-net0",
+		NetworkSource: kubevirt.NetworkSource{Multus: &kubevirt.MultusNetwork{NetworkName: "default/sriov-n3-static-100-100-100-100"}},
+	}}
+
+	parseEthernets := func(networkData string) map[string]interface{} {
+		document := map[string]interface{}{}
+		Expect(yaml.Unmarshal([]byte(networkData), &document)).To(Succeed())
+		Expect(document["version"]).To(BeEquivalentTo(2))
+		return document["ethernets"].(map[string]interface{})
+	}
+
+	It("should match the sriov nic by mac address and rename it", func() {
+		interfaces := []kubevirt.Interface{{Name: "sriov-net0", MacAddress: "02:00:00:00:00:01"}}
+
+		ethernets := netplanEthernets(networks, interfaces, vmNetworks)
+		Expect(ethernets).To(HaveKey("sriov-net0"))
+		ethernet := ethernets["sriov-net0"].(map[string]interface{})
+		Expect(ethernet["match"]).To(Equal(map[string]interface{}{"macaddress": "02:00:00:00:00:01"}))
+		Expect(ethernet["set-name"]).To(Equal("sriov-net0"))
+		Expect(ethernet["addresses"]).To(ConsistOf("100.100.100.100/24"))
+		Expect(ethernet["gateway4"]).To(Equal("100.100.100.1"))
+	})
+
+	It("should use the guest interface name when there is no mac address", func() {
+		withInterface := &sriovNetwork{IPPool: []sriovIpAddress{networks.IPPool[0]}}
+		withInterface.IPPool[0].Interface = "eth1"
+
+		ethernets := netplanEthernets(withInterface, nil, vmNetworks)
+		Expect(ethernets).To(HaveKey("eth1"))
+		Expect(ethernets["eth1"]).ToNot(HaveKey("match"))
+	})
+
+	It("should configure both addresses and gateways of a dual-stack entry", func() {
+		dualStack := &sriovNetwork{IPPool: []sriovIpAddress{networks.IPPool[0]}}
+		dualStack.IPPool[0].Address6 = "fd00:100::100/64"
+		dualStack.IPPool[0].Gateway6 = "fd00:100::1"
+
+		ethernets := netplanEthernets(dualStack, nil, vmNetworks)
+		ethernet := ethernets["sriov-net0"].(map[string]interface{})
+		Expect(ethernet["addresses"]).To(Equal([]string{"100.100.100.100/24", "fd00:100::100/64"}))
+		Expect(ethernet["gateway4"]).To(Equal("100.100.100.1"))
+		Expect(ethernet["gateway6"]).To(Equal("fd00:100::1"))
+	})
+
+	It("should configure the routes and search domains of the entry", func() {
+		withRoutes := &sriovNetwork{IPPool: []sriovIpAddress{networks.IPPool[0]}}
+		withRoutes.IPPool[0].Search = []string{"upf.local"}
+		withRoutes.IPPool[0].Routes = []ippoolv1alpha1.Route{{Dst: "10.10.0.0/16", Gw: "100.100.100.254"}}
+
+		ethernet := netplanEthernets(withRoutes, nil, vmNetworks)["sriov-net0"].(map[string]interface{})
+		Expect(ethernet["nameservers"]).To(Equal(map[string]interface{}{"addresses": []string{"114.114.114.114"}, "search": []string{"upf.local"}}))
+		Expect(ethernet["routes"]).To(Equal([]map[string]interface{}{{"to": "10.10.0.0/16", "via": "100.100.100.254"}}))
+	})
+
+	It("should add a cloudInitNoCloud volume and disk when the template has none", func() {
+		spec := &kubevirt.VirtualMachineInstanceSpec{}
+
+		volumes, disks, err := mergeCloudInitNetworkData(spec, netplanEthernets(networks, nil, vmNetworks))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(volumes).To(HaveLen(1))
+		Expect(volumes[0].Name).To(Equal(cloudInitNetworkVolumeName))
+		Expect(parseEthernets(volumes[0].CloudInitNoCloud.NetworkData)).To(HaveKey("sriov-net0"))
+		Expect(disks).To(HaveLen(1))
+		Expect(disks[0].Name).To(Equal(cloudInitNetworkVolumeName))
+	})
+
+	It("should merge into the existing network data keeping the other ethernets", func() {
+		spec := &kubevirt.VirtualMachineInstanceSpec{Volumes: []kubevirt.Volume{{
+			Name: "cloudinitdisk",
+			VolumeSource: kubevirt.VolumeSource{CloudInitNoCloud: &kubevirt.CloudInitNoCloudSource{
+				UserData:    "#cloud-config",
+				NetworkData: "network:\n  version: 2\n  ethernets:\n    eth0:\n      dhcp4: true\n",
+			}},
+		}}}
+
+		volumes, disks, err := mergeCloudInitNetworkData(spec, netplanEthernets(networks, nil, vmNetworks))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(disks).To(BeEmpty())
+		Expect(volumes).To(HaveLen(1))
+		Expect(volumes[0].CloudInitNoCloud.UserData).To(Equal("#cloud-config"))
+
+		document := map[string]interface{}{}
+		Expect(yaml.Unmarshal([]byte(volumes[0].CloudInitNoCloud.NetworkData), &document)).To(Succeed())
+		network := document["network"].(map[string]interface{})
+		Expect(network["ethernets"]).To(HaveKey("eth0"))
+		Expect(network["ethernets"]).To(HaveKey("sriov-net0"))
+
+		Expect(spec.Volumes[0].CloudInitNoCloud.NetworkData).ToNot(ContainSubstring("sriov-net0"), "the template must not be modified")
+	})
+
+	It("should merge into base64 encoded config drive network data", func() {
+		spec := &kubevirt.VirtualMachineInstanceSpec{Volumes: []kubevirt.Volume{{
+			Name: "cloudinitdisk",
+			VolumeSource: kubevirt.VolumeSource{CloudInitConfigDrive: &kubevirt.CloudInitConfigDriveSource{
+				NetworkDataBase64: base64.StdEncoding.EncodeToString([]byte("version: 2\n")),
+			}},
+		}}}
+
+		volumes, _, err := mergeCloudInitNetworkData(spec, netplanEthernets(networks, nil, vmNetworks))
+		Expect(err).ToNot(HaveOccurred())
+		decoded, err := base64.StdEncoding.DecodeString(volumes[0].CloudInitConfigDrive.NetworkDataBase64)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(parseEthernets(string(decoded))).To(HaveKey("sriov-net0"))
+	})
+
+	It("should leave network data stored in a secret untouched", func() {
+		spec := &kubevirt.VirtualMachineInstanceSpec{Volumes: []kubevirt.Volume{{
+			Name: "cloudinitdisk",
+			VolumeSource: kubevirt.VolumeSource{CloudInitNoCloud: &kubevirt.CloudInitNoCloudSource{
+				NetworkDataSecretRef: &corev1.LocalObjectReference{Name: "network-data"},
+			}},
+		}}}
+
+		volumes, _, err := mergeCloudInitNetworkData(spec, netplanEthernets(networks, nil, vmNetworks))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(volumes).To(BeNil())
+	})
+
+	It("should reject network data that is not netplan version 2", func() {
+		_, err := mergeNetworkData("version: 1\nconfig: []\n", map[string]interface{}{})
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,275 @@
+package ip_manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	uns "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/wenwenxiong/kubeipfixed/bindata"
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+const (
+	// CNITemplatesConfigMapName is the ConfigMap of the manager namespace overriding the NetworkAttachmentDefinition
+	// template of a pool, the template of pool sriov-n3 is under the sriov-n3.yaml key
+	CNITemplatesConfigMapName = "kubeipfixed-cni-templates"
+	cniTemplateKeySuffix      = ".yaml"
+)
+
+// cniTemplates holds the parsed NetworkAttachmentDefinition templates: the defaults embedded in the binary, one per cni
+// type, and the templates overriding them for a pool
+type cniTemplates struct {
+	lock      sync.RWMutex
+	defaults  map[ippoolv1alpha1.CNIType]*template.Template
+	overrides map[string]*template.Template // by pool name
+	version   string                        // resourceVersion of the ConfigMap the overrides were loaded from
+}
+
+// newCNITemplates parses the default templates embedded in the binary
+func newCNITemplates() (*cniTemplates, error) {
+	templates := &cniTemplates{
+		defaults:  map[ippoolv1alpha1.CNIType]*template.Template{},
+		overrides: map[string]*template.Template{},
+	}
+
+	for _, cniType := range cniTypes {
+		name := cniConfigTemplate(cniType)
+		source, err := bindata.CNIConfig.ReadFile(path.Join(bindata.CNIConfigDir, name))
+		if err != nil {
+			return nil, fmt.Errorf("no default template for cni type %s: %v", cniType, err)
+		}
+		tmpl, err := parseTemplate(name, string(source), nil)
+		if err != nil {
+			return nil, err
+		}
+		templates.defaults[cniType] = tmpl
+	}
+
+	return templates, nil
+}
+
+// lookup returns the template overriding the one of the pool, the default template of the cni type otherwise
+func (t *cniTemplates) lookup(poolName string, cniType ippoolv1alpha1.CNIType) (*template.Template, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if tmpl, exist := t.overrides[poolName]; exist && poolName != "" {
+		return tmpl, nil
+	}
+	tmpl, exist := t.defaults[cniType]
+	if !exist {
+		return nil, fmt.Errorf("unsupported cni type %q", cniType)
+	}
+	return tmpl, nil
+}
+
+// load replaces the pool templates with the ones of the ConfigMap data. A template that does not parse or does not
+// render a NetworkAttachmentDefinition is rejected and the pool keeps its previous template. It returns the errors of
+// the rejected templates by ConfigMap key.
+func (t *cniTemplates) load(data map[string]string, version string) map[string]error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	overrides, rejected := parseCNITemplates(data)
+	for key := range rejected {
+		poolName := strings.TrimSuffix(key, cniTemplateKeySuffix)
+		if previous, exist := t.overrides[poolName]; exist && poolName != key {
+			overrides[poolName] = previous
+		}
+	}
+	t.overrides = overrides
+	t.version = version
+
+	return rejected
+}
+
+// loadedVersion returns the resourceVersion of the ConfigMap the templates were loaded from, empty for the defaults
+func (t *cniTemplates) loadedVersion() string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.version
+}
+
+// parseCNITemplates parses the pool templates of the ConfigMap data, it returns the valid ones by pool name and the
+// errors of the rejected ones by ConfigMap key
+func parseCNITemplates(data map[string]string) (map[string]*template.Template, map[string]error) {
+	rejected := map[string]error{}
+	overrides := map[string]*template.Template{}
+	for key, source := range data {
+		poolName := strings.TrimSuffix(key, cniTemplateKeySuffix)
+		if poolName == key || poolName == "" {
+			rejected[key] = fmt.Errorf("the key must be the name of a pool followed by %s", cniTemplateKeySuffix)
+			continue
+		}
+
+		tmpl, err := parseTemplate(key, source, nil)
+		if err == nil {
+			err = validateCNITemplate(tmpl)
+		}
+		if err != nil {
+			rejected[key] = err
+			continue
+		}
+		overrides[poolName] = tmpl
+	}
+	return overrides, rejected
+}
+
+// poolNames returns the sorted names of the pools with their own template
+func (t *cniTemplates) poolNames() []string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	names := []string{}
+	for poolName := range t.overrides {
+		names = append(names, poolName)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateCNITemplate renders the template with a sample address, it must give a NetworkAttachmentDefinition with a
+// json cni config
+func validateCNITemplate(tmpl *template.Template) error {
+	sample := &sriovIpAddress{
+		Name:        "kubeipfixed-template-validation",
+		Namespace:   "default",
+		Address:     "192.0.2.10/24",
+		Gateway:     "192.0.2.1",
+		Nameservers: nameserverList{"192.0.2.53"},
+	}
+	data := sample.renderData("example.com/resource")
+	objs, err := renderParsedTemplate(tmpl, &data)
+	if err != nil {
+		return err
+	}
+	if len(objs) != 1 || objs[0].GetKind() != "NetworkAttachmentDefinition" {
+		return fmt.Errorf("the template must render exactly one NetworkAttachmentDefinition")
+	}
+
+	config, _, err := uns.NestedString(objs[0].Object, "spec", "config")
+	if err != nil {
+		return err
+	}
+	if !json.Valid([]byte(config)) {
+		return fmt.Errorf("the rendered spec.config is not valid json: %s", config)
+	}
+	return nil
+}
+
+// CNITemplatesConfigMap returns the ConfigMap overriding the NetworkAttachmentDefinition templates of the pools
+func (p *IPManager) CNITemplatesConfigMap() types.NamespacedName {
+	return types.NamespacedName{Namespace: p.managerNamespace, Name: CNITemplatesConfigMapName}
+}
+
+// initCNITemplates loads the templates of the pools before the webhooks render anything, WatchCNITemplates reloads
+// them on change
+func (p *IPManager) initCNITemplates() error {
+	configMap := &corev1.ConfigMap{}
+	err := p.kubeClient.Get(context.TODO(), p.CNITemplatesConfigMap(), configMap)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return err
+		}
+		configMap = nil
+	}
+	p.logRejectedCNITemplates(p.LoadCNITemplates(configMap))
+	return nil
+}
+
+// WatchCNITemplates reloads the templates of the pools whenever their ConfigMap changes. The ConfigMap is watched on
+// every replica, all of them render the NetworkAttachmentDefinitions of the workloads they admit. The leader reports
+// the rejected templates by a warning Event on the ConfigMap.
+func (p *IPManager) WatchCNITemplates(mgr manager.Manager) error {
+	informer, err := p.watchManagerConfigMaps(mgr, cache.ObjectSelector{Field: fields.OneTermEqualSelector("metadata.name", CNITemplatesConfigMapName)})
+	if err != nil {
+		return errors.Wrap(err, "failed to watch the NetworkAttachmentDefinition templates")
+	}
+	elected := mgr.Elected()
+	reload := func(obj interface{}) {
+		configMap, ok := obj.(*corev1.ConfigMap)
+		if !ok {
+			return
+		}
+		select {
+		case <-elected:
+			p.reloadCNITemplates(configMap, true)
+		default:
+			p.reloadCNITemplates(configMap, false)
+		}
+	}
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    reload,
+		UpdateFunc: func(_, obj interface{}) { reload(obj) },
+		// all the pools go back to the default templates
+		DeleteFunc: func(interface{}) { p.LoadCNITemplates(nil) },
+	})
+	return nil
+}
+
+// reloadCNITemplates loads the templates of the ConfigMap delivered by the watch unless they are the loaded ones
+func (p *IPManager) reloadCNITemplates(configMap *corev1.ConfigMap, isLeader bool) {
+	if configMap.ResourceVersion == p.cniTemplates.loadedVersion() {
+		return
+	}
+	rejected := p.LoadCNITemplates(configMap)
+	p.logRejectedCNITemplates(rejected)
+	if isLeader {
+		p.recordRejectedCNITemplates(configMap, rejected)
+	}
+}
+
+// LoadCNITemplates reloads the templates of the pools from the ConfigMap, the pools go back to the default templates
+// when it is nil. It returns the errors of the rejected templates by ConfigMap key.
+func (p *IPManager) LoadCNITemplates(configMap *corev1.ConfigMap) map[string]error {
+	data := map[string]string{}
+	version := ""
+	if configMap != nil {
+		data = configMap.Data
+		version = configMap.ResourceVersion
+	}
+
+	rejected := p.cniTemplates.load(data, version)
+	log.Info("reloaded the NetworkAttachmentDefinition templates", "pools", p.cniTemplates.poolNames(), "rejected", len(rejected))
+	return rejected
+}
+
+// logRejectedCNITemplates logs the errors of the rejected templates, every replica loads them
+func (p *IPManager) logRejectedCNITemplates(rejected map[string]error) {
+	for _, key := range sortedTemplateKeys(rejected) {
+		log.Error(rejected[key], "rejected NetworkAttachmentDefinition template", "key", key)
+	}
+}
+
+// recordRejectedCNITemplates reports the rejected templates by a warning Event on their ConfigMap
+func (p *IPManager) recordRejectedCNITemplates(configMap *corev1.ConfigMap, rejected map[string]error) {
+	for _, key := range sortedTemplateKeys(rejected) {
+		p.recordEvent(configMap, corev1.EventTypeWarning, eventReasonInvalidTemplate, "template %s rejected: %v", key, rejected[key])
+	}
+}
+
+// sortedTemplateKeys returns the sorted ConfigMap keys of the rejected templates
+func sortedTemplateKeys(rejected map[string]error) []string {
+	keys := []string{}
+	for key := range rejected {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
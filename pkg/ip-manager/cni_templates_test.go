@@ -0,0 +1,124 @@
+package ip_manager
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+// testPoolTemplate renders a bridge NetworkAttachmentDefinition, as a template of a pool would
+const testPoolTemplate = `apiVersion: "k8s.cni.cncf.io/v1"
+kind: NetworkAttachmentDefinition
+metadata:
+  name: {{.SriovNetworkName}}
+  namespace: {{.SriovNetworkNamespace}}
+  labels:
+    kubeippool.io/managed: "true"
+  annotations:
+    kubeippool.io/address: "{{.SriovCniAddress}}"
+spec:
+  config: '{ "cniVersion": "0.3.1", "name": "{{.SriovNetworkName}}", "type": "bridge", "bridge": "{{ getOr . "CniBridge" "br0" }}",
+    "ipam": { "type": "static", "addresses": [{ "address": "{{.SriovCniAddress}}" }] } }'
+`
+
+var _ = Describe("NetworkAttachmentDefinition templates", func() {
+	const sriovNetworks = `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`
+	var ipManager *IPManager
+
+	newTemplatesConfigMap := func(data map[string]string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "kubeipfixed-system", Name: CNITemplatesConfigMapName},
+			Data:       data,
+		}
+	}
+
+	renderedConfig := func(pod *corev1.Pod, netAttDefName string) string {
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+		Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: netAttDefName}, netAttDef)).To(Succeed())
+		return netAttDef.Spec.Config
+	}
+
+	BeforeEach(func() {
+		ipManager = createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}))
+	})
+
+	It("should render the pools with the embedded templates by default", func() {
+		config := renderedConfig(newTestPod("pod-1", sriovNetworks), "sriov-n3-static-100-100-100-100")
+		Expect(config).To(ContainSubstring(`"type":"sriov"`))
+	})
+
+	It("should render a pool with the template of the ConfigMap and go back to the default once removed", func() {
+		Expect(ipManager.LoadCNITemplates(newTemplatesConfigMap(map[string]string{"sriov-n3.yaml": testPoolTemplate}))).To(BeEmpty())
+		config := renderedConfig(newTestPod("pod-1", sriovNetworks), "sriov-n3-static-100-100-100-100")
+		Expect(config).To(ContainSubstring(`"type": "bridge", "bridge": "br0"`))
+
+		Expect(ipManager.LoadCNITemplates(nil)).To(BeEmpty())
+		config = renderedConfig(newTestPod("pod-2", sriovNetworks), "sriov-n3-static-100-100-100-101")
+		Expect(config).To(ContainSubstring(`"type":"sriov"`))
+	})
+
+	It("should reject an invalid template and keep the previous one of the pool", func() {
+		Expect(ipManager.LoadCNITemplates(newTemplatesConfigMap(map[string]string{"sriov-n3.yaml": testPoolTemplate}))).To(BeEmpty())
+
+		rejected := ipManager.LoadCNITemplates(newTemplatesConfigMap(map[string]string{
+			"sriov-n3.yaml": "{{ .SriovNetworkName ",
+			"other.yaml":    `kind: ConfigMap`,
+			"sriov-n4":      testPoolTemplate,
+		}))
+		Expect(rejected).To(HaveLen(3))
+		Expect(rejected["sriov-n3.yaml"]).To(MatchError(ContainSubstring("failed to parse manifest sriov-n3.yaml as template")))
+		Expect(rejected["other.yaml"]).To(MatchError("the template must render exactly one NetworkAttachmentDefinition"))
+		Expect(rejected["sriov-n4"]).To(MatchError("the key must be the name of a pool followed by .yaml"))
+
+		config := renderedConfig(newTestPod("pod-1", sriovNetworks), "sriov-n3-static-100-100-100-100")
+		Expect(config).To(ContainSubstring(`"type": "bridge"`))
+	})
+
+	It("should reject a template whose cni config is not json", func() {
+		rejected := ipManager.LoadCNITemplates(newTemplatesConfigMap(map[string]string{
+			"sriov-n3.yaml": `{"apiVersion": "k8s.cni.cncf.io/v1", "kind": "NetworkAttachmentDefinition", "metadata": {"name": "{{.SriovNetworkName}}"}, "spec": {"config": "{ \"type\": "}}`,
+		}))
+		Expect(rejected["sriov-n3.yaml"]).To(MatchError(`the rendered spec.config is not valid json: { "type": `))
+	})
+
+	It("should load the templates of the ConfigMap on start", func() {
+		ipManager = createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24"), newTemplatesConfigMap(map[string]string{"sriov-n3.yaml": testPoolTemplate}))
+		Expect(ipManager.Start()).To(Succeed())
+		Expect(ipManager.cniTemplates.poolNames()).To(Equal([]string{"sriov-n3"}))
+	})
+
+	It("should reload the templates once the watch delivered a change of the ConfigMap", func() {
+		recorder := record.NewFakeRecorder(10)
+		ipManager.recorder = recorder
+		configMap := newTemplatesConfigMap(map[string]string{"sriov-n3.yaml": testPoolTemplate})
+		configMap.ResourceVersion = "1"
+		ipManager.reloadCNITemplates(configMap, false)
+		Expect(ipManager.cniTemplates.poolNames()).To(Equal([]string{"sriov-n3"}))
+
+		// a resync of the same ConfigMap keeps the loaded templates
+		ipManager.cniTemplates.overrides = nil
+		ipManager.reloadCNITemplates(configMap, false)
+		Expect(ipManager.cniTemplates.poolNames()).To(BeEmpty())
+
+		configMap.ResourceVersion = "2"
+		configMap.Data = map[string]string{"sriov-n4.yaml": testPoolTemplate, "other.yaml": "kind: ConfigMap"}
+		ipManager.reloadCNITemplates(configMap, false)
+		Expect(ipManager.cniTemplates.poolNames()).To(Equal([]string{"sriov-n4"}))
+		Expect(recorder.Events).To(BeEmpty())
+
+		// only the leader reports the rejected templates
+		configMap.ResourceVersion = "3"
+		ipManager.reloadCNITemplates(configMap, true)
+		Expect(recorder.Events).To(Receive(Equal("Warning InvalidTemplate template other.yaml rejected: the template must render exactly one NetworkAttachmentDefinition")))
+	})
+})
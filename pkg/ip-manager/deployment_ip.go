@@ -0,0 +1,332 @@
+package ip_manager
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const deploymentInstancePrefix = "deployment/"
+
+// ownerNotFoundError is returned for a pod whose ReplicaSet or Deployment is neither in the cache nor in the cluster
+type ownerNotFoundError struct {
+	kind string
+	name types.NamespacedName
+}
+
+func (e *ownerNotFoundError) Error() string {
+	return fmt.Sprintf("%s %s owning the pod was not found", e.kind, e.name)
+}
+
+// deploymentIPSet returns the Deployment owning the pod through its ReplicaSet and the identity of the ip set
+// reserved for it, deployment/<namespace>/<name>/<uid>. The Deployment is nil for the pods not owned by a Deployment,
+// an ownerNotFoundError is returned when one of the owners is gone.
+func (p *IPManager) deploymentIPSet(pod *corev1.Pod) (*appsv1.Deployment, string, error) {
+	replicaSetRef := metav1.GetControllerOf(pod)
+	if replicaSetRef == nil || replicaSetRef.Kind != "ReplicaSet" {
+		return nil, "", nil
+	}
+
+	replicaSet := &appsv1.ReplicaSet{}
+	err := p.getOwner(types.NamespacedName{Namespace: pod.Namespace, Name: replicaSetRef.Name}, replicaSetRef, replicaSet)
+	if err != nil {
+		return nil, "", err
+	}
+
+	deploymentRef := metav1.GetControllerOf(replicaSet)
+	if deploymentRef == nil || deploymentRef.Kind != "Deployment" {
+		return nil, "", nil
+	}
+
+	deployment := &appsv1.Deployment{}
+	err = p.getOwner(types.NamespacedName{Namespace: pod.Namespace, Name: deploymentRef.Name}, deploymentRef, deployment)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return deployment, deploymentIPSetName(deployment), nil
+}
+
+// getOwner reads the owner referenced by a pod or a ReplicaSet from the cache, and from the cluster when the cache did
+// not catch up with it yet, e.g. the ReplicaSet of a rollout whose first pods are admitted right after its creation
+func (p *IPManager) getOwner(name types.NamespacedName, ref *metav1.OwnerReference, owner client.Object) error {
+	err := p.cachedKubeClient.Get(context.TODO(), name, owner)
+	if err == nil && owner.GetUID() == ref.UID {
+		return nil
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	err = p.kubeClient.Get(context.TODO(), name, owner)
+	if apierrors.IsNotFound(err) || err == nil && owner.GetUID() != ref.UID {
+		return &ownerNotFoundError{kind: ref.Kind, name: name}
+	}
+	return err
+}
+
+func deploymentIPSetName(deployment *appsv1.Deployment) string {
+	return fmt.Sprintf("%s%s/%s/%s", deploymentInstancePrefix, deployment.Namespace, deployment.Name, deployment.UID)
+}
+
+// parseDeploymentIPSetName splits an ip set identity into the Deployment and its uid
+func parseDeploymentIPSetName(instanceName string) (types.NamespacedName, types.UID, bool) {
+	if !strings.HasPrefix(instanceName, deploymentInstancePrefix) {
+		return types.NamespacedName{}, "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(instanceName, deploymentInstancePrefix), "/")
+	if len(parts) != 3 {
+		return types.NamespacedName{}, "", false
+	}
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, types.UID(parts[2]), true
+}
+
+func deploymentReplicas(deployment *appsv1.Deployment) int {
+	if deployment.Spec.Replicas == nil {
+		return 1
+	}
+	return int(*deployment.Spec.Replicas)
+}
+
+// deploymentSurge returns the number of pods a rolling update may create above the replicas, see maxSurge
+func deploymentSurge(deployment *appsv1.Deployment) int {
+	if deployment.Spec.Strategy.Type == appsv1.RecreateDeploymentStrategyType {
+		return 0
+	}
+	// the api server defaults maxSurge to 25%
+	maxSurge := intstr.FromString("25%")
+	if rollingUpdate := deployment.Spec.Strategy.RollingUpdate; rollingUpdate != nil && rollingUpdate.MaxSurge != nil {
+		maxSurge = *rollingUpdate.MaxSurge
+	}
+	surge, err := intstr.GetScaledValueFromIntOrPercent(&maxSurge, deploymentReplicas(deployment), true)
+	if err != nil || surge < 0 {
+		return 0
+	}
+	return surge
+}
+
+// isDeploymentRollingOut returns true until the Deployment controller has replaced all the pods of the Deployment
+// by updated ones and removed the surplus ones
+func isDeploymentRollingOut(deployment *appsv1.Deployment) bool {
+	replicas := int32(deploymentReplicas(deployment))
+	return deployment.Status.ObservedGeneration < deployment.Generation || deployment.Status.UpdatedReplicas < replicas ||
+		deployment.Status.Replicas > replicas
+}
+
+// reuseDeploymentIPs completes the networks with an address of the ip set that no pod uses, e.g. the one freed by a
+// pod terminating during a rolling update, and with a free address of the other family for a dual-stack set.
+// Nothing is reused while the set is smaller than the replicas plus the surge of a rolling update and has no free
+// address, the set then grows with an address from the pool. A set without free address at that size rejects the
+// pod, the ReplicaSet controller retries once a pod of the set terminated.
+func (p *IPManager) reuseDeploymentIPs(networks *sriovNetwork, instanceName, defaultNamespace string, deployment *appsv1.Deployment) (bool, error) {
+	ipSet := p.ipPoolMap.filterByInstanceName(instanceName)
+
+	free := ipMap{}
+	for ip, entry := range ipSet {
+		if !entry.inUse {
+			free.createOrUpdateEntry(ip, entry)
+		}
+	}
+
+	if len(free) == 0 {
+		if size := ipSetSize(ipSet); size >= deploymentReplicas(deployment)+deploymentSurge(deployment) {
+			return false, fmt.Errorf("all the %d ips reserved for deployment %s/%s are in use", size, deployment.Namespace, deployment.Name)
+		}
+		return false, nil
+	}
+
+	reused := []string{}
+	for _, ips := range ipsByFamily(free) {
+		if len(ips) != 0 {
+			reused = append(reused, ips[0])
+		}
+	}
+
+	err := p.completeWithPoolAddresses(networks, reused, defaultNamespace)
+	if err != nil {
+		return false, err
+	}
+	log.Info("reusing a free ip of the deployment ip set", "instanceName", instanceName, "addresses", reused)
+	return len(networks.IPPool) != 0, nil
+}
+
+// ipsByFamily returns the sorted IPv4 and IPv6 addresses of the map
+func ipsByFamily(ips ipMap) [2][]string {
+	families := [2][]string{}
+	for ip := range ips {
+		if net.ParseIP(ip).To4() != nil {
+			families[0] = append(families[0], ip)
+		} else {
+			families[1] = append(families[1], ip)
+		}
+	}
+	sortIPs(families[0])
+	sortIPs(families[1])
+	return families
+}
+
+// ipSetSize returns the number of pods an ip set can serve, a dual-stack set holds two addresses per pod
+func ipSetSize(ipSet ipMap) int {
+	families := ipsByFamily(ipSet)
+	if len(families[0]) > len(families[1]) {
+		return len(families[0])
+	}
+	return len(families[1])
+}
+
+// markIPsInUse flags the addresses of the networks held by an ip set as used by the pod or free for the next one,
+// the addresses meanwhile used by another pod of the set are left alone
+func (p *IPManager) markIPsInUse(instanceName string, networks *sriovNetwork, podName string, inUse bool) error {
+	marked := ipMap{}
+	for _, network := range networks.IPPool {
+		for _, address := range network.addresses() {
+			ip, err := addressKey(address)
+			if err != nil {
+				continue
+			}
+			entry, exist := p.ipPoolMap[ip]
+			if !exist || entry.instanceName != instanceName || entry.isPending() {
+				continue
+			}
+			if inUse && (!entry.inUse || entry.podName != podName || entry.reuseTimestamp != nil) {
+				entry.inUse = true
+				entry.podName = podName
+				entry.reuseTimestamp = nil
+				marked.createOrUpdateEntry(ip, entry)
+			}
+			if !inUse && entry.inUse && (entry.podName == "" || entry.podName == podName) {
+				entry.inUse = false
+				entry.podName = ""
+				marked.createOrUpdateEntry(ip, entry)
+			}
+		}
+	}
+	return p.claimInLedger(marked)
+}
+
+// freedIPSetAddresses returns the addresses of ip sets free for the next pod of their set
+func freedIPSetAddresses(addresses ipMap) ipMap {
+	freed := ipMap{}
+	for ip, entry := range addresses {
+		entry.inUse = false
+		entry.podName = ""
+		entry.reuseTimestamp = nil
+		freed.createOrUpdateEntry(ip, entry)
+	}
+	return freed
+}
+
+// freeIPSetAddresses hands the addresses of the ip sets the pod used over to the next pod of their set, for the pods
+// gone before their ip set could be told from them
+func (p *IPManager) freeIPSetAddresses(podName string) error {
+	used := ipMap{}
+	for ip, entry := range p.ipPoolMap {
+		if _, _, ok := parseDeploymentIPSetName(entry.instanceName); ok && entry.inUse && entry.podName == podName {
+			used.createOrUpdateEntry(ip, entry)
+		}
+	}
+	return p.claimInLedger(freedIPSetAddresses(used))
+}
+
+// ReleaseDeploymentIPs shrinks the ip set of a Deployment to its replicas, releasing free addresses from the highest
+// one, and releases the whole set when the Deployment was deleted (deployment is nil) or replaced by a new one.
+// The addresses the set grew by for the surge of a rolling update are kept until the rollout is complete.
+func (p *IPManager) ReleaseDeploymentIPs(name types.NamespacedName, deployment *appsv1.Deployment) error {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	return p.releaseDeploymentIPs(name, deployment)
+}
+
+func (p *IPManager) releaseDeploymentIPs(name types.NamespacedName, deployment *appsv1.Deployment) error {
+	ipSets := map[string]ipMap{}
+	for ip, entry := range p.ipPoolMap {
+		owner, _, ok := parseDeploymentIPSetName(entry.instanceName)
+		if !ok || owner != name {
+			continue
+		}
+		if ipSets[entry.instanceName] == nil {
+			ipSets[entry.instanceName] = ipMap{}
+		}
+		ipSets[entry.instanceName].createOrUpdateEntry(ip, entry)
+	}
+
+	for instanceName, ipSet := range ipSets {
+		if deployment == nil || instanceName != deploymentIPSetName(deployment) {
+			err := p.releaseAllocations(instanceName, ipSet)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		free := ipMap{}
+		for ip, entry := range ipSet {
+			if !entry.inUse && !entry.isPending() {
+				free.createOrUpdateEntry(ip, entry)
+			}
+		}
+
+		size := deploymentReplicas(deployment)
+		if isDeploymentRollingOut(deployment) {
+			size += deploymentSurge(deployment)
+		}
+
+		// each family shrinks on its own, the addresses of a dual-stack set are not paired until they are reused
+		toRelease := ipMap{}
+		held := ipsByFamily(ipSet)
+		for family, ips := range ipsByFamily(free) {
+			released := 0
+			for i := len(ips) - 1; i >= 0 && len(held[family])-released > size; i-- {
+				toRelease.createOrUpdateEntry(ips[i], ipSet[ips[i]])
+				released++
+			}
+		}
+		err := p.releaseAllocations(instanceName, toRelease)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseOrphanedDeploymentIPs releases the ip sets of the Deployments removed while kubeipfixed was down
+func (p *IPManager) releaseOrphanedDeploymentIPs() error {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	owners := map[types.NamespacedName]bool{}
+	for _, entry := range p.ipPoolMap {
+		if owner, _, ok := parseDeploymentIPSetName(entry.instanceName); ok {
+			owners[owner] = true
+		}
+	}
+
+	for owner := range owners {
+		deployment := &appsv1.Deployment{}
+		err := p.cachedKubeClient.Get(context.TODO(), owner, deployment)
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+			deployment = nil
+		}
+
+		err = p.releaseDeploymentIPs(owner, deployment)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,226 @@
+package ip_manager
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+// newTestDeployment returns a Deployment done rolling out, updated without surge pods
+func newTestDeployment(name string, uid types.UID, replicas int32) *appsv1.Deployment {
+	maxSurge := intstr.FromInt(0)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: uid},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Strategy: appsv1.DeploymentStrategy{
+				Type:          appsv1.RollingUpdateDeploymentStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateDeployment{MaxSurge: &maxSurge},
+			},
+		},
+		Status: appsv1.DeploymentStatus{Replicas: replicas, UpdatedReplicas: replicas},
+	}
+}
+
+func newTestReplicaSet(deployment *appsv1.Deployment, name string) *appsv1.ReplicaSet {
+	isController := true
+	return &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+		Name:      name,
+		Namespace: deployment.Namespace,
+		UID:       types.UID(name + "-uid"),
+		OwnerReferences: []metav1.OwnerReference{{
+			APIVersion: "apps/v1", Kind: "Deployment", Name: deployment.Name, UID: deployment.UID, Controller: &isController,
+		}},
+	}}
+}
+
+func newTestReplicaSetPod(replicaSet *appsv1.ReplicaSet) *corev1.Pod {
+	isController := true
+	pod := newTestPod("", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+	pod.GenerateName = replicaSet.Name + "-"
+	pod.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "apps/v1", Kind: "ReplicaSet", Name: replicaSet.Name, UID: replicaSet.UID, Controller: &isController,
+	}}
+	return pod
+}
+
+var _ = Describe("Deployment IP", func() {
+	var ipManager *IPManager
+	deployment := newTestDeployment("web", "uid-1", 2)
+	oldReplicaSet := newTestReplicaSet(deployment, "web-old")
+	newReplicaSet := newTestReplicaSet(deployment, "web-new")
+
+	BeforeEach(func() {
+		ipManager = createTestIPManager(
+			newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}),
+			deployment.DeepCopy(), oldReplicaSet.DeepCopy(), newReplicaSet.DeepCopy())
+	})
+
+	allocate := func(pod *corev1.Pod) (string, error) {
+		err := ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)
+		if err != nil {
+			return "", err
+		}
+		ExpectWithOffset(1, ipManager.MarkPodAsReady(pod)).To(Succeed())
+		networks, err := parsePodNetworkAnnotation(pod.Annotations[sriovNetworksAnnotation], pod.Namespace)
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		return networks.IPPool[0].Address, nil
+	}
+
+	It("should find a replicaset the cache did not catch up with yet in the cluster", func() {
+		// the cache only knows of the replicaset of the previous rollout
+		ipManager.cachedKubeClient = fake.NewClientBuilder().WithScheme(ipManager.Scheme).WithObjects(
+			newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}),
+			deployment.DeepCopy(), oldReplicaSet.DeepCopy()).Build()
+
+		Expect(allocate(newTestReplicaSetPod(newReplicaSet))).To(Equal("100.100.100.100/24"))
+		Expect(ipManager.ipPoolMap["100.100.100.100"].instanceName).To(Equal("deployment/default/web/uid-1"))
+
+		_, err := allocate(newTestReplicaSetPod(newTestReplicaSet(deployment, "web-gone")))
+		Expect(err).To(MatchError("failed to find the deployment owning the pod: ReplicaSet default/web-gone owning the pod was not found"))
+		Expect(ipManager.ipPoolMap).To(HaveLen(1))
+	})
+
+	It("should reserve an ip set sized to the replicas on the deployment", func() {
+		first := newTestReplicaSetPod(oldReplicaSet)
+		Expect(allocate(first)).To(Equal("100.100.100.100/24"))
+		Expect(allocate(newTestReplicaSetPod(oldReplicaSet))).To(Equal("100.100.100.101/24"))
+		Expect(ipManager.ipPoolMap["100.100.100.100"].instanceName).To(Equal("deployment/default/web/uid-1"))
+
+		_, err := allocate(newTestReplicaSetPod(newReplicaSet))
+		Expect(err).To(MatchError("all the 2 ips reserved for deployment default/web are in use"))
+		Expect(ipManager.ipPoolMap).To(HaveLen(2))
+	})
+
+	It("should hand the ip of a terminating pod over to the new pod of a rollout", func() {
+		terminating := newTestReplicaSetPod(oldReplicaSet)
+		Expect(allocate(terminating)).To(Equal("100.100.100.100/24"))
+		Expect(allocate(newTestReplicaSetPod(oldReplicaSet))).To(Equal("100.100.100.101/24"))
+
+		Expect(ipManager.ReleasePodIPs(terminating)).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(HaveLen(2))
+		Expect(allocate(newTestReplicaSetPod(newReplicaSet))).To(Equal("100.100.100.100/24"))
+	})
+
+	It("should grow the ip set by the surge of a rollout and shrink it once the rollout is complete", func() {
+		surging := deployment.DeepCopy()
+		maxSurge := intstr.FromString("50%")
+		surging.Spec.Strategy.RollingUpdate.MaxSurge = &maxSurge
+		surging.Status.UpdatedReplicas = 0
+		ipManager = createTestIPManager(
+			newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}), surging.DeepCopy(), oldReplicaSet.DeepCopy(), newReplicaSet.DeepCopy())
+
+		old := newTestReplicaSetPod(oldReplicaSet)
+		Expect(allocate(old)).To(Equal("100.100.100.100/24"))
+		Expect(allocate(newTestReplicaSetPod(oldReplicaSet))).To(Equal("100.100.100.101/24"))
+		Expect(allocate(newTestReplicaSetPod(newReplicaSet))).To(Equal("100.100.100.102/24"))
+		_, err := allocate(newTestReplicaSetPod(newReplicaSet))
+		Expect(err).To(MatchError("all the 3 ips reserved for deployment default/web are in use"))
+
+		name := types.NamespacedName{Namespace: "default", Name: "web"}
+		Expect(ipManager.ReleasePodIPs(old)).To(Succeed())
+		Expect(ipManager.ReleaseDeploymentIPs(name, surging)).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(HaveLen(3), "the surge addresses are kept during the rollout")
+
+		surging.Status.UpdatedReplicas = 2
+		Expect(ipManager.ReleaseDeploymentIPs(name, surging)).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(HaveLen(2))
+		Expect(ipManager.ipPoolMap).ToNot(HaveKey("100.100.100.100"))
+	})
+
+	It("should give the ip back to the set when the pod it was handed to is not created", func() {
+		defer func() { now = time.Now }()
+		terminating := newTestReplicaSetPod(oldReplicaSet)
+		terminating.Name = "web-old-a"
+		Expect(allocate(terminating)).To(Equal("100.100.100.100/24"))
+		Expect(ipManager.ReleasePodIPs(terminating)).To(Succeed())
+
+		Expect(ipManager.AllocatePodIP(newTestReplicaSetPod(newReplicaSet), &testTransactionTimestamp, true)).To(Succeed())
+		Expect(ipManager.ipPoolMap["100.100.100.100"].isPending()).To(BeFalse())
+		Expect(ipManager.ipPoolMap["100.100.100.100"].inUse).To(BeTrue())
+
+		now = func() time.Time {
+			return testTransactionTimestamp.Add(time.Duration(ipManager.waitTime+1) * time.Second)
+		}
+		ipManager.rollbackExpiredTransactions()
+		Expect(ipManager.ipPoolMap).To(HaveKey("100.100.100.100"))
+		Expect(ipManager.ipPoolMap["100.100.100.100"].inUse).To(BeFalse())
+		Expect(allocate(newTestReplicaSetPod(newReplicaSet))).To(Equal("100.100.100.100/24"))
+	})
+
+	It("should free the ip of a pod of the set that is already gone", func() {
+		gone := newTestReplicaSetPod(oldReplicaSet)
+		gone.Name = "web-old-a"
+		Expect(allocate(gone)).To(Equal("100.100.100.100/24"))
+		Expect(ipManager.ipPoolMap["100.100.100.100"].podName).To(Equal("pod/default/" + gone.Name))
+
+		// the pod controller only knows the name of a pod it did not see deleted
+		Expect(ipManager.ReleasePodIPs(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: gone.Name}})).To(Succeed())
+		Expect(ipManager.ipPoolMap["100.100.100.100"].inUse).To(BeFalse())
+		Expect(allocate(newTestReplicaSetPod(newReplicaSet))).To(Equal("100.100.100.100/24"))
+	})
+
+	It("should shrink the ip set on scale down and release it with the deployment", func() {
+		first := newTestReplicaSetPod(oldReplicaSet)
+		Expect(allocate(first)).To(Equal("100.100.100.100/24"))
+		second := newTestReplicaSetPod(oldReplicaSet)
+		Expect(allocate(second)).To(Equal("100.100.100.101/24"))
+
+		name := types.NamespacedName{Namespace: "default", Name: "web"}
+		Expect(ipManager.ReleaseDeploymentIPs(name, newTestDeployment("web", "uid-1", 1))).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(HaveLen(2), "the ips in use are kept")
+
+		Expect(ipManager.ReleasePodIPs(first)).To(Succeed())
+		Expect(ipManager.ReleaseDeploymentIPs(name, newTestDeployment("web", "uid-1", 1))).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(HaveLen(1))
+		Expect(ipManager.ipPoolMap).To(HaveKey("100.100.100.101"))
+
+		Expect(ipManager.ReleaseDeploymentIPs(name, nil)).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(BeEmpty())
+	})
+
+	It("should hand both addresses of a dual-stack ip set over and shrink each family", func() {
+		ipManager = createTestIPManager(newTestDualStackIPPool("sriov-n3"), deployment.DeepCopy(), oldReplicaSet.DeepCopy(), newReplicaSet.DeepCopy())
+		terminating := newTestReplicaSetPod(oldReplicaSet)
+		Expect(allocate(terminating)).To(Equal("100.100.100.100/24"))
+		Expect(allocate(newTestReplicaSetPod(oldReplicaSet))).To(Equal("100.100.100.101/24"))
+		Expect(ipManager.ipPoolMap).To(HaveLen(4))
+
+		_, err := allocate(newTestReplicaSetPod(newReplicaSet))
+		Expect(err).To(MatchError("all the 2 ips reserved for deployment default/web are in use"))
+
+		Expect(ipManager.ReleasePodIPs(terminating)).To(Succeed())
+		Expect(ipManager.ReleaseDeploymentIPs(types.NamespacedName{Namespace: "default", Name: "web"}, newTestDeployment("web", "uid-1", 1))).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(HaveLen(2))
+		Expect(ipManager.ipPoolMap).To(HaveKey("100.100.100.101"))
+		Expect(ipManager.ipPoolMap).To(HaveKey("fd00:100::101"))
+	})
+
+	It("should rebuild the ip set with the terminating pods handing their ip over", func() {
+		running := newTestReplicaSetPod(oldReplicaSet)
+		running.Name = "web-old-a"
+		Expect(allocate(running)).To(Equal("100.100.100.100/24"))
+		terminating := newTestReplicaSetPod(oldReplicaSet)
+		terminating.Name = "web-old-b"
+		Expect(allocate(terminating)).To(Equal("100.100.100.101/24"))
+
+		now := metav1.Now()
+		terminating.DeletionTimestamp = &now
+		terminating.Finalizers = []string{ReleaseIPFinalizer}
+		restarted := createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24"),
+			deployment.DeepCopy(), oldReplicaSet.DeepCopy(), running, terminating)
+		Expect(restarted.Start()).To(Succeed())
+		Expect(restarted.ipPoolMap["100.100.100.100"].inUse).To(BeTrue())
+		Expect(restarted.ipPoolMap["100.100.100.101"].inUse).To(BeFalse())
+	})
+})
@@ -0,0 +1,117 @@
+package ip_manager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+// reasons of the Events recorded on the workloads and on the pools
+const (
+	eventReasonAllocated        = "IPAllocated"
+	eventReasonReleased         = "IPReleased"
+	eventReasonConflict         = "IPConflict"
+	eventReasonExhausted        = "IPPoolExhausted"
+	eventReasonAllocationFailed = "IPAllocationFailed"
+	eventReasonMismatch         = "IPMismatch"
+	eventReasonInvalidTemplate  = "InvalidTemplate"
+)
+
+// recordEvent records an Event on the object, objects without a name yet, e.g. pods created from a generateName at
+// admission time, get none
+func (p *IPManager) recordEvent(object client.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	if p.recorder == nil || object == nil || object.GetName() == "" {
+		return
+	}
+	p.recorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+// recordPoolEvent records an Event on the pool, the pool is read from the cache for the Event to reference its uid
+func (p *IPManager) recordPoolEvent(poolName, eventType, reason, messageFmt string, args ...interface{}) {
+	if p.recorder == nil || poolName == "" {
+		return
+	}
+	pool := &ippoolv1alpha1.IPPool{}
+	err := p.cachedKubeClient.Get(context.TODO(), types.NamespacedName{Name: poolName}, pool)
+	if err != nil {
+		log.V(1).Info("no event recorded on a missing ip pool", "poolName", poolName, "reason", reason)
+		return
+	}
+	p.recorder.Eventf(pool, eventType, reason, messageFmt, args...)
+}
+
+// recordAllocationFailedEvents tells the workload why it got no address, and the pool when it ran out of addresses
+func (p *IPManager) recordAllocationFailedEvents(object client.Object, isNotDryRun bool, err error) {
+	if !isNotDryRun {
+		return
+	}
+
+	var exhausted *poolExhaustedError
+	var held *addressHeldError
+	switch {
+	case errors.As(err, &exhausted):
+		p.recordEvent(object, corev1.EventTypeWarning, eventReasonExhausted, "%v", err)
+		p.recordPoolEvent(exhausted.poolName, corev1.EventTypeWarning, eventReasonExhausted,
+			"no free ip left for %s/%s", object.GetNamespace(), object.GetName())
+	case errors.As(err, &held):
+		p.recordEvent(object, corev1.EventTypeWarning, eventReasonConflict, "%v", err)
+	default:
+		p.recordEvent(object, corev1.EventTypeWarning, eventReasonAllocationFailed, "%v", err)
+	}
+}
+
+// recordWorkloadEvent records the allocated or released addresses on the workload
+func (p *IPManager) recordWorkloadEvent(object client.Object, reason, verb string, allocations ipMap) {
+	if len(allocations) == 0 {
+		return
+	}
+	p.recordEvent(object, corev1.EventTypeNormal, reason, "%s ips %s", verb, strings.Join(describeAllocations(allocations), ", "))
+}
+
+// recordPoolEvents records the allocated or released addresses of the instance on their pools
+func (p *IPManager) recordPoolEvents(instanceName, reason, verb string, allocations ipMap) {
+	byPool := map[string]ipMap{}
+	for ip, entry := range allocations {
+		if byPool[entry.poolName] == nil {
+			byPool[entry.poolName] = ipMap{}
+		}
+		byPool[entry.poolName].createOrUpdateEntry(ip, entry)
+	}
+
+	for poolName, poolAllocations := range byPool {
+		p.recordPoolEvent(poolName, corev1.EventTypeNormal, reason, "%s ips %s of %s", verb,
+			strings.Join(describeAllocations(poolAllocations), ", "), holderName(instanceName))
+	}
+}
+
+func describeAllocations(allocations ipMap) []string {
+	descriptions := []string{}
+	for _, ip := range sortedIPs(allocations) {
+		descriptions = append(descriptions, describeAllocation(ip, allocations[ip]))
+	}
+	return descriptions
+}
+
+// describeAllocation gives the address with the NetworkAttachmentDefinition attaching it, e.g. 10.0.0.5 (default/n3)
+func describeAllocation(ip string, entry ipEntry) string {
+	if entry.netAttDef.Name == "" {
+		return ip
+	}
+	return fmt.Sprintf("%s (%s)", ip, entry.netAttDef)
+}
+
+func sortedIPs(allocations ipMap) []string {
+	ips := []string{}
+	for ip := range allocations {
+		ips = append(ips, ip)
+	}
+	sortIPs(ips)
+	return ips
+}
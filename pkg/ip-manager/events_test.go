@@ -0,0 +1,68 @@
+package ip_manager
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"k8s.io/client-go/tools/record"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+var _ = Describe("Events", func() {
+	const sriovNetworks = `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`
+	const netAttDef = "default/sriov-n3-static-100-100-100-100"
+	var ipManager *IPManager
+	var recorder *record.FakeRecorder
+
+	BeforeEach(func() {
+		ipManager = createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.100"}))
+		recorder = record.NewFakeRecorder(10)
+		ipManager.recorder = recorder
+	})
+
+	It("should record the committed and the released ips on the pod and on the pool", func() {
+		pod := newTestPod("pod-1", sriovNetworks)
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(recorder.Events).To(BeEmpty())
+
+		Expect(ipManager.MarkPodAsReady(pod)).To(Succeed())
+		Expect(recorder.Events).To(Receive(Equal("Normal IPAllocated allocated ips 100.100.100.100 (" + netAttDef + ")")))
+		Expect(recorder.Events).To(Receive(Equal("Normal IPAllocated allocated ips 100.100.100.100 (" + netAttDef + ") of pod/default/pod-1")))
+
+		// the allocation is committed once
+		Expect(ipManager.MarkPodAsReady(pod)).To(Succeed())
+		Expect(recorder.Events).To(BeEmpty())
+
+		Expect(ipManager.ReleasePodIPs(pod)).To(Succeed())
+		Expect(recorder.Events).To(Receive(Equal("Normal IPReleased released ips 100.100.100.100 (" + netAttDef + ") of pod/default/pod-1")))
+		Expect(recorder.Events).To(Receive(Equal("Normal IPReleased released ips 100.100.100.100 (" + netAttDef + ")")))
+	})
+
+	It("should warn the pod and the pool when the pool is exhausted", func() {
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-1", sriovNetworks), &testTransactionTimestamp, true)).To(Succeed())
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-2", sriovNetworks), &testTransactionTimestamp, true)).ToNot(Succeed())
+
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning IPPoolExhausted ")))
+		Expect(recorder.Events).To(Receive(Equal("Warning IPPoolExhausted no free ip left for default/pod-2")))
+	})
+
+	It("should warn the pod about an ip held by another workload", func() {
+		requested := `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "n3", "address": "100.100.100.150/24"}]}`
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-1", requested), &testTransactionTimestamp, true)).To(Succeed())
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-2", requested), &testTransactionTimestamp, true)).ToNot(Succeed())
+
+		Expect(recorder.Events).To(Receive(And(HavePrefix("Warning IPConflict "), ContainSubstring("pod/default/pod-1"))))
+		Expect(recorder.Events).To(BeEmpty())
+	})
+
+	It("should record nothing on dry-run requests and pods without a name yet", func() {
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-1", sriovNetworks), &testTransactionTimestamp, true)).To(Succeed())
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-2", sriovNetworks), &testTransactionTimestamp, false)).ToNot(Succeed())
+		Expect(recorder.Events).To(BeEmpty())
+
+		Expect(ipManager.AllocatePodIP(newTestPod("", sriovNetworks), &testTransactionTimestamp, true)).ToNot(Succeed())
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning IPPoolExhausted no free ip left for default/")))
+		Expect(recorder.Events).To(BeEmpty())
+	})
+})
@@ -0,0 +1,184 @@
+package ip_manager
+
+import (
+	"context"
+	"math/big"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/pkg/errors"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+// Allocation is an allocated address as reported to the operators
+type Allocation struct {
+	IP   string
+	Pool string
+	// Holder is the workload holding the address, e.g. pod/default/pod-1, see holderName
+	Holder string
+	// NetAttDef is the NetworkAttachmentDefinition attaching the address, namespace/name
+	NetAttDef string
+	MAC       string
+	// Interface and ObservedMAC are the interface of the workload attaching the address and its MAC as reported by
+	// multus, empty until the workload runs
+	Interface   string
+	ObservedMAC string
+	// Pending is set until the workload holding the address is created
+	Pending bool
+}
+
+// PoolUsage is the utilization of a pool subnet, a dual-stack pool has one per family
+type PoolUsage struct {
+	Name      string
+	Family    string
+	Subnet    string
+	Total     *big.Int
+	Allocated int
+}
+
+// Free returns the number of addresses of the ranges still allocatable
+func (u *PoolUsage) Free() *big.Int {
+	free := big.NewInt(0).Sub(u.Total, big.NewInt(int64(u.Allocated)))
+	if free.Sign() < 0 {
+		return big.NewInt(0)
+	}
+	return free
+}
+
+// LoadState rebuilds the allocation state from the cluster and loads the NetworkAttachmentDefinition templates of the
+// pools like Start, without the routines of the manager, for the tools inspecting or changing the allocations. When
+// readOnly is set the allocation ledger is only read, the rebuilt allocations missing from it are not recorded there.
+func (p *IPManager) LoadState(readOnly bool) error {
+	err := p.initMaps(!readOnly)
+	if err != nil {
+		return errors.Wrap(err, "failed Init ip manager maps")
+	}
+	return p.initCNITemplates()
+}
+
+func newAllocation(ip string, entry ipEntry) Allocation {
+	allocation := Allocation{
+		IP:          ip,
+		Pool:        entry.poolName,
+		Holder:      holderName(entry.instanceName),
+		MAC:         entry.mac,
+		Interface:   entry.interfaceName,
+		ObservedMAC: entry.observedMAC,
+		Pending:     entry.isPending(),
+	}
+	if entry.netAttDef.Name != "" {
+		allocation.NetAttDef = entry.netAttDef.String()
+	}
+	return allocation
+}
+
+func newAllocations(allocations ipMap) []Allocation {
+	result := []Allocation{}
+	for _, ip := range sortedIPs(allocations) {
+		result = append(result, newAllocation(ip, allocations[ip]))
+	}
+	return result
+}
+
+// Allocations returns the allocated addresses of the pool sorted by address, all of them when poolName is empty
+func (p *IPManager) Allocations(poolName string) []Allocation {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	allocations := ipMap{}
+	for ip, entry := range p.ipPoolMap {
+		if poolName == "" || entry.poolName == poolName {
+			allocations[ip] = entry
+		}
+	}
+	return newAllocations(allocations)
+}
+
+// Whois returns the allocation of the address, given with or without prefix length, nil when it is free
+func (p *IPManager) Whois(address string) (*Allocation, error) {
+	ip, err := addressKey(address)
+	if err != nil {
+		return nil, err
+	}
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	entry, exist := p.ipPoolMap[ip]
+	if !exist {
+		return nil, nil
+	}
+	allocation := newAllocation(ip, entry)
+	return &allocation, nil
+}
+
+// PoolsUsage returns the utilization of the subnets of all the pools, see subnetUsage
+func (p *IPManager) PoolsUsage() ([]PoolUsage, error) {
+	poolList := &ippoolv1alpha1.IPPoolList{}
+	err := p.cachedKubeClient.List(context.TODO(), poolList)
+	if err != nil {
+		return nil, err
+	}
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	usages := []PoolUsage{}
+	addUsage := func(poolName, cidr string, ranges []ippoolv1alpha1.IPRange, gateway string) error {
+		family, total, used, err := subnetUsage(p.ipPoolMap, poolName, cidr, ranges, gateway)
+		if err != nil {
+			return err
+		}
+		usages = append(usages, PoolUsage{Name: poolName, Family: family, Subnet: cidr, Total: total, Allocated: used})
+		return nil
+	}
+	for _, pool := range poolList.Items {
+		err = addUsage(pool.Name, pool.Spec.Subnet, pool.Spec.Ranges, pool.Spec.Gateway)
+		if err != nil {
+			return nil, err
+		}
+		if pool.Spec.Subnet6 != "" {
+			err = addUsage(pool.Name, pool.Spec.Subnet6, pool.Spec.Ranges6, pool.Spec.Gateway6)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return usages, nil
+}
+
+// RenderNetworks returns the NetworkAttachmentDefinitions the sriovnetworks annotation of a workload of the namespace
+// would get, nothing is created nor reserved. A request without address gets the next free address of its pool.
+func (p *IPManager) RenderNetworks(namespace, sriovNetworks string) ([]*netattdefv1.NetworkAttachmentDefinition, error) {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	networks, err := parseSriovNetworks(sriovNetworks, namespace)
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.completeRequestedAddresses(networks)
+	if err != nil {
+		return nil, err
+	}
+	err = validateNetworkSettings(networks)
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.allocateNetworks(networks, namespace, "", nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	poolName := ""
+	if networks.Subnet != "" {
+		pool, err := p.findIPPool(networks.Subnet, networks.ResourceName)
+		if err != nil {
+			return nil, err
+		}
+		if pool != nil {
+			poolName = pool.Name
+		}
+	}
+	return p.renderNetAttDefs(networks, poolName, "")
+}
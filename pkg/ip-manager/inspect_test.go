@@ -0,0 +1,60 @@
+package ip_manager
+
+import (
+	"math/big"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+var _ = Describe("Inspect", func() {
+	const subnetRequest = `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`
+	var ipManager *IPManager
+
+	BeforeEach(func() {
+		ipManager = createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.109"}),
+			newTestDualStackIPPool("sriov-n6"))
+	})
+
+	It("should report the usage of every pool subnet", func() {
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-1", subnetRequest), &testTransactionTimestamp, true)).To(Succeed())
+
+		usages, err := ipManager.PoolsUsage()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(usages).To(HaveLen(3))
+		Expect(usages[0]).To(Equal(PoolUsage{Name: "sriov-n3", Family: "ipv4", Subnet: "100.100.100.0/24", Total: big.NewInt(10), Allocated: 1}))
+		Expect(usages[0].Free()).To(Equal(big.NewInt(9)))
+		Expect(usages[2].Name).To(Equal("sriov-n6"))
+		Expect(usages[2].Family).To(Equal("ipv6"))
+		Expect(usages[2].Total).To(Equal(big.NewInt(257)))
+	})
+
+	It("should list the allocations of a pool and tell who holds an address", func() {
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-1", subnetRequest), &testTransactionTimestamp, true)).To(Succeed())
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-2", `{"subnet": "10.0.0.0/24", "ippool": [{"name": "n3", "address": "10.0.0.5"}]}`), &testTransactionTimestamp, true)).To(Succeed())
+
+		pending := Allocation{IP: "100.100.100.100", Pool: "sriov-n3", Holder: "pod/default/pod-1",
+			NetAttDef: "default/sriov-n3-static-100-100-100-100", Pending: true}
+		Expect(ipManager.Allocations("sriov-n3")).To(Equal([]Allocation{pending}))
+		Expect(ipManager.Allocations("")).To(HaveLen(2))
+
+		Expect(ipManager.Whois("100.100.100.100/24")).To(Equal(&pending))
+		Expect(ipManager.Whois("100.100.100.101")).To(BeNil())
+		_, err := ipManager.Whois("100.100.100")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should render the NetworkAttachmentDefinitions of an annotation without allocating", func() {
+		netAttDefs, err := ipManager.RenderNetworks("default", subnetRequest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(netAttDefs).To(HaveLen(1))
+		Expect(netAttDefs[0].Name).To(Equal("sriov-n3-static-100-100-100-100"))
+		Expect(netAttDefs[0].Spec.Config).To(ContainSubstring(`"address": "100.100.100.100/24"`))
+		Expect(ipManager.ipPoolMap).To(BeEmpty())
+
+		_, err = ipManager.RenderNetworks("default", `{"subnet": "100.100.100.0/24", "ippool": [{"name": "n3", "address": "100.100.100.150", "vlan": 4095}]}`)
+		Expect(err).To(MatchError("vlan 4095 of address 100.100.100.150/24 is not in the range 0-4094"))
+	})
+})
@@ -1,22 +1,35 @@
 package ip_manager
 
 import (
+	"context"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	"sync"
 	"time"
 
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 )
 
 const (
-	sriovNetworksAnnotation        = "k8s.v1.cni.cncf.io/sriovnetworks"
-	NetworksAnnotation             = "k8s.v1.cni.cncf.io/networks"
-	TransactionTimestampAnnotation = "kubeippool.io/transaction-timestamp"
-	mutatingWebhookConfigName      = "kubeippool-mutator"
-	virtualMachnesWebhookName      = "mutatevirtualmachines.kubeippool.io"
-	podsWebhookName                = "mutatepods.kubeippool.io"
-	defaultNameservers             = "114.114.114.114"
+	sriovNetworksAnnotation         = "k8s.v1.cni.cncf.io/sriovnetworks"
+	NetworksAnnotation              = "k8s.v1.cni.cncf.io/networks"
+	TransactionTimestampAnnotation  = "kubeippool.io/transaction-timestamp"
+	StatusAnnotation                = "kubeippool.io/status"
+	ReleaseIPFinalizer              = "kubeippool.io/release-ip"
+	mutatingWebhookConfigName       = "kubeippool-mutator"
+	virtualMachnesWebhookName       = "mutatevirtualmachines.kubeippool.io"
+	podsWebhookName                 = "mutatepods.kubeippool.io"
+	defaultNameservers              = "114.114.114.114"
+	managedNetAttDefLabel           = "kubeippool.io/managed"
+	netAttDefAddressAnnotation      = "kubeippool.io/address"
+	netAttDefResourceNameAnnotation = "k8s.v1.cni.cncf.io/resourceName"
+	netAttDefOwnerAnnotation        = "kubeippool.io/owner"
+	netAttDefMACAnnotation          = "kubeippool.io/mac"
 )
 
 var log = logf.Log.WithName("IPManager")
@@ -29,30 +42,152 @@ type IPManager struct {
 	Scheme           *runtime.Scheme
 	kubeClient       client.Client
 	managerNamespace string
-	poolMutex        sync.Mutex // mutex for allocation an release
-	isKubevirt       bool       // bool if kubevirt virtualmachine crd exist in the cluster
-	waitTime         int        // Duration in second to free macs of allocated vms that failed to start.
+	ipPoolMap        ipMap                // allocated fixed addresses
+	ledger           map[string]ipMap     // allocations recorded by each shard of the ledger, see mirrorLedger
+	poolMutex        sync.Mutex           // mutex for allocation an release
+	isKubevirt       bool                 // bool if kubevirt virtualmachine crd exist in the cluster
+	waitTime         int                  // Duration in second to free ips of allocations whose workload was never created.
+	ready            chan struct{}        // closed once the allocation state was rebuilt from the cluster
+	cniTemplates     *cniTemplates        // NetworkAttachmentDefinition templates, see LoadCNITemplates
+	recorder         record.EventRecorder // records the allocation results on the workloads and the pools
 }
 
-func NewIPManager(kubeClient, cachedKubeClient client.Client, managerNamespace string, kubevirtExist bool, waitTime int, Scheme *runtime.Scheme) (*IPManager, error) {
+func NewIPManager(kubeClient, cachedKubeClient client.Client, managerNamespace string, kubevirtExist bool, waitTime int, Scheme *runtime.Scheme, recorder record.EventRecorder) (*IPManager, error) {
+	templates, err := newCNITemplates()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse the default NetworkAttachmentDefinition templates")
+	}
 
 	ipManger := &IPManager{
 		cachedKubeClient: cachedKubeClient,
 		kubeClient:       kubeClient,
 		isKubevirt:       kubevirtExist,
 		managerNamespace: managerNamespace,
+		ipPoolMap:        ipMap{},
+		ledger:           map[string]ipMap{},
 		poolMutex:        sync.Mutex{},
 		waitTime:         waitTime,
 		Scheme:           Scheme,
+		ready:            make(chan struct{}),
+		cniTemplates:     templates,
+		recorder:         recorder,
 	}
 
 	return ipManger, nil
 }
 
 func (p *IPManager) Start() error {
+	// the ledger is only read before the leader election, InitLeader records the rebuilt allocations it misses
+	err := p.initMaps(false)
+	if err != nil {
+		return errors.Wrap(err, "failed Init ip manager maps")
+	}
+
+	err = p.initCNITemplates()
+	if err != nil {
+		return errors.Wrap(err, "failed to load the NetworkAttachmentDefinition templates")
+	}
+
+	poolCollector.setIPManager(p)
+	close(p.ready)
+	return nil
+}
+
+// InitLeader records the allocations rebuilt from the cluster that the ledger misses and releases the addresses of
+// the StatefulSets and Deployments removed while kubeipfixed was down. It only runs on the leader once the caches
+// synced, the other replicas only mirror the ledger.
+func (p *IPManager) InitLeader(ctx context.Context) error {
+	err := p.InitMaps()
+	if err != nil {
+		return errors.Wrap(err, "failed to record the rebuilt allocations in the ledger")
+	}
+
+	err = p.releaseOrphanedStatefulSetIPs()
+	if err != nil {
+		return errors.Wrap(err, "failed to release the ips of removed statefulsets")
+	}
+
+	err = p.releaseOrphanedDeploymentIPs()
+	if err != nil {
+		return errors.Wrap(err, "failed to release the ips of removed deployments")
+	}
+	return nil
+}
+
+// watchManagerConfigMaps returns an informer of the ConfigMaps of the manager namespace matching the selector, its
+// cache is started by the manager on every replica
+func (p *IPManager) watchManagerConfigMaps(mgr manager.Manager, selector cache.ObjectSelector) (cache.Informer, error) {
+	configMapCache, err := cache.New(mgr.GetConfig(), cache.Options{
+		Scheme:            mgr.GetScheme(),
+		Mapper:            mgr.GetRESTMapper(),
+		Namespace:         p.managerNamespace,
+		SelectorsByObject: cache.SelectorsByObject{&corev1.ConfigMap{}: selector},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = mgr.Add(configMapCache)
+	if err != nil {
+		return nil, err
+	}
+	return configMapCache.GetInformer(context.TODO(), &corev1.ConfigMap{})
+}
+
+// InitMaps rebuilds the allocated addresses from the NetworkAttachmentDefinitions, pods and virtual machines in the
+// cluster, the allocation ledger written by the replicas takes precedence over them
+func (p *IPManager) InitMaps() error {
+	return p.initMaps(true)
+}
+
+// initMaps rebuilds the allocated addresses, the rebuilt ones missing from the ledger are added to it when merge is
+// set, they are only added to the allocation state otherwise
+func (p *IPManager) initMaps(merge bool) error {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	p.ipPoolMap = ipMap{}
+	p.ledger = map[string]ipMap{}
+
+	err := p.initNetAttDefMap()
+	if err != nil {
+		return err
+	}
+
+	err = p.initPodMap()
+	if err != nil {
+		return err
+	}
+
+	if p.isKubevirt {
+		err = p.initVirtualMachineMap()
+		if err != nil {
+			return err
+		}
+	}
+
+	if merge {
+		err = p.syncLedger(true)
+	} else {
+		err = p.peekLedger()
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Info("allocation state rebuilt", "allocatedAddresses", len(p.ipPoolMap))
 	return nil
 }
 
+// IsReady returns true once the allocation state was rebuilt, webhooks must not allocate before that
+func (p *IPManager) IsReady() bool {
+	select {
+	case <-p.ready:
+		return true
+	default:
+		return false
+	}
+}
+
 func (p *IPManager) IsKubevirtEnabled() bool {
 	return p.isKubevirt
 }
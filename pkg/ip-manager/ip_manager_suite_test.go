@@ -0,0 +1,16 @@
+package ip_manager
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func TestIPManager(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "IP Manager Suite")
+}
+
+var testTransactionTimestamp = time.Date(2022, time.October, 18, 1, 38, 12, 0, time.UTC)
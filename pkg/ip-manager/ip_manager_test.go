@@ -0,0 +1,67 @@
+package ip_manager
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+var _ = Describe("IP Manager", func() {
+	Describe("Start", func() {
+		It("should rebuild the allocated addresses from the cluster", func() {
+			pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "sriov-n3-static-100-100-100-100", "address": "100.100.100.100/24", "gateway": "100.100.100.1"}]}`)
+			orphanNetAttDef := &netattdefv1.NetworkAttachmentDefinition{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "sriov-n3-static-100-100-100-101",
+					Namespace: "default",
+					Labels:    map[string]string{managedNetAttDefLabel: "true"},
+					Annotations: map[string]string{
+						netAttDefAddressAnnotation:      "100.100.100.101/24",
+						netAttDefResourceNameAnnotation: "mecdev.com/intel2v2nics",
+					},
+				},
+			}
+			ipManager := createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}), pod, orphanNetAttDef)
+			Expect(ipManager.IsReady()).To(BeFalse())
+			now = func() time.Time { return testTransactionTimestamp }
+			defer func() { now = time.Now }()
+
+			Expect(ipManager.Start()).To(Succeed())
+			Expect(ipManager.IsReady()).To(BeTrue())
+			Expect(ipManager.ipPoolMap).To(Equal(ipMap{
+				"100.100.100.100": ipEntry{
+					instanceName: "pod/default/pod-1",
+					poolName:     "sriov-n3",
+					netAttDef:    types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-100"},
+				},
+				"100.100.100.101": ipEntry{
+					instanceName:         "netattdef/default/sriov-n3-static-100-100-100-101",
+					poolName:             "sriov-n3",
+					netAttDef:            types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-101"},
+					transactionTimestamp: &testTransactionTimestamp,
+				},
+			}))
+
+			newPod := newTestPod("pod-2", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+			Expect(ipManager.AllocatePodIP(newPod, &testTransactionTimestamp, true)).To(Succeed())
+			Expect(newPod.Annotations[sriovNetworksAnnotation]).To(ContainSubstring("100.100.100.102/24"))
+		})
+
+		It("should keep a single holder of an address requested by several workloads", func() {
+			sriovNetworks := `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "n3", "address": "100.100.100.150/24"}]}`
+			ipManager := createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24"), newTestPod("pod-1", sriovNetworks), newTestPod("pod-2", sriovNetworks))
+
+			Expect(ipManager.Start()).To(Succeed())
+			holder := ipManager.ipPoolMap["100.100.100.150"].instanceName
+			Expect(holder).To(BeElementOf("pod/default/pod-1", "pod/default/pod-2"))
+			Expect(ipManager.ValidatePodNetworks(newTestPod("pod-3", sriovNetworks))).To(MatchError("address 100.100.100.150 is already held by " + holder))
+		})
+	})
+})
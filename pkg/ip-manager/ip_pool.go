@@ -0,0 +1,688 @@
+package ip_manager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+	"github.com/wenwenxiong/kubeipfixed/pkg/metrics"
+)
+
+// findIPPool returns the IPPool serving the subnet and resource name, nil if there is none
+func (p *IPManager) findIPPool(subnet, resourceName string) (*ippoolv1alpha1.IPPool, error) {
+	_, requestedNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse subnet %q", subnet)
+	}
+
+	poolList := &ippoolv1alpha1.IPPoolList{}
+	err = p.cachedKubeClient.List(context.TODO(), poolList)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list ip pools")
+	}
+
+	for i := range poolList.Items {
+		pool := &poolList.Items[i]
+		_, poolNet, err := net.ParseCIDR(pool.Spec.Subnet)
+		if err != nil {
+			log.Error(err, "ignoring ip pool with an invalid subnet", "poolName", pool.Name)
+			continue
+		}
+		if poolNet.String() == requestedNet.String() && pool.Spec.ResourceName == resourceName {
+			return pool, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// allocateFromIPPool picks the first free address of the pool matching the network and returns it ready to be rendered
+func (p *IPManager) allocateFromIPPool(network *sriovNetwork, defaultNamespace string) (*sriovIpAddress, *ippoolv1alpha1.IPPool, error) {
+	pool, err := p.findIPPool(network.Subnet, network.ResourceName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pool == nil {
+		return nil, nil, &noIPPoolError{subnet: network.Subnet, resourceName: network.ResourceName}
+	}
+
+	ip, subnet, err := p.nextFreeIP(pool)
+	if err != nil {
+		return nil, nil, err
+	}
+	ipAddress := poolAddress(pool, ip, subnet, defaultNamespace)
+
+	if pool.Spec.Subnet6 != "" {
+		ip6, subnet6, err := p.nextFreeIP6(pool)
+		if err != nil {
+			return nil, nil, err
+		}
+		setPoolAddress6(ipAddress, pool, ip6, subnet6)
+	}
+
+	return ipAddress, pool, nil
+}
+
+// poolAddress returns the address of the pool ready to be rendered with the pool settings
+func poolAddress(pool *ippoolv1alpha1.IPPool, ip net.IP, subnet *net.IPNet, defaultNamespace string) *sriovIpAddress {
+	namespace := pool.Spec.NetworkNamespace
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	prefixLength, _ := subnet.Mask.Size()
+
+	ipAddress := &sriovIpAddress{
+		Name:      netAttDefNameForIP(pool.Name, ip),
+		Namespace: namespace,
+		Address:   fmt.Sprintf("%s/%d", ip.String(), prefixLength),
+		Gateway:   poolGateway(pool.Spec.Subnet, pool.Spec.Gateway),
+		Vlan:      pool.Spec.Vlan,
+	}
+	setPoolIPAMSettings(ipAddress, pool)
+	setPoolCNISettings(ipAddress, pool)
+	if isSharedNetAttDefPool(pool) {
+		useSharedNetAttDef(ipAddress, pool, defaultNamespace)
+	}
+
+	return ipAddress
+}
+
+// setPoolAddress6 adds the address of the Subnet6 of a dual-stack pool to the entry, both end up on the same interface
+func setPoolAddress6(ipAddress *sriovIpAddress, pool *ippoolv1alpha1.IPPool, ip net.IP, subnet *net.IPNet) {
+	prefixLength, _ := subnet.Mask.Size()
+	ipAddress.Address6 = fmt.Sprintf("%s/%d", ip.String(), prefixLength)
+	ipAddress.Gateway6 = poolGateway(pool.Spec.Subnet6, pool.Spec.Gateway6)
+}
+
+// completeWithPoolAddresses adds the given addresses of the pool serving the networks, rendered with the pool settings.
+// The addresses of the Subnet6 of a dual-stack pool are paired in order with the ones of its Subnet.
+func (p *IPManager) completeWithPoolAddresses(networks *sriovNetwork, ips []string, defaultNamespace string) error {
+	pool, err := p.findIPPool(networks.Subnet, networks.ResourceName)
+	if err != nil {
+		return err
+	}
+	if pool == nil {
+		return &noIPPoolError{subnet: networks.Subnet, resourceName: networks.ResourceName}
+	}
+	_, subnet, err := net.ParseCIDR(pool.Spec.Subnet)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse subnet of ip pool %s", pool.Name)
+	}
+
+	var subnet6 *net.IPNet
+	if pool.Spec.Subnet6 != "" {
+		_, subnet6, err = net.ParseCIDR(pool.Spec.Subnet6)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse subnet6 of ip pool %s", pool.Name)
+		}
+	}
+
+	addresses, addresses6 := []net.IP{}, []net.IP{}
+	for _, ip := range ips {
+		address := net.ParseIP(ip)
+		switch {
+		case address == nil:
+		case subnet.Contains(address):
+			addresses = append(addresses, normalizeIP(address))
+		case subnet6 != nil && subnet6.Contains(address):
+			addresses6 = append(addresses6, address)
+		}
+	}
+
+	for i, address := range addresses {
+		ipAddress := poolAddress(pool, address, subnet, defaultNamespace)
+		if i < len(addresses6) {
+			setPoolAddress6(ipAddress, pool, addresses6[i], subnet6)
+		}
+		networks.IPPool = append(networks.IPPool, *ipAddress)
+	}
+	return nil
+}
+
+func isSharedNetAttDefPool(pool *ippoolv1alpha1.IPPool) bool {
+	return pool.Spec.NetAttDefMode == ippoolv1alpha1.NetAttDefModeShared
+}
+
+// sharedNetAttDefName returns the name of the NetworkAttachmentDefinition shared by the addresses of a pool, e.g. sriov-n3-shared
+func sharedNetAttDefName(poolName string) string {
+	return fmt.Sprintf("%s-shared", poolName)
+}
+
+// useSharedNetAttDef points the address to the NetworkAttachmentDefinition shared by the pool. The settings rendered
+// into that NetworkAttachmentDefinition are the ones of the pool, so they are the same for all the addresses.
+func useSharedNetAttDef(ipAddress *sriovIpAddress, pool *ippoolv1alpha1.IPPool, defaultNamespace string) {
+	ipAddress.Name = sharedNetAttDefName(pool.Name)
+	ipAddress.Namespace = pool.Spec.NetworkNamespace
+	if ipAddress.Namespace == "" {
+		ipAddress.Namespace = defaultNamespace
+	}
+	ipAddress.Gateway = poolGateway(pool.Spec.Subnet, pool.Spec.Gateway)
+	if ipAddress.Address6 != "" {
+		ipAddress.Gateway6 = poolGateway(pool.Spec.Subnet6, pool.Spec.Gateway6)
+	}
+	ipAddress.Vlan = pool.Spec.Vlan
+	setPoolIPAMSettings(ipAddress, pool)
+	setPoolCNISettings(ipAddress, pool)
+	ipAddress.Shared = true
+}
+
+// setPoolIPAMSettings sets the nameservers, search domains and static routes of the pool to the address
+func setPoolIPAMSettings(ipAddress *sriovIpAddress, pool *ippoolv1alpha1.IPPool) {
+	ipAddress.Nameservers = nameserverList{defaultNameservers}
+	if len(pool.Spec.Nameservers) > 0 {
+		ipAddress.Nameservers = append(nameserverList{}, pool.Spec.Nameservers...)
+	}
+	ipAddress.Search = append([]string(nil), pool.Spec.Search...)
+	ipAddress.Routes = append([]ippoolv1alpha1.Route(nil), pool.Spec.Routes...)
+}
+
+// setPoolCNISettings sets the cni type of the pool and its settings to the address
+func setPoolCNISettings(ipAddress *sriovIpAddress, pool *ippoolv1alpha1.IPPool) {
+	ipAddress.CNIType = pool.Spec.CNIType
+	ipAddress.Master = pool.Spec.Master
+	ipAddress.Mode = pool.Spec.Mode
+	ipAddress.Bridge = pool.Spec.Bridge
+}
+
+// poolGateway returns the gateway of a pool subnet, the first usable host of the subnet when the pool sets none
+func poolGateway(cidr, gateway string) string {
+	if gateway != "" {
+		return gateway
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ""
+	}
+	first, _ := usableHosts(subnet)
+	return first.String()
+}
+
+// completeRequestedAddresses puts the explicitly requested addresses given without prefix length in CIDR form with
+// the prefix of the requested subnet, and defaults the gateway of the entries to the one of the pool serving the
+// subnet or to the first usable host of the subnet. The entries without search domains nor routes get the ones of
+// the pool, the entries without cni type get the cni type of the pool and its settings. It returns true when an entry
+// was completed.
+func (p *IPManager) completeRequestedAddresses(networks *sriovNetwork) (bool, error) {
+	if len(networks.IPPool) == 0 {
+		return false, nil
+	}
+
+	subnet6 := networks.Subnet6
+	gateway, gateway6 := "", ""
+	var pool *ippoolv1alpha1.IPPool
+	if networks.Subnet != "" {
+		var err error
+		pool, err = p.findIPPool(networks.Subnet, networks.ResourceName)
+		if err != nil {
+			return false, err
+		}
+		if pool != nil {
+			gateway, gateway6 = pool.Spec.Gateway, pool.Spec.Gateway6
+			if subnet6 == "" {
+				subnet6 = pool.Spec.Subnet6
+			}
+		}
+	}
+
+	changed := false
+	for i := range networks.IPPool {
+		network := &networks.IPPool[i]
+		if pool != nil && len(network.Search) == 0 && len(pool.Spec.Search) != 0 {
+			network.Search = append([]string(nil), pool.Spec.Search...)
+			changed = true
+		}
+		if pool != nil && len(network.Routes) == 0 && len(pool.Spec.Routes) != 0 {
+			network.Routes = append([]ippoolv1alpha1.Route(nil), pool.Spec.Routes...)
+			changed = true
+		}
+		if pool != nil && network.CNIType == "" && pool.Spec.CNIType != "" {
+			setPoolCNISettings(network, pool)
+			changed = true
+		}
+		completed, err := completeRequestedAddress(&network.Address, &network.Gateway, networks.Subnet, gateway)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || completed
+		if network.Address6 == "" {
+			continue
+		}
+		completed, err = completeRequestedAddress(&network.Address6, &network.Gateway6, subnet6, gateway6)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || completed
+	}
+	return changed, nil
+}
+
+func completeRequestedAddress(address, gateway *string, cidr, defaultGateway string) (bool, error) {
+	changed := false
+	if !strings.Contains(*address, "/") {
+		if cidr == "" {
+			return false, fmt.Errorf("address %s has no prefix length and no subnet to take it from", *address)
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to parse subnet %q", cidr)
+		}
+		prefixLength, _ := subnet.Mask.Size()
+		*address = fmt.Sprintf("%s/%d", *address, prefixLength)
+		changed = true
+	}
+	if *gateway == "" && cidr != "" {
+		*gateway = poolGateway(cidr, defaultGateway)
+		changed = *gateway != "" || changed
+	}
+	return changed, nil
+}
+
+// nextFreeIP walks the pool ranges and returns the first address not in use
+func (p *IPManager) nextFreeIP(pool *ippoolv1alpha1.IPPool) (net.IP, *net.IPNet, error) {
+	return p.nextFreeIPInSubnet(pool.Name, pool.Spec.Subnet, pool.Spec.Ranges, pool.Spec.Gateway)
+}
+
+// nextFreeIP6 walks the Subnet6 ranges of a dual-stack pool and returns the first address not in use
+func (p *IPManager) nextFreeIP6(pool *ippoolv1alpha1.IPPool) (net.IP, *net.IPNet, error) {
+	return p.nextFreeIPInSubnet(pool.Name, pool.Spec.Subnet6, pool.Spec.Ranges6, pool.Spec.Gateway6)
+}
+
+func (p *IPManager) nextFreeIPInSubnet(poolName, cidr string, poolRanges []ippoolv1alpha1.IPRange, gatewayAddress string) (net.IP, *net.IPNet, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to parse subnet of ip pool %s", poolName)
+	}
+
+	ranges, err := subnetRanges(poolName, poolRanges, subnet)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gateway := net.ParseIP(poolGateway(cidr, gatewayAddress))
+	for _, r := range ranges {
+		for ip := r.start; bytes.Compare(ip, r.end) <= 0; ip = nextIP(ip) {
+			if gateway != nil && gateway.Equal(ip) {
+				continue
+			}
+			if !p.ipPoolMap.isAllocated(ip.String()) {
+				return ip, subnet, nil
+			}
+			if ip.Equal(r.end) {
+				break
+			}
+		}
+	}
+
+	return nil, nil, &poolExhaustedError{poolName: poolName}
+}
+
+// noIPPoolError is returned when no pool serves the requested subnet and resource
+type noIPPoolError struct {
+	subnet       string
+	resourceName string
+}
+
+func (e *noIPPoolError) Error() string {
+	return fmt.Sprintf("no ip pool found for subnet %s and resource %s", e.subnet, e.resourceName)
+}
+
+// poolExhaustedError is returned when a pool has no free address left, or no free MAC when mac is set
+type poolExhaustedError struct {
+	poolName string
+	mac      bool
+}
+
+func (e *poolExhaustedError) Error() string {
+	if e.mac {
+		return fmt.Sprintf("mac range of ip pool %s is exhausted", e.poolName)
+	}
+	return fmt.Sprintf("ip pool %s is exhausted", e.poolName)
+}
+
+type ipRange struct {
+	start net.IP
+	end   net.IP
+}
+
+// subnetRanges returns the allocatable ranges of a pool subnet, all its usable hosts when no range is set
+func subnetRanges(poolName string, poolRanges []ippoolv1alpha1.IPRange, subnet *net.IPNet) ([]ipRange, error) {
+	if len(poolRanges) == 0 {
+		first, last := usableHosts(subnet)
+		return []ipRange{{start: first, end: last}}, nil
+	}
+
+	ranges := []ipRange{}
+	for _, r := range poolRanges {
+		start := normalizeIP(net.ParseIP(r.Start))
+		end := normalizeIP(net.ParseIP(r.End))
+		if start == nil || end == nil {
+			return nil, fmt.Errorf("ip pool %s has an invalid range %s-%s", poolName, r.Start, r.End)
+		}
+		if !subnet.Contains(start) || !subnet.Contains(end) || bytes.Compare(start, end) > 0 {
+			return nil, fmt.Errorf("ip pool %s range %s-%s is not inside subnet %s", poolName, r.Start, r.End, subnet.String())
+		}
+		ranges = append(ranges, ipRange{start: start, end: end})
+	}
+	return ranges, nil
+}
+
+// usableHosts returns the first and last host addresses of the subnet, skipping the network and broadcast addresses
+func usableHosts(subnet *net.IPNet) (net.IP, net.IP) {
+	first := normalizeIP(subnet.IP)
+	last := make(net.IP, len(first))
+	for i := range first {
+		last[i] = first[i] | ^subnet.Mask[i]
+	}
+
+	ones, bits := subnet.Mask.Size()
+	if bits-ones < 2 {
+		return first, last
+	}
+	return nextIP(first), prevIP(last)
+}
+
+// normalizeIP returns the 4 bytes form of ipv4 addresses so it can be compared to subnet bounds
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+func prevIP(ip net.IP) net.IP {
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// netAttDefNameForIP returns the name of the per address NetworkAttachmentDefinition, e.g. sriov-n3-static-100-100-100-100
+func netAttDefNameForIP(poolName string, ip net.IP) string {
+	return fmt.Sprintf("%s-static-%s", poolName, strings.NewReplacer(".", "-", ":", "-").Replace(ip.String()))
+}
+
+// poolNameForAddress returns the name of the IPPool whose subnet contains the address, empty if there is none
+func (p *IPManager) poolNameForAddress(ip, resourceName string) string {
+	address := net.ParseIP(ip)
+	if address == nil {
+		return ""
+	}
+
+	poolList := &ippoolv1alpha1.IPPoolList{}
+	err := p.cachedKubeClient.List(context.TODO(), poolList)
+	if err != nil {
+		log.Error(err, "failed to list ip pools")
+		return ""
+	}
+
+	for _, pool := range poolList.Items {
+		if resourceName != "" && pool.Spec.ResourceName != resourceName {
+			continue
+		}
+		for _, cidr := range []string{pool.Spec.Subnet, pool.Spec.Subnet6} {
+			_, poolNet, err := net.ParseCIDR(cidr)
+			if err == nil && poolNet.Contains(address) {
+				return pool.Name
+			}
+		}
+	}
+
+	return ""
+}
+
+// networksAllocations returns the addresses listed in the sriovnetworks annotation of a workload
+func (p *IPManager) networksAllocations(instanceName string, networks *sriovNetwork) (ipMap, error) {
+	allocations := ipMap{}
+	for _, network := range networks.IPPool {
+		for _, address := range network.addresses() {
+			ip, err := addressKey(address)
+			if err != nil {
+				return nil, err
+			}
+			allocations.createOrUpdateEntry(ip, ipEntry{
+				instanceName: instanceName,
+				poolName:     p.poolNameForAddress(ip, networks.ResourceName),
+				netAttDef:    network.netAttDefKey(),
+				mac:          network.MAC,
+			})
+		}
+	}
+	return allocations, nil
+}
+
+// allocateNetworks picks an address from the matching pool when none was requested explicitly, renders the
+// NetworkAttachmentDefinitions of all the addresses and records them as pending allocations of the instance.
+// On dry-run the networks are completed the same way but nothing is created nor reserved.
+// It returns true when the networks were changed and have to be written back to the workload annotation, i.e. they
+// were completed with an address or a MAC from a pool or their addresses were moved to the NetworkAttachmentDefinition
+// shared by the pool.
+func (p *IPManager) allocateNetworks(networks *sriovNetwork, defaultNamespace, instanceName string, transactionTimestamp *time.Time, isNotDryRun bool) (bool, error) {
+	requested := append([]sriovIpAddress{}, networks.IPPool...)
+	for conflicts := 0; ; conflicts++ {
+		networksChanged, err := p.allocateNetworksOnce(networks, defaultNamespace, instanceName, transactionTimestamp, isNotDryRun)
+		if _, isConflict := err.(*ledgerConflictError); !isConflict || conflicts == maxLedgerConflicts {
+			return networksChanged, err
+		}
+		// another replica claimed an address or a MAC first, the ledger it wrote is mirrored now. The requested
+		// addresses then fail as held, the ones picked from the pool are picked again.
+		log.Info("allocation conflicted with another replica, retrying", "instanceName", instanceName, "error", err.Error())
+		networks.IPPool = append([]sriovIpAddress{}, requested...)
+	}
+}
+
+func (p *IPManager) allocateNetworksOnce(networks *sriovNetwork, defaultNamespace, instanceName string, transactionTimestamp *time.Time, isNotDryRun bool) (bool, error) {
+	networksChanged := false
+	var pool *ippoolv1alpha1.IPPool
+	if len(networks.IPPool) == 0 {
+		// only the subnet and resource name were requested, pick a free address from the matching pool
+		ipAddress, allocatedFrom, err := p.allocateFromIPPool(networks, defaultNamespace)
+		if err != nil {
+			return false, err
+		}
+		networks.IPPool = append(networks.IPPool, *ipAddress)
+		pool = allocatedFrom
+		networksChanged = true
+		log.Info("allocated ip from pool", "instanceName", instanceName, "poolName", pool.Name, "address", ipAddress.Address,
+			"address6", ipAddress.Address6, "isNotDryRun", isNotDryRun)
+	} else if found, err := p.findIPPool(networks.Subnet, networks.ResourceName); err == nil && found != nil {
+		pool = found
+		if isSharedNetAttDefPool(pool) {
+			for i := range networks.IPPool {
+				if !networks.IPPool[i].Shared || networks.IPPool[i].Name != sharedNetAttDefName(pool.Name) {
+					useSharedNetAttDef(&networks.IPPool[i], pool, defaultNamespace)
+					networksChanged = true
+				}
+			}
+		}
+	}
+
+	poolName := ""
+	if pool != nil {
+		poolName = pool.Name
+		err := validateIPPoolSettings(pool)
+		if err != nil {
+			return false, err
+		}
+	}
+	macsAssigned, err := p.assignMACs(networks, pool, instanceName)
+	if err != nil {
+		return false, err
+	}
+	networksChanged = networksChanged || macsAssigned
+
+	if !isNotDryRun {
+		return networksChanged, nil
+	}
+
+	// the addresses of a Deployment ip set are used by the pod they are allocated to
+	_, _, isIPSet := parseDeploymentIPSetName(instanceName)
+	allocations := ipMap{}
+	reused := ipMap{}
+	for _, network := range networks.IPPool {
+		// both addresses of a dual-stack entry are reserved with the NetworkAttachmentDefinition they share
+		for _, address := range network.addresses() {
+			ip, err := addressKey(address)
+			if err != nil {
+				return false, err
+			}
+			entry := ipEntry{
+				instanceName:         instanceName,
+				poolName:             poolName,
+				netAttDef:            network.netAttDefKey(),
+				transactionTimestamp: transactionTimestamp,
+				inUse:                isIPSet,
+				mac:                  network.MAC,
+			}
+			// nothing is rendered unless all the addresses can be claimed
+			err = p.ipPoolMap.checkClaim(ip, entry)
+			if err != nil {
+				return false, err
+			}
+			// the instance already holds the address, e.g. an updated virtual machine, a recreated StatefulSet pod or
+			// the next pod of an ip set. It stays committed, a denied admission does not release it.
+			if held, exist := p.ipPoolMap[ip]; exist && held.instanceName == instanceName && !held.isPending() && held.netAttDef == entry.netAttDef {
+				if !isIPSet {
+					continue
+				}
+				if held.inUse {
+					return false, fmt.Errorf("ip %s of %s is used by another pod", ip, holderName(instanceName))
+				}
+				held.inUse = true
+				held.reuseTimestamp = transactionTimestamp
+				reused.createOrUpdateEntry(ip, held)
+				continue
+			}
+			allocations.createOrUpdateEntry(ip, entry)
+		}
+	}
+	claimed := ipMap{}
+	for ip, entry := range allocations {
+		claimed.createOrUpdateEntry(ip, entry)
+	}
+	for ip, entry := range reused {
+		claimed.createOrUpdateEntry(ip, entry)
+	}
+
+	netAttDefs, err := p.renderNetAttDefs(networks, poolName, instanceName)
+	if err != nil {
+		return false, err
+	}
+
+	// the ledger is written before the NetworkAttachmentDefinitions, another replica can not render the same addresses
+	err = p.claimInLedger(claimed)
+	if err != nil {
+		return false, err
+	}
+	for _, netAttDef := range netAttDefs {
+		err = p.createOrUpdateNetAttDef(netAttDef)
+		if err != nil {
+			if releaseErr := p.releaseInLedger(allocations); releaseErr != nil {
+				log.Error(releaseErr, "failed to release the addresses of a failed allocation from the ledger", "instanceName", instanceName)
+			}
+			if freeErr := p.claimInLedger(freedIPSetAddresses(reused)); freeErr != nil {
+				log.Error(freeErr, "failed to free the ip set addresses of a failed allocation in the ledger", "instanceName", instanceName)
+			}
+			return false, err
+		}
+	}
+
+	return networksChanged, nil
+}
+
+// renderNetAttDefs renders the NetworkAttachmentDefinitions of the networks with the templates of the pool, the
+// addresses of a shared pool all use the same one
+func (p *IPManager) renderNetAttDefs(networks *sriovNetwork, poolName, instanceName string) ([]*netattdefv1.NetworkAttachmentDefinition, error) {
+	netAttDefs := []*netattdefv1.NetworkAttachmentDefinition{}
+	rendered := map[types.NamespacedName]bool{}
+	for _, network := range networks.IPPool {
+		netAttDefName := types.NamespacedName{Namespace: network.Namespace, Name: network.Name}
+		if rendered[netAttDefName] {
+			continue
+		}
+		rendered[netAttDefName] = true
+
+		tmpl, err := p.cniTemplates.lookup(poolName, network.cniType())
+		if err != nil {
+			return nil, err
+		}
+		raw, err := network.RenderNetAttDef(networks.ResourceName, tmpl)
+		if err != nil {
+			return nil, err
+		}
+		netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+
+		err = p.Scheme.Convert(raw, netAttDef, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		// sticky addresses outlive their pods, the NetworkAttachmentDefinition records the identity holding them
+		// and the MAC reserved with them
+		if !network.Shared && (isStickyInstance(instanceName) || network.MAC != "") && netAttDef.Annotations == nil {
+			netAttDef.Annotations = map[string]string{}
+		}
+		if isStickyInstance(instanceName) && !network.Shared {
+			netAttDef.Annotations[netAttDefOwnerAnnotation] = instanceName
+		}
+		if network.MAC != "" && !network.Shared {
+			netAttDef.Annotations[netAttDefMACAnnotation] = network.MAC
+		}
+		netAttDefs = append(netAttDefs, netAttDef)
+	}
+	return netAttDefs, nil
+}
+
+// releaseAllocations removes the NetworkAttachmentDefinitions of the allocations and frees their addresses.
+// The NetworkAttachmentDefinitions shared by a pool are kept for the other addresses, the one of a dual-stack entry
+// is removed with its first address.
+func (p *IPManager) releaseAllocations(instanceName string, allocations ipMap) error {
+	released := ipMap{}
+	defer func() { p.recordPoolEvents(instanceName, eventReasonReleased, "released", released) }()
+
+	var err error
+	for ip, entry := range allocations {
+		err = p.deleteNetAttDef(entry.netAttDef)
+		metrics.Releases.WithLabelValues(metrics.Result(err), releaseReason(instanceName)).Inc()
+		if err != nil {
+			break
+		}
+		released.createOrUpdateEntry(ip, entry)
+	}
+
+	// the addresses whose NetworkAttachmentDefinition is gone are freed even when another one failed
+	ledgerErr := p.releaseInLedger(released)
+	if ledgerErr != nil {
+		released = ipMap{}
+		return ledgerErr
+	}
+	for ip := range released {
+		log.Info("released ip", "instanceName", instanceName, "address", ip)
+	}
+
+	return err
+}
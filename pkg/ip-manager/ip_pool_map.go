@@ -0,0 +1,185 @@
+package ip_manager
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type ipEntry struct {
+	instanceName string               // the workload holding the address, e.g. pod/namespace/name
+	poolName     string               // the IPPool the address belongs to, empty if no pool serves the subnet
+	netAttDef    types.NamespacedName // the NetworkAttachmentDefinition rendered for the address
+	// transactionTimestamp is set while the allocation waits for its workload to be created, nil once committed
+	transactionTimestamp *time.Time
+	// inUse tells whether a pod uses an address of a Deployment ip set, the free ones go to the next pod of the set
+	inUse bool
+	// podName is the pod using an address of a Deployment ip set, pod/namespace/name, recorded once the pod is created
+	podName string
+	// reuseTimestamp is set while the pod handed a free address of a Deployment ip set is not created yet, the
+	// address stays committed to the set and is freed again when the transaction expires
+	reuseTimestamp *time.Time
+	// mac is the MAC address reserved with the address, both addresses of a dual-stack entry share it
+	mac string
+	// interfaceName and observedMAC are the interface attaching the address and its MAC as reported by multus once
+	// the pod runs, see UpdatePodNetworkStatus
+	interfaceName string
+	observedMAC   string
+}
+
+func (e ipEntry) isPending() bool {
+	return e.transactionTimestamp != nil
+}
+
+// ipMap holds the allocated addresses keyed by their canonical (prefix less) form
+type ipMap map[string]ipEntry
+
+func (m ipMap) isAllocated(ip string) bool {
+	_, exist := m[ip]
+	return exist
+}
+
+func (m ipMap) createOrUpdateEntry(ip string, entry ipEntry) {
+	m[ip] = entry
+}
+
+// claim records the entry of an instance unless another instance already holds the address
+func (m ipMap) claim(ip string, entry ipEntry) error {
+	err := m.checkClaim(ip, entry)
+	if err != nil {
+		return err
+	}
+	m[ip] = entry
+	return nil
+}
+
+// checkClaim returns an error naming the holder of the address, or of the MAC of the entry, when it is not the
+// instance of the entry. The addresses restored from a NetworkAttachmentDefinition are handed over to the instance using it.
+func (m ipMap) checkClaim(ip string, entry ipEntry) error {
+	if held, exist := m[ip]; exist && !held.isClaimableBy(entry) {
+		return &addressHeldError{ip: ip, holder: holderName(held.instanceName)}
+	}
+	if entry.mac == "" {
+		return nil
+	}
+	for _, held := range m {
+		if held.mac == entry.mac && !held.isClaimableBy(entry) {
+			return &addressHeldError{ip: entry.mac, holder: holderName(held.instanceName)}
+		}
+	}
+	return nil
+}
+
+func (e ipEntry) isClaimableBy(entry ipEntry) bool {
+	if e.instanceName == entry.instanceName {
+		return true
+	}
+	return strings.HasPrefix(e.instanceName, netAttDefInstancePrefix) && e.netAttDef == entry.netAttDef
+}
+
+// isAttachedBy returns true when the NetworkAttachmentDefinition, namespace/name, attaches the address of the entry.
+// The entries of a pool sharing its NetworkAttachmentDefinition have none of their own, they are attached by the
+// shared one of the pool.
+func (e ipEntry) isAttachedBy(netAttDef string) bool {
+	if e.netAttDef.Name != "" {
+		return e.netAttDef.String() == netAttDef
+	}
+	_, name, _ := strings.Cut(netAttDef, "/")
+	return name == sharedNetAttDefName(e.poolName)
+}
+
+// allocatedMACs returns the MAC addresses reserved with the allocated addresses
+func (m ipMap) allocatedMACs() map[string]bool {
+	macs := map[string]bool{}
+	for _, entry := range m {
+		if entry.mac != "" {
+			macs[entry.mac] = true
+		}
+	}
+	return macs
+}
+
+// addressHeldError is returned for an address held by another instance
+type addressHeldError struct {
+	ip     string
+	holder string
+}
+
+func (e *addressHeldError) Error() string {
+	return fmt.Sprintf("address %s is already held by %s", e.ip, e.holder)
+}
+
+// holderName returns the kind/namespace/name of the workload behind an instance name, e.g. statefulset/default/web
+// for the identity of the pod web-0
+func holderName(instanceName string) string {
+	if owner, _, ordinal, ok := parseStatefulSetIdentity(instanceName); ok {
+		return fmt.Sprintf("statefulset/%s/%s (pod %s-%d)", owner.Namespace, owner.Name, owner.Name, ordinal)
+	}
+	if owner, _, ok := parseDeploymentIPSetName(instanceName); ok {
+		return fmt.Sprintf("deployment/%s/%s", owner.Namespace, owner.Name)
+	}
+	kind, namespacedName, _ := strings.Cut(instanceName, "/")
+	switch kind {
+	case "vm":
+		kind = "virtualmachine"
+	case "netattdef":
+		kind = "networkattachmentdefinition"
+	}
+	return kind + "/" + namespacedName
+}
+
+func (m ipMap) removeEntry(ip string) {
+	delete(m, ip)
+}
+
+func (m ipMap) filterPendingOlderThan(deadline time.Time) ipMap {
+	filtered := ipMap{}
+	for ip, entry := range m {
+		if entry.isPending() && entry.transactionTimestamp.Before(deadline) {
+			filtered[ip] = entry
+		}
+	}
+	return filtered
+}
+
+// filterReusedOlderThan returns the addresses of ip sets handed to a pod that was not created before the deadline
+func (m ipMap) filterReusedOlderThan(deadline time.Time) ipMap {
+	filtered := ipMap{}
+	for ip, entry := range m {
+		if entry.reuseTimestamp != nil && entry.reuseTimestamp.Before(deadline) {
+			filtered[ip] = entry
+		}
+	}
+	return filtered
+}
+
+func (m ipMap) filterByInstanceName(instanceName string) ipMap {
+	filtered := ipMap{}
+	for ip, entry := range m {
+		if entry.instanceName == instanceName {
+			filtered[ip] = entry
+		}
+	}
+	return filtered
+}
+
+// sortIPs orders canonical addresses numerically
+func sortIPs(ips []string) {
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(net.ParseIP(ips[i]).To16(), net.ParseIP(ips[j]).To16()) < 0
+	})
+}
+
+// addressKey returns the canonical form of an address given with or without a prefix length
+func addressKey(address string) (string, error) {
+	ip := net.ParseIP(strings.Split(address, "/")[0])
+	if ip == nil {
+		return "", fmt.Errorf("failed to parse ip address %q", address)
+	}
+	return ip.String(), nil
+}
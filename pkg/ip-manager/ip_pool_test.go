@@ -0,0 +1,311 @@
+package ip_manager
+
+import (
+	"context"
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+func createTestIPManager(objects ...client.Object) *IPManager {
+	scheme := runtime.NewScheme()
+	Expect(corev1.AddToScheme(scheme)).To(Succeed())
+	Expect(appsv1.AddToScheme(scheme)).To(Succeed())
+	Expect(netattdefv1.AddToScheme(scheme)).To(Succeed())
+	Expect(ippoolv1alpha1.AddToScheme(scheme)).To(Succeed())
+
+	fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).Build()
+	// the recorder drops the events, the tests checking them set a buffered one
+	ipManager, err := NewIPManager(fakeClient, fakeClient, "kubeipfixed-system", false, 600, scheme, &record.FakeRecorder{})
+	Expect(err).ToNot(HaveOccurred())
+	return ipManager
+}
+
+func newTestIPPool(name, subnet string, ranges ...ippoolv1alpha1.IPRange) *ippoolv1alpha1.IPPool {
+	return &ippoolv1alpha1.IPPool{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: ippoolv1alpha1.IPPoolSpec{
+			Subnet:       subnet,
+			Ranges:       ranges,
+			Gateway:      "100.100.100.1",
+			Nameservers:  []string{"8.8.8.8"},
+			ResourceName: "mecdev.com/intel2v2nics",
+		},
+	}
+}
+
+func newTestDualStackIPPool(name string) *ippoolv1alpha1.IPPool {
+	pool := newTestIPPool(name, "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"})
+	pool.Spec.Subnet6 = "fd00:100::/64"
+	pool.Spec.Ranges6 = []ippoolv1alpha1.IPRange{{Start: "fd00:100::100", End: "fd00:100::200"}}
+	pool.Spec.Gateway6 = "fd00:100::1"
+	return pool
+}
+
+func newTestPod(name, sriovNetworks string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Annotations: map[string]string{sriovNetworksAnnotation: sriovNetworks},
+		},
+	}
+}
+
+var _ = Describe("IP Pool", func() {
+	Describe("Internal Functions", func() {
+		It("should skip the network, broadcast and gateway addresses", func() {
+			ipManager := createTestIPManager()
+			pool := newTestIPPool("sriov-n3", "100.100.100.0/30")
+
+			ip, _, err := ipManager.nextFreeIP(pool)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip.String()).To(Equal("100.100.100.2"))
+
+			ipManager.ipPoolMap.createOrUpdateEntry("100.100.100.2", ipEntry{instanceName: "pod/default/other"})
+			_, _, err = ipManager.nextFreeIP(pool)
+			Expect(err).To(MatchError("ip pool sriov-n3 is exhausted"))
+		})
+
+		It("should only allocate inside the pool ranges", func() {
+			ipManager := createTestIPManager()
+			pool := newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.101"})
+			ipManager.ipPoolMap.createOrUpdateEntry("100.100.100.100", ipEntry{instanceName: "pod/default/other"})
+
+			ip, _, err := ipManager.nextFreeIP(pool)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip.String()).To(Equal("100.100.100.101"))
+		})
+
+		It("should reject a range outside of the subnet", func() {
+			ipManager := createTestIPManager()
+			pool := newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.101.1", End: "100.100.101.10"})
+
+			_, _, err := ipManager.nextFreeIP(pool)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should keep the first usable host for the gateway of a pool without one", func() {
+			ipManager := createTestIPManager()
+			pool := newTestIPPool("sriov-n3", "100.100.100.0/29")
+			pool.Spec.Gateway = ""
+
+			ip, subnet, err := ipManager.nextFreeIP(pool)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip.String()).To(Equal("100.100.100.2"))
+			Expect(poolAddress(pool, ip, subnet, "default").Gateway).To(Equal("100.100.100.1"))
+		})
+
+		It("should allocate the ipv6 addresses of a dual-stack pool from its own subnet", func() {
+			ipManager := createTestIPManager()
+			pool := newTestDualStackIPPool("sriov-n3")
+			pool.Spec.Ranges6 = nil
+			ipManager.ipPoolMap.createOrUpdateEntry("fd00:100::2", ipEntry{instanceName: "pod/default/other"})
+
+			ip, subnet, err := ipManager.nextFreeIP6(pool)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ip.String()).To(Equal("fd00:100::3"))
+			Expect(subnet.String()).To(Equal("fd00:100::/64"))
+		})
+	})
+
+	Describe("AllocatePodIP", func() {
+		It("should pick a free address from the matching pool and render its NetworkAttachmentDefinition", func() {
+			ipManager := createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}))
+
+			pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+			Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+
+			networks := &sriovNetwork{}
+			Expect(json.Unmarshal([]byte(pod.Annotations[sriovNetworksAnnotation]), networks)).To(Succeed())
+			Expect(networks.IPPool).To(HaveLen(1))
+			Expect(networks.IPPool[0].Address).To(Equal("100.100.100.100/24"))
+			Expect(networks.IPPool[0].Gateway).To(Equal("100.100.100.1"))
+			Expect(networks.IPPool[0].Name).To(Equal("sriov-n3-static-100-100-100-100"))
+			Expect(ipManager.ipPoolMap).To(HaveKeyWithValue("100.100.100.100", ipEntry{
+				instanceName:         "pod/default/pod-1",
+				poolName:             "sriov-n3",
+				netAttDef:            types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-100"},
+				transactionTimestamp: &testTransactionTimestamp,
+			}))
+
+			netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+			Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-100"}, netAttDef)).To(Succeed())
+			Expect(netAttDef.Spec.Config).To(ContainSubstring(`"address": "100.100.100.100/24"`))
+
+			secondPod := newTestPod("pod-2", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+			Expect(ipManager.AllocatePodIP(secondPod, &testTransactionTimestamp, true)).To(Succeed())
+			Expect(secondPod.Annotations[sriovNetworksAnnotation]).To(ContainSubstring("100.100.100.101/24"))
+		})
+
+		It("should pass the address at runtime to the NetworkAttachmentDefinition shared by the pool", func() {
+			pool := newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"})
+			pool.Spec.NetAttDefMode = ippoolv1alpha1.NetAttDefModeShared
+			ipManager := createTestIPManager(pool)
+
+			pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+			Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+			Expect(pod.Annotations[NetworksAnnotation]).To(MatchJSON(`[{"name": "sriov-n3-shared", "namespace": "default", "ips": ["100.100.100.100/24"], "interface": "net1"}]`))
+
+			secondPod := newTestPod("pod-2", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "static", "address": "100.100.100.150/24"}]}`)
+			Expect(ipManager.AllocatePodIP(secondPod, &testTransactionTimestamp, true)).To(Succeed())
+			Expect(secondPod.Annotations[NetworksAnnotation]).To(MatchJSON(`[{"name": "sriov-n3-shared", "namespace": "default", "ips": ["100.100.100.150/24"], "interface": "net1"}]`))
+			Expect(secondPod.Annotations[sriovNetworksAnnotation]).To(ContainSubstring(`"shared":true`))
+
+			netAttDefList := &netattdefv1.NetworkAttachmentDefinitionList{}
+			Expect(ipManager.kubeClient.List(context.TODO(), netAttDefList)).To(Succeed())
+			Expect(netAttDefList.Items).To(HaveLen(1))
+			netAttDef := netAttDefList.Items[0]
+			Expect(netAttDef.Name).To(Equal("sriov-n3-shared"))
+			Expect(netAttDef.Annotations).ToNot(HaveKey(netAttDefAddressAnnotation))
+			Expect(netAttDef.Spec.Config).To(ContainSubstring(`"capabilities": { "ips": true }`))
+			Expect(netAttDef.Spec.Config).To(ContainSubstring(`"gw": "100.100.100.1"`))
+			config := map[string]interface{}{}
+			Expect(json.Unmarshal([]byte(netAttDef.Spec.Config), &config)).To(Succeed())
+
+			Expect(ipManager.ReleasePodIPs(pod)).To(Succeed())
+			Expect(ipManager.ipPoolMap).ToNot(HaveKey("100.100.100.100"))
+			Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "sriov-n3-shared"}, &netattdefv1.NetworkAttachmentDefinition{})).To(Succeed())
+		})
+
+		It("should render the NetworkAttachmentDefinition with the cni type of the pool", func() {
+			pool := newTestIPPool("macvlan-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"})
+			pool.Spec.ResourceName = ""
+			pool.Spec.CNIType = ippoolv1alpha1.CNITypeMacvlan
+			pool.Spec.Master = "eth1"
+			pool.Spec.Mode = "bridge"
+			ipManager := createTestIPManager(pool)
+
+			pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24"}`)
+			Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+			Expect(pod.Annotations[sriovNetworksAnnotation]).To(ContainSubstring(`"cniType":"macvlan","master":"eth1","mode":"bridge"`))
+
+			netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+			Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "macvlan-n3-static-100-100-100-100"}, netAttDef)).To(Succeed())
+			Expect(netAttDef.Annotations).ToNot(HaveKey(netAttDefResourceNameAnnotation))
+			Expect(netAttDef.Spec.Config).To(ContainSubstring(`"type":"macvlan","master":"eth1","mode":"bridge",`))
+
+			explicit := newTestPod("pod-2", `{"subnet": "100.100.100.0/24", "ippool": [{"name": "n3", "address": "100.100.100.150"}]}`)
+			Expect(ipManager.AllocatePodIP(explicit, &testTransactionTimestamp, true)).To(Succeed())
+			Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "n3"}, netAttDef)).To(Succeed())
+			Expect(netAttDef.Spec.Config).To(ContainSubstring(`"type":"macvlan"`))
+		})
+
+		It("should allocate an ipv4 and an ipv6 address on the same interface from a dual-stack pool", func() {
+			ipManager := createTestIPManager(newTestDualStackIPPool("sriov-n3"))
+
+			pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+			Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+
+			networks := &sriovNetwork{}
+			Expect(json.Unmarshal([]byte(pod.Annotations[sriovNetworksAnnotation]), networks)).To(Succeed())
+			Expect(networks.IPPool).To(HaveLen(1))
+			Expect(networks.IPPool[0].Address).To(Equal("100.100.100.100/24"))
+			Expect(networks.IPPool[0].Address6).To(Equal("fd00:100::100/64"))
+			Expect(networks.IPPool[0].Gateway6).To(Equal("fd00:100::1"))
+			netAttDefName := types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-100"}
+			for _, ip := range []string{"100.100.100.100", "fd00:100::100"} {
+				Expect(ipManager.ipPoolMap).To(HaveKeyWithValue(ip, ipEntry{
+					instanceName:         "pod/default/pod-1",
+					poolName:             "sriov-n3",
+					netAttDef:            netAttDefName,
+					transactionTimestamp: &testTransactionTimestamp,
+				}))
+			}
+
+			netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+			Expect(ipManager.kubeClient.Get(context.TODO(), netAttDefName, netAttDef)).To(Succeed())
+			Expect(netAttDef.Annotations).To(HaveKeyWithValue(netAttDefAddressAnnotation, "100.100.100.100/24,fd00:100::100/64"))
+			Expect(netAttDef.Spec.Config).To(ContainSubstring(`"addresses": [{ "address": "100.100.100.100/24", "gateway": "100.100.100.1" }, { "address": "fd00:100::100/64", "gateway": "fd00:100::1" }]`))
+			config := map[string]interface{}{}
+			Expect(json.Unmarshal([]byte(netAttDef.Spec.Config), &config)).To(Succeed())
+
+			secondPod := newTestPod("pod-2", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+			Expect(ipManager.AllocatePodIP(secondPod, &testTransactionTimestamp, true)).To(Succeed())
+			Expect(secondPod.Annotations[sriovNetworksAnnotation]).To(ContainSubstring(`"address6":"fd00:100::101/64"`))
+
+			Expect(ipManager.ReleasePodIPs(pod)).To(Succeed())
+			Expect(ipManager.ipPoolMap).ToNot(HaveKey("100.100.100.100"))
+			Expect(ipManager.ipPoolMap).ToNot(HaveKey("fd00:100::100"))
+			Expect(ipManager.ipPoolMap).To(HaveKey("fd00:100::101"))
+			Expect(ipManager.kubeClient.Get(context.TODO(), netAttDefName, &netattdefv1.NetworkAttachmentDefinition{})).ToNot(Succeed())
+		})
+
+		It("should pass both addresses and default routes of a dual-stack pool to the shared NetworkAttachmentDefinition", func() {
+			pool := newTestDualStackIPPool("sriov-n3")
+			pool.Spec.NetAttDefMode = ippoolv1alpha1.NetAttDefModeShared
+			ipManager := createTestIPManager(pool)
+
+			pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+			Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+			Expect(pod.Annotations[NetworksAnnotation]).To(MatchJSON(`[{"name": "sriov-n3-shared", "namespace": "default", "ips": ["100.100.100.100/24", "fd00:100::100/64"], "interface": "net1"}]`))
+
+			netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+			Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "sriov-n3-shared"}, netAttDef)).To(Succeed())
+			Expect(netAttDef.Spec.Config).To(ContainSubstring(`"routes": [{ "dst": "0.0.0.0/0", "gw": "100.100.100.1" }, { "dst": "::/0", "gw": "fd00:100::1" }]`))
+			config := map[string]interface{}{}
+			Expect(json.Unmarshal([]byte(netAttDef.Spec.Config), &config)).To(Succeed())
+		})
+
+		It("should allocate from an ipv6 only pool", func() {
+			pool := newTestIPPool("sriov-v6", "fd00:200::/64", ippoolv1alpha1.IPRange{Start: "fd00:200::10", End: "fd00:200::20"})
+			pool.Spec.Gateway = "fd00:200::1"
+			ipManager := createTestIPManager(pool)
+
+			pod := newTestPod("pod-1", `{"subnet": "fd00:200::/64", "resourcename": "mecdev.com/intel2v2nics"}`)
+			Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+			Expect(pod.Annotations[sriovNetworksAnnotation]).To(ContainSubstring(`"address":"fd00:200::10/64"`))
+			Expect(ipManager.ipPoolMap).To(HaveKey("fd00:200::10"))
+
+			netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+			Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "sriov-v6-static-fd00-200--10"}, netAttDef)).To(Succeed())
+			Expect(netAttDef.Spec.Config).To(ContainSubstring(`{ "address": "fd00:200::10/64", "gateway": "fd00:200::1" }`))
+		})
+
+		It("should derive the prefix length and the gateway of a bare address from the subnet", func() {
+			pool := newTestIPPool("sriov-n3", "100.100.100.0/24")
+			pool.Spec.Gateway = "100.100.100.254"
+			ipManager := createTestIPManager(pool)
+
+			pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "n3", "address": "100.100.100.150"}]}`)
+			Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+
+			networks := &sriovNetwork{}
+			Expect(json.Unmarshal([]byte(pod.Annotations[sriovNetworksAnnotation]), networks)).To(Succeed())
+			Expect(networks.IPPool[0].Address).To(Equal("100.100.100.150/24"))
+			Expect(networks.IPPool[0].Gateway).To(Equal("100.100.100.254"))
+
+			netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+			Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "n3"}, netAttDef)).To(Succeed())
+			Expect(netAttDef.Spec.Config).To(ContainSubstring(`{ "address": "100.100.100.150/24", "gateway": "100.100.100.254" }`))
+		})
+
+		It("should default the gateway of an address outside of any pool to the first usable host", func() {
+			ipManager := createTestIPManager()
+
+			pod := newTestPod("pod-1", `{"subnet": "100.100.200.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "n3", "address": "100.100.200.150"}]}`)
+			Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+			Expect(pod.Annotations[sriovNetworksAnnotation]).To(ContainSubstring(`"address":"100.100.200.150/24","gateway":"100.100.200.1"`))
+		})
+
+		It("should fail when no pool serves the requested subnet", func() {
+			ipManager := createTestIPManager()
+
+			pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+			Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).ToNot(Succeed())
+		})
+	})
+})
@@ -0,0 +1,796 @@
+package ip_manager
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+// The allocations are committed to a ledger before anything is rendered for them. The ledger is sharded into
+// ConfigMaps of the manager namespace, one per pool and block of 2048 addresses, so that a shard stays far below the
+// size limit of a ConfigMap however large the pools are, and the allocations of different pools do not conflict.
+// Every replica serving the webhooks writes the shards with optimistic concurrency on their resourceVersion, an
+// address claimed concurrently by another replica makes the write conflict instead of being handed out twice.
+// The MACs are unique across all the pools, the address holding a MAC is recorded in the MAC shard of its last byte
+// once the address is claimed, so that two addresses of different shards can not be given the same MAC.
+// The allocation state of a replica mirrors the address shards once they exist.
+const (
+	// LedgerConfigMapName prefixes the ConfigMaps of the manager namespace holding the allocations of all the replicas
+	LedgerConfigMapName = "kubeipfixed-ledger"
+	// macLedgerConfigMapName prefixes the ConfigMaps of the ledger recording the address holding each MAC
+	macLedgerConfigMapName = LedgerConfigMapName + "-mac"
+	// ledgerLabel marks the ConfigMaps of the ledger, it is true for the address shards and mac for the MAC shards
+	ledgerLabel    = "kubeippool.io/ledger"
+	macLedgerLabel = "mac"
+	// ledgerBlockBits is the size of the blocks of addresses recorded by a shard, 2^11 addresses
+	ledgerBlockBits = 11
+	// maxLedgerConflicts bounds the free addresses picked again after the picked one was claimed by another replica
+	maxLedgerConflicts = 3
+)
+
+// ledgerEntry is the ledger record of an allocated address, the ConfigMap keys are the addresses
+type ledgerEntry struct {
+	Instance    string     `json:"instance"`
+	Pool        string     `json:"pool,omitempty"`
+	NetAttDef   string     `json:"netAttDef,omitempty"`
+	MAC         string     `json:"mac,omitempty"`
+	Transaction *time.Time `json:"transaction,omitempty"`
+	InUse       bool       `json:"inUse,omitempty"`
+	Pod         string     `json:"pod,omitempty"`
+	Reuse       *time.Time `json:"reuse,omitempty"`
+	Interface   string     `json:"interface,omitempty"`
+	ObservedMAC string     `json:"observedMAC,omitempty"`
+}
+
+// ledgerConflictError is returned when the ledger holds an address or a MAC for another instance
+type ledgerConflictError struct {
+	*addressHeldError
+}
+
+func (e *ledgerConflictError) Unwrap() error {
+	return e.addressHeldError
+}
+
+// ledgerShardName returns the ConfigMap recording the address of the pool, kubeipfixed-ledger-<pool>-<block>, e.g.
+// kubeipfixed-ledger-sriov-n3-100-100-96-0, the pool is left out for the addresses outside of the pools
+func ledgerShardName(poolName string, ip net.IP) string {
+	name := LedgerConfigMapName
+	if poolName != "" {
+		name += "-" + poolName
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		block := ip4.Mask(net.CIDRMask(32-ledgerBlockBits, 32))
+		return name + "-" + strings.ReplaceAll(block.String(), ".", "-")
+	}
+	block := ip.To16().Mask(net.CIDRMask(128-ledgerBlockBits, 128))
+	return name + "-" + hex.EncodeToString(block)
+}
+
+// ledgerShards groups the addresses by the shard recording them. An address not recorded yet goes to the shard of the
+// first pool by name whose subnets contain it, whatever its resource name, so that all the replicas pick the same one.
+func (p *IPManager) ledgerShards(addresses ipMap) (map[string]ipMap, error) {
+	poolList := &ippoolv1alpha1.IPPoolList{}
+	err := p.cachedKubeClient.List(context.TODO(), poolList)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list the ip pools of the allocation ledger")
+	}
+	sort.Slice(poolList.Items, func(i, j int) bool { return poolList.Items[i].Name < poolList.Items[j].Name })
+
+	shards := map[string]ipMap{}
+	for ip, entry := range addresses {
+		address := net.ParseIP(ip)
+		if address == nil {
+			return nil, fmt.Errorf("invalid address %q in the allocation ledger", ip)
+		}
+		name := p.recordingShard(ip)
+		if name == "" {
+			name = ledgerShardName(poolNameContaining(poolList, address), address)
+		}
+		if shards[name] == nil {
+			shards[name] = ipMap{}
+		}
+		shards[name].createOrUpdateEntry(ip, entry)
+	}
+	return shards, nil
+}
+
+// macLedgerShardName returns the ConfigMap recording the address holding the MAC, kubeipfixed-ledger-mac-<last byte>,
+// e.g. kubeipfixed-ledger-mac-01
+func macLedgerShardName(mac string) string {
+	hardwareAddr, err := net.ParseMAC(mac)
+	if err != nil || len(hardwareAddr) == 0 {
+		return macLedgerConfigMapName
+	}
+	return fmt.Sprintf("%s-%02x", macLedgerConfigMapName, hardwareAddr[len(hardwareAddr)-1])
+}
+
+// recordingShard returns the shard the address is recorded in, the address stays there when the pools change
+func (p *IPManager) recordingShard(ip string) string {
+	for name, ledger := range p.ledger {
+		if ledger.isAllocated(ip) {
+			return name
+		}
+	}
+	return ""
+}
+
+func poolNameContaining(poolList *ippoolv1alpha1.IPPoolList, address net.IP) string {
+	for _, pool := range poolList.Items {
+		for _, cidr := range []string{pool.Spec.Subnet, pool.Spec.Subnet6} {
+			_, subnet, err := net.ParseCIDR(cidr)
+			if err == nil && subnet.Contains(address) {
+				return pool.Name
+			}
+		}
+	}
+	return ""
+}
+
+// ledgerKey turns an address into a ConfigMap key, the colons of IPv6 addresses are not allowed there
+func ledgerKey(ip string) string {
+	return strings.ReplaceAll(ip, ":", "_")
+}
+
+func ledgerAddress(key string) string {
+	return strings.ReplaceAll(key, "_", ":")
+}
+
+func decodeLedger(configMap *corev1.ConfigMap) (ipMap, error) {
+	ledger := ipMap{}
+	for key, value := range configMap.Data {
+		record := ledgerEntry{}
+		err := json.Unmarshal([]byte(value), &record)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid entry %s in the allocation ledger", key)
+		}
+		entry := ipEntry{
+			instanceName:         record.Instance,
+			poolName:             record.Pool,
+			transactionTimestamp: record.Transaction,
+			inUse:                record.InUse,
+			podName:              record.Pod,
+			reuseTimestamp:       record.Reuse,
+			mac:                  record.MAC,
+			interfaceName:        record.Interface,
+			observedMAC:          record.ObservedMAC,
+		}
+		if namespace, name, found := strings.Cut(record.NetAttDef, "/"); found {
+			entry.netAttDef = types.NamespacedName{Namespace: namespace, Name: name}
+		}
+		ledger[ledgerAddress(key)] = entry
+	}
+	return ledger, nil
+}
+
+func encodeLedger(configMap *corev1.ConfigMap, ledger ipMap) error {
+	configMap.Data = map[string]string{}
+	for ip, entry := range ledger {
+		record := ledgerEntry{
+			Instance:    entry.instanceName,
+			Pool:        entry.poolName,
+			MAC:         entry.mac,
+			Transaction: entry.transactionTimestamp,
+			InUse:       entry.inUse,
+			Pod:         entry.podName,
+			Reuse:       entry.reuseTimestamp,
+			Interface:   entry.interfaceName,
+			ObservedMAC: entry.observedMAC,
+		}
+		if entry.netAttDef.Name != "" {
+			record.NetAttDef = entry.netAttDef.String()
+		}
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		configMap.Data[ledgerKey(ip)] = string(value)
+	}
+	return nil
+}
+
+// updateLedgerShard applies the update to a shard of the ledger and mirrors the result, the update runs again on the
+// latest shard when another replica wrote it in the meantime. A missing shard is created from the allocations this
+// replica knows of.
+func (p *IPManager) updateLedgerShard(name string, update func(ledger ipMap) error) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap := &corev1.ConfigMap{}
+		err := p.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: p.managerNamespace, Name: name}, configMap)
+		exist := err == nil
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "failed to read the allocation ledger")
+		}
+
+		ledger := ipMap{}
+		if exist {
+			ledger, err = decodeLedger(configMap)
+			if err != nil {
+				return err
+			}
+		} else {
+			configMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+				Namespace: p.managerNamespace,
+				Name:      name,
+				Labels:    map[string]string{ledgerLabel: "true"},
+			}}
+			known, err := p.ledgerShards(p.ipPoolMap)
+			if err != nil {
+				return err
+			}
+			for ip, entry := range known[name] {
+				ledger.createOrUpdateEntry(ip, entry)
+			}
+		}
+
+		recordedEntries := ipMap{}
+		for ip, entry := range ledger {
+			recordedEntries.createOrUpdateEntry(ip, entry)
+		}
+		err = update(ledger)
+		if err != nil {
+			// the replica learns about the allocations of the others even when its own can not be made
+			if exist {
+				p.mirrorLedgerShard(name, recordedEntries, recordedEntries)
+			}
+			return err
+		}
+
+		recorded := configMap.Data
+		err = encodeLedger(configMap, ledger)
+		if err != nil {
+			return err
+		}
+		switch {
+		case exist && reflect.DeepEqual(recorded, configMap.Data):
+			// nothing changed, e.g. the rebuilt allocations were all recorded already
+		case exist:
+			err = p.kubeClient.Update(context.TODO(), configMap)
+		default:
+			err = p.kubeClient.Create(context.TODO(), configMap)
+			if apierrors.IsAlreadyExists(err) {
+				// another replica created the shard first, apply the update to its one
+				err = apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, configMap.Name, err)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		p.mirrorLedgerShard(name, recordedEntries, ledger)
+		return nil
+	})
+}
+
+// updateLedger applies the update to the shards recording the addresses one after the other, the update is given
+// the addresses of the shard
+func (p *IPManager) updateLedger(addresses ipMap, update func(ledger, addresses ipMap) error) error {
+	shards, err := p.ledgerShards(addresses)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedShards(shards) {
+		shard := shards[name]
+		err = p.updateLedgerShard(name, func(ledger ipMap) error {
+			return update(ledger, shard)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedShards(shards map[string]ipMap) []string {
+	names := []string{}
+	for name := range shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mirrorLedgerShard replaces the allocations of the shard in the allocation state by the ones it records, the
+// addresses mirrored from it before or recorded by it before the update are dropped when the update removed them
+func (p *IPManager) mirrorLedgerShard(name string, before, ledger ipMap) {
+	for _, recorded := range []ipMap{p.ledger[name], before} {
+		for ip := range recorded {
+			if !ledger.isAllocated(ip) {
+				p.ipPoolMap.removeEntry(ip)
+			}
+		}
+	}
+	for ip, entry := range ledger {
+		p.ipPoolMap.createOrUpdateEntry(ip, entry)
+	}
+	p.ledger[name] = ledger
+}
+
+// claimInLedger commits the allocations to the ledger, it fails when another instance holds one of the addresses or
+// MACs there, or when the free address of an ip set taken by the allocation was handed to another pod of the set
+// meanwhile. The shards already claimed are given back when a later one or a MAC fails.
+func (p *IPManager) claimInLedger(allocations ipMap) error {
+	if len(allocations) == 0 {
+		return nil
+	}
+	known := ipMap{}
+	for ip := range allocations {
+		if entry, exist := p.ipPoolMap[ip]; exist {
+			known.createOrUpdateEntry(ip, entry)
+		}
+	}
+	shards, err := p.ledgerShards(allocations)
+	if err != nil {
+		return err
+	}
+
+	claimed := map[string]ipMap{}
+	for _, name := range sortedShards(shards) {
+		shard := shards[name]
+		previous := ipMap{}
+		err = p.updateLedgerShard(name, func(ledger ipMap) error {
+			for ip, entry := range shard {
+				err := ledger.checkClaim(ip, entry)
+				if heldErr, ok := err.(*addressHeldError); ok {
+					return &ledgerConflictError{heldErr}
+				}
+				if err != nil {
+					return err
+				}
+				held, exist := ledger[ip]
+				if entry.inUse && exist && held.inUse && held.instanceName == entry.instanceName && !known[ip].inUse {
+					return fmt.Errorf("ip %s of %s was handed to another pod meanwhile", ip, holderName(entry.instanceName))
+				}
+			}
+			previous = ipMap{}
+			for ip, entry := range shard {
+				if held, exist := ledger[ip]; exist {
+					previous.createOrUpdateEntry(ip, held)
+				}
+				ledger.createOrUpdateEntry(ip, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			p.unclaimInLedger(shards, claimed)
+			return err
+		}
+		claimed[name] = previous
+	}
+
+	// the addresses are recorded first, a replica finding the MAC claimed finds the address holding it as well
+	err = p.claimMACsInLedger(allocations, false)
+	if err != nil {
+		p.unclaimInLedger(shards, claimed)
+		return err
+	}
+	return nil
+}
+
+// unclaimInLedger restores the claimed shards to the entries they recorded before the claim
+func (p *IPManager) unclaimInLedger(shards map[string]ipMap, claimed map[string]ipMap) {
+	for name, previous := range claimed {
+		shard := shards[name]
+		err := p.updateLedgerShard(name, func(ledger ipMap) error {
+			for ip, entry := range shard {
+				held, exist := ledger[ip]
+				if !exist || !isSameAllocation(held, entry) {
+					continue
+				}
+				if before, recorded := previous[ip]; recorded {
+					ledger.createOrUpdateEntry(ip, before)
+				} else {
+					ledger.removeEntry(ip)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.Error(err, "failed to give back the addresses of a failed claim in the allocation ledger", "shard", name)
+		}
+	}
+}
+
+// commitInLedger records the committed allocations in the ledger, the pending allocations of the transaction are
+// handed over to the instance created with it
+func (p *IPManager) commitInLedger(committed ipMap, transactionTimestamp time.Time) error {
+	if len(committed) == 0 {
+		return nil
+	}
+	err := p.updateLedger(committed, func(ledger, committed ipMap) error {
+		for ip, entry := range committed {
+			if held, exist := ledger[ip]; exist && held.isPending() && held.transactionTimestamp.Equal(transactionTimestamp) {
+				ledger.createOrUpdateEntry(ip, entry)
+			}
+		}
+		for ip, entry := range committed {
+			err := ledger.checkClaim(ip, entry)
+			if err != nil {
+				return err
+			}
+			ledger.createOrUpdateEntry(ip, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// the addresses re-reserved for an instance created after its transaction expired claim their MAC again
+	return p.claimMACsInLedger(committed, false)
+}
+
+// releaseInLedger removes the allocations from the ledger, the addresses meanwhile held by another instance are kept,
+// so are the pending ones meanwhile committed or allocated again by another transaction
+func (p *IPManager) releaseInLedger(allocations ipMap) error {
+	if len(allocations) == 0 {
+		return nil
+	}
+	removed := ipMap{}
+	err := p.updateLedger(allocations, func(ledger, allocations ipMap) error {
+		for ip, entry := range allocations {
+			if held, exist := ledger[ip]; exist && isSameAllocation(held, entry) {
+				ledger.removeEntry(ip)
+				removed.createOrUpdateEntry(ip, held)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return p.releaseMACsInLedger(removed)
+}
+
+// macLedgerShards groups the allocations with a MAC by the MAC shard recording it
+func macLedgerShards(allocations ipMap) map[string]ipMap {
+	shards := map[string]ipMap{}
+	for ip, entry := range allocations {
+		if entry.mac == "" {
+			continue
+		}
+		name := macLedgerShardName(entry.mac)
+		if shards[name] == nil {
+			shards[name] = ipMap{}
+		}
+		shards[name].createOrUpdateEntry(ip, entry)
+	}
+	return shards
+}
+
+// updateMACLedgerShard applies the update to the addresses holding the MACs of a MAC shard, by ledger key of the MAC.
+// The update runs again on the latest shard when another replica wrote it in the meantime.
+func (p *IPManager) updateMACLedgerShard(name string, update func(holders map[string]string) error) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap := &corev1.ConfigMap{}
+		err := p.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: p.managerNamespace, Name: name}, configMap)
+		exist := err == nil
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "failed to read the allocation ledger")
+		}
+		if !exist {
+			configMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+				Namespace: p.managerNamespace,
+				Name:      name,
+				Labels:    map[string]string{ledgerLabel: macLedgerLabel},
+			}}
+		}
+
+		recorded := map[string]string{}
+		holders := map[string]string{}
+		for key, ip := range configMap.Data {
+			recorded[key] = ip
+			holders[key] = ip
+		}
+		err = update(holders)
+		if err != nil {
+			return err
+		}
+		if exist && reflect.DeepEqual(recorded, holders) {
+			return nil
+		}
+
+		configMap.Data = holders
+		if exist {
+			return p.kubeClient.Update(context.TODO(), configMap)
+		}
+		err = p.kubeClient.Create(context.TODO(), configMap)
+		if apierrors.IsAlreadyExists(err) {
+			err = apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, configMap.Name, err)
+		}
+		return err
+	})
+}
+
+// claimMACsInLedger records the addresses of the allocations as the holders of their MACs. A MAC recorded for another
+// address conflicts as long as that address holds it for an instance that may not claim it, the record is stale
+// otherwise, e.g. the address was released by a replica that stopped before giving the MAC back. When missingOnly is
+// set, the MACs recorded for another address are left as they are.
+func (p *IPManager) claimMACsInLedger(allocations ipMap, missingOnly bool) error {
+	shards := macLedgerShards(allocations)
+	for _, name := range sortedShards(shards) {
+		shard := shards[name]
+		err := p.updateMACLedgerShard(name, func(holders map[string]string) error {
+			for ip, entry := range shard {
+				key := ledgerKey(entry.mac)
+				if holder, exist := holders[key]; exist && holder != ip {
+					if missingOnly {
+						continue
+					}
+					held, recorded, err := p.ledgerEntry(holder)
+					if err != nil {
+						return err
+					}
+					if recorded && held.mac == entry.mac && !held.isClaimableBy(entry) {
+						return &ledgerConflictError{&addressHeldError{ip: entry.mac, holder: holderName(held.instanceName)}}
+					}
+				}
+				holders[key] = ip
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseMACsInLedger removes the records of the MACs held by the released addresses
+func (p *IPManager) releaseMACsInLedger(released ipMap) error {
+	shards := macLedgerShards(released)
+	for _, name := range sortedShards(shards) {
+		shard := shards[name]
+		err := p.updateMACLedgerShard(name, func(holders map[string]string) error {
+			for ip, entry := range shard {
+				if holders[ledgerKey(entry.mac)] == ip {
+					delete(holders, ledgerKey(entry.mac))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ledgerEntry reads the entry of the address from the shard recording it, the shard is mirrored on the way so that a
+// replica learns about the MACs held by the others
+func (p *IPManager) ledgerEntry(ip string) (ipEntry, bool, error) {
+	shards, err := p.ledgerShards(ipMap{ip: ipEntry{}})
+	if err != nil {
+		return ipEntry{}, false, err
+	}
+	for name := range shards {
+		configMap := &corev1.ConfigMap{}
+		err = p.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: p.managerNamespace, Name: name}, configMap)
+		if apierrors.IsNotFound(err) {
+			return ipEntry{}, false, nil
+		}
+		if err != nil {
+			return ipEntry{}, false, errors.Wrap(err, "failed to read the allocation ledger")
+		}
+		ledger, err := decodeLedger(configMap)
+		if err != nil {
+			return ipEntry{}, false, err
+		}
+		p.mirrorLedgerShard(name, nil, ledger)
+		entry, exist := ledger[ip]
+		return entry, exist, nil
+	}
+	return ipEntry{}, false, nil
+}
+
+func isSameAllocation(held, entry ipEntry) bool {
+	if held.instanceName != entry.instanceName {
+		return false
+	}
+	return !entry.isPending() || held.isPending() && held.transactionTimestamp.Equal(*entry.transactionTimestamp)
+}
+
+// readLedger returns the allocations recorded by each shard of the ledger
+func (p *IPManager) readLedger() (map[string]ipMap, error) {
+	configMaps := &corev1.ConfigMapList{}
+	err := p.kubeClient.List(context.TODO(), configMaps, client.InNamespace(p.managerNamespace), client.MatchingLabels{ledgerLabel: "true"})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the allocation ledger")
+	}
+
+	shards := map[string]ipMap{}
+	for i := range configMaps.Items {
+		ledger, err := decodeLedger(&configMaps.Items[i])
+		if err != nil {
+			return nil, err
+		}
+		shards[configMaps.Items[i].Name] = ledger
+	}
+	return shards, nil
+}
+
+// mirrorLedger replaces the allocation state by the allocations recorded in the shards, the allocations this replica
+// knows of are kept as long as the shard recording them does not exist
+func (p *IPManager) mirrorLedger(shards map[string]ipMap) error {
+	mirrored := ipMap{}
+	for name, ledger := range shards {
+		for ip, entry := range ledger {
+			if mirrored.isAllocated(ip) {
+				log.Info("address recorded by several shards of the allocation ledger", "address", ip, "shard", name)
+			}
+			mirrored.createOrUpdateEntry(ip, entry)
+		}
+	}
+
+	unrecorded := ipMap{}
+	for ip, entry := range p.ipPoolMap {
+		if !mirrored.isAllocated(ip) {
+			unrecorded.createOrUpdateEntry(ip, entry)
+		}
+	}
+	p.ledger = shards
+	known, err := p.ledgerShards(unrecorded)
+	if err != nil {
+		return err
+	}
+	for name, allocations := range known {
+		if _, exist := shards[name]; exist {
+			continue
+		}
+		for ip, entry := range allocations {
+			mirrored.createOrUpdateEntry(ip, entry)
+		}
+	}
+
+	p.ipPoolMap = mirrored
+	return nil
+}
+
+// syncLedger mirrors the ledger written by all the replicas, the allocations this replica rebuilt are kept as long as
+// there is no ledger. When merge is set, the rebuilt allocations missing from the ledger are added to it.
+func (p *IPManager) syncLedger(merge bool) error {
+	shards, err := p.readLedger()
+	if err != nil {
+		return err
+	}
+	if len(shards) == 0 {
+		return nil
+	}
+
+	if merge {
+		p.ledger = shards
+		err = p.updateLedger(p.ipPoolMap, func(ledger, rebuilt ipMap) error {
+			for ip, entry := range rebuilt {
+				if !ledger.isAllocated(ip) {
+					ledger.createOrUpdateEntry(ip, entry)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = p.claimMACsInLedger(p.ipPoolMap, true)
+		if err != nil {
+			return err
+		}
+		shards, err = p.readLedger()
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.mirrorLedger(shards)
+}
+
+// peekLedger mirrors the ledger with the rebuilt allocations missing from it added, the allocation state is the one
+// syncLedger(true) gives but nothing is written
+func (p *IPManager) peekLedger() error {
+	shards, err := p.readLedger()
+	if err != nil {
+		return err
+	}
+
+	rebuilt := p.ipPoolMap
+	err = p.mirrorLedger(shards)
+	if err != nil {
+		return err
+	}
+	for ip, entry := range rebuilt {
+		if !p.ipPoolMap.isAllocated(ip) {
+			p.ipPoolMap.createOrUpdateEntry(ip, entry)
+		}
+	}
+	return nil
+}
+
+// WatchLedger keeps the allocation state in line with the allocations and releases of the other replicas, the address
+// shards of the ledger are watched on every replica and mirrored as they change
+func (p *IPManager) WatchLedger(mgr manager.Manager) error {
+	informer, err := p.watchManagerConfigMaps(mgr, cache.ObjectSelector{Label: labels.SelectorFromSet(labels.Set{ledgerLabel: "true"})})
+	if err != nil {
+		return errors.Wrap(err, "failed to watch the allocation ledger")
+	}
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    p.mirrorLedgerConfigMap,
+		UpdateFunc: func(_, obj interface{}) { p.mirrorLedgerConfigMap(obj) },
+		DeleteFunc: p.forgetLedgerConfigMap,
+	})
+	return nil
+}
+
+// mirrorLedgerConfigMap mirrors a shard of the ledger written by any of the replicas
+func (p *IPManager) mirrorLedgerConfigMap(obj interface{}) {
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+	ledger, err := decodeLedger(configMap)
+	if err != nil {
+		log.Error(err, "failed to mirror a shard of the allocation ledger", "shard", configMap.Name)
+		return
+	}
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+	p.mirrorLedgerShard(configMap.Name, nil, ledger)
+}
+
+// forgetLedgerConfigMap stops mirroring a deleted shard, the allocations it recorded are kept as the ones this replica
+// knows of until the shard is written again
+func (p *IPManager) forgetLedgerConfigMap(obj interface{}) {
+	if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	configMap, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+	delete(p.ledger, configMap.Name)
+}
+
+// mirrorLedgerShards reads the shards recording the addresses and mirrors them, the watch of the ledger may not have
+// delivered the latest allocations of the other replicas yet
+func (p *IPManager) mirrorLedgerShards(addresses ipMap) error {
+	shards, err := p.ledgerShards(addresses)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedShards(shards) {
+		configMap := &corev1.ConfigMap{}
+		err = p.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: p.managerNamespace, Name: name}, configMap)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read the allocation ledger")
+		}
+		ledger, err := decodeLedger(configMap)
+		if err != nil {
+			return err
+		}
+		p.mirrorLedgerShard(name, nil, ledger)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package ip_manager
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+var _ = Describe("Allocation ledger", func() {
+	const sriovNetworks = `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`
+	var leader, follower *IPManager
+
+	// newReplica returns another manager replica working on the same cluster
+	newReplica := func(ipManager *IPManager) *IPManager {
+		replica, err := NewIPManager(ipManager.kubeClient, ipManager.cachedKubeClient, "kubeipfixed-system", false, 600, ipManager.Scheme, &record.FakeRecorder{})
+		Expect(err).ToNot(HaveOccurred())
+		return replica
+	}
+
+	BeforeEach(func() {
+		leader = createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}))
+		follower = newReplica(leader)
+	})
+
+	AfterEach(func() {
+		now = time.Now
+	})
+
+	It("should not hand the same free address out on two replicas", func() {
+		Expect(leader.AllocatePodIP(newTestPod("pod-1", sriovNetworks), &testTransactionTimestamp, true)).To(Succeed())
+
+		pod := newTestPod("pod-2", sriovNetworks)
+		Expect(follower.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(pod.Annotations[sriovNetworksAnnotation]).To(ContainSubstring("100.100.100.101/24"))
+		Expect(follower.ipPoolMap["100.100.100.100"].instanceName).To(Equal("pod/default/pod-1"))
+	})
+
+	It("should refuse an address requested on another replica", func() {
+		Expect(leader.AllocatePodIP(newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "ippool": [{"name": "n1", "address": "100.100.100.150"}]}`), &testTransactionTimestamp, true)).To(Succeed())
+
+		pod := newTestPod("pod-2", `{"subnet": "100.100.100.0/24", "ippool": [{"name": "n2", "address": "100.100.100.150"}]}`)
+		Expect(follower.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(MatchError("address 100.100.100.150 is already held by pod/default/pod-1"))
+		err := follower.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "n2"}, &netattdefv1.NetworkAttachmentDefinition{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should commit and roll back the allocations of the other replicas on the leader", func() {
+		created := newTestPod("pod-1", sriovNetworks)
+		Expect(follower.AllocatePodIP(created, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(follower.AllocatePodIP(newTestPod("pod-2", sriovNetworks), &testTransactionTimestamp, true)).To(Succeed())
+
+		Expect(leader.MarkPodAsReady(created)).To(Succeed())
+		Expect(leader.ipPoolMap["100.100.100.100"].isPending()).To(BeFalse())
+
+		now = func() time.Time {
+			return testTransactionTimestamp.Add(time.Duration(leader.waitTime+1) * time.Second)
+		}
+		leader.rollbackExpiredTransactions()
+		Expect(leader.ipPoolMap).To(HaveLen(1))
+		err := leader.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-101"}, &netattdefv1.NetworkAttachmentDefinition{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+
+		Expect(follower.syncLedger(false)).To(Succeed())
+		Expect(follower.ipPoolMap).To(HaveLen(1))
+		Expect(follower.ipPoolMap["100.100.100.100"].isPending()).To(BeFalse())
+	})
+
+	It("should free the addresses released on another replica", func() {
+		pod := newTestPod("pod-1", sriovNetworks)
+		Expect(leader.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(leader.MarkPodAsReady(pod)).To(Succeed())
+		Expect(follower.syncLedger(false)).To(Succeed())
+		Expect(follower.ipPoolMap).To(HaveKey("100.100.100.100"))
+
+		Expect(leader.ReleasePodIPs(pod)).To(Succeed())
+		Expect(follower.syncLedger(false)).To(Succeed())
+		Expect(follower.ipPoolMap).To(BeEmpty())
+
+		explicit := newTestPod("pod-2", `{"subnet": "100.100.100.0/24", "ippool": [{"name": "n2", "address": "100.100.100.100"}]}`)
+		Expect(follower.AllocatePodIP(explicit, &testTransactionTimestamp, true)).To(Succeed())
+	})
+
+	It("should not hand the free address of a deployment ip set to two pods", func() {
+		deployment := newTestDeployment("web", "uid-1", 1)
+		replicaSet := newTestReplicaSet(deployment, "web-new")
+		Expect(leader.kubeClient.Create(context.TODO(), deployment)).To(Succeed())
+		Expect(leader.kubeClient.Create(context.TODO(), replicaSet)).To(Succeed())
+
+		terminating := newTestReplicaSetPod(replicaSet)
+		Expect(leader.AllocatePodIP(terminating, &testTransactionTimestamp, true)).To(Succeed())
+		terminating.Name = "web-new-1"
+		Expect(leader.MarkPodAsReady(terminating)).To(Succeed())
+		Expect(leader.ReleasePodIPs(terminating)).To(Succeed())
+		Expect(follower.syncLedger(false)).To(Succeed())
+
+		Expect(leader.AllocatePodIP(newTestReplicaSetPod(replicaSet), &testTransactionTimestamp, true)).To(Succeed())
+		Expect(follower.AllocatePodIP(newTestReplicaSetPod(replicaSet), &testTransactionTimestamp, true)).To(
+			MatchError("ip 100.100.100.100 of deployment/default/web was handed to another pod meanwhile"))
+	})
+
+	It("should keep the colons of IPv6 addresses out of the keys", func() {
+		leader = createTestIPManager(newTestDualStackIPPool("sriov-n3"))
+		Expect(leader.AllocatePodIP(newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "subnet6": "fd00:100::/64", "resourcename": "mecdev.com/intel2v2nics"}`), &testTransactionTimestamp, true)).To(Succeed())
+
+		configMap := &corev1.ConfigMap{}
+		shard := types.NamespacedName{Namespace: "kubeipfixed-system", Name: "kubeipfixed-ledger-sriov-n3-fd000100000000000000000000000000"}
+		Expect(leader.kubeClient.Get(context.TODO(), shard, configMap)).To(Succeed())
+		Expect(configMap.Data).To(HaveKey("fd00_100__100"))
+
+		ledger, err := decodeLedger(configMap)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ledger).To(HaveLen(1))
+		Expect(ledger["fd00:100::100"].instanceName).To(Equal("pod/default/pod-1"))
+	})
+
+	It("should record the allocations of each pool and block of addresses in its own shard", func() {
+		Expect(leader.kubeClient.Create(context.TODO(), newTestIPPool("sriov-n4", "100.100.200.0/24"))).To(Succeed())
+		Expect(leader.AllocatePodIP(newTestPod("pod-1", sriovNetworks), &testTransactionTimestamp, true)).To(Succeed())
+		Expect(leader.AllocatePodIP(newTestPod("pod-2", `{"subnet": "100.100.200.0/24", "ippool": [{"name": "n4", "address": "100.100.200.10/24"}]}`), &testTransactionTimestamp, true)).To(Succeed())
+		Expect(leader.AllocatePodIP(newTestPod("pod-3", `{"subnet": "10.0.8.0/24", "ippool": [{"name": "n5", "address": "10.0.8.10/24"}]}`), &testTransactionTimestamp, true)).To(Succeed())
+
+		shards, err := leader.readLedger()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(shards).To(HaveLen(3))
+		Expect(shards["kubeipfixed-ledger-sriov-n3-100-100-96-0"]).To(HaveKey("100.100.100.100"))
+		Expect(shards["kubeipfixed-ledger-sriov-n4-100-100-200-0"]).To(HaveKey("100.100.200.10"))
+		Expect(shards["kubeipfixed-ledger-10-0-8-0"]).To(HaveKey("10.0.8.10"))
+
+		Expect(follower.syncLedger(false)).To(Succeed())
+		Expect(follower.ipPoolMap).To(HaveLen(3))
+	})
+
+	It("should not give one MAC to addresses of different shards on two replicas", func() {
+		pool := &ippoolv1alpha1.IPPool{}
+		Expect(leader.kubeClient.Get(context.TODO(), types.NamespacedName{Name: "sriov-n3"}, pool)).To(Succeed())
+		pool.Spec.MACRange = &ippoolv1alpha1.MACRange{Start: "02:00:00:00:00:01", End: "02:00:00:00:00:02"}
+		Expect(leader.kubeClient.Update(context.TODO(), pool)).To(Succeed())
+		other := newTestIPPool("sriov-n4", "100.100.200.0/24", ippoolv1alpha1.IPRange{Start: "100.100.200.100", End: "100.100.200.200"})
+		other.Spec.MACRange = pool.Spec.MACRange
+		Expect(leader.kubeClient.Create(context.TODO(), other)).To(Succeed())
+
+		Expect(leader.AllocatePodIP(newTestPod("pod-1", sriovNetworks), &testTransactionTimestamp, true)).To(Succeed())
+		Expect(leader.ipPoolMap["100.100.100.100"].mac).To(Equal("02:00:00:00:00:01"))
+
+		// the follower did not sync the ledger yet, the MAC is claimed by the address of the other pool
+		pod := newTestPod("pod-2", `{"subnet": "100.100.200.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+		Expect(follower.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(follower.ipPoolMap["100.100.200.100"].mac).To(Equal("02:00:00:00:00:02"))
+		Expect(follower.ipPoolMap["100.100.100.100"].instanceName).To(Equal("pod/default/pod-1"))
+
+		configMap := &corev1.ConfigMap{}
+		Expect(leader.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "kubeipfixed-system", Name: "kubeipfixed-ledger-mac-01"}, configMap)).To(Succeed())
+		Expect(configMap.Data).To(Equal(map[string]string{"02_00_00_00_00_01": "100.100.100.100"}))
+
+		// the MAC of a released address is claimed again
+		Expect(leader.ReleasePodIPs(newTestPod("pod-1", sriovNetworks))).To(Succeed())
+		Expect(leader.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "kubeipfixed-system", Name: "kubeipfixed-ledger-mac-01"}, configMap)).To(Succeed())
+		Expect(configMap.Data).To(BeEmpty())
+	})
+
+	It("should mirror the shards delivered by the watch of the ledger", func() {
+		Expect(leader.AllocatePodIP(newTestPod("pod-1", sriovNetworks), &testTransactionTimestamp, true)).To(Succeed())
+		shard := &corev1.ConfigMap{}
+		Expect(leader.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "kubeipfixed-system", Name: "kubeipfixed-ledger-sriov-n3-100-100-96-0"}, shard)).To(Succeed())
+
+		follower.mirrorLedgerConfigMap(shard)
+		Expect(follower.ipPoolMap["100.100.100.100"].instanceName).To(Equal("pod/default/pod-1"))
+
+		released := shard.DeepCopy()
+		released.Data = map[string]string{}
+		follower.mirrorLedgerConfigMap(released)
+		Expect(follower.ipPoolMap).To(BeEmpty())
+
+		// a deleted shard is written again from the allocations the replicas know of
+		follower.mirrorLedgerConfigMap(shard)
+		follower.forgetLedgerConfigMap(toolscache.DeletedFinalStateUnknown{Key: "kubeipfixed-system/" + shard.Name, Obj: shard})
+		Expect(follower.ledger).To(BeEmpty())
+		Expect(follower.ipPoolMap).To(HaveKey("100.100.100.100"))
+	})
+
+	It("should only read the ledger on start and record the rebuilt allocations on the leader", func() {
+		Expect(leader.AllocatePodIP(newTestPod("pod-1", sriovNetworks), &testTransactionTimestamp, true)).To(Succeed())
+		Expect(leader.kubeClient.Create(context.TODO(), newTestPod("pod-2", `{"subnet": "100.100.100.0/24", "ippool": [{"name": "n2", "address": "100.100.100.150/24"}]}`))).To(Succeed())
+
+		Expect(follower.Start()).To(Succeed())
+		Expect(follower.ipPoolMap).To(HaveKey("100.100.100.100"))
+		Expect(follower.ipPoolMap).To(HaveKey("100.100.100.150"))
+		shards, err := leader.readLedger()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(shards["kubeipfixed-ledger-sriov-n3-100-100-96-0"]).To(HaveLen(1))
+
+		Expect(follower.InitLeader(context.TODO())).To(Succeed())
+		shards, err = leader.readLedger()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(shards["kubeipfixed-ledger-sriov-n3-100-100-96-0"]).To(HaveKey("100.100.100.150"))
+	})
+
+	It("should add the allocations rebuilt on start to the ledger", func() {
+		Expect(leader.AllocatePodIP(newTestPod("pod-1", sriovNetworks), &testTransactionTimestamp, true)).To(Succeed())
+
+		orphan := &netattdefv1.NetworkAttachmentDefinition{ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "leftover",
+			Labels:      map[string]string{managedNetAttDefLabel: "true"},
+			Annotations: map[string]string{netAttDefAddressAnnotation: "100.100.100.150/24", netAttDefResourceNameAnnotation: "mecdev.com/intel2v2nics"},
+		}}
+		Expect(leader.kubeClient.Create(context.TODO(), orphan)).To(Succeed())
+
+		Expect(follower.InitMaps()).To(Succeed())
+		Expect(follower.ipPoolMap["100.100.100.100"].instanceName).To(Equal("pod/default/pod-1"))
+		Expect(follower.ipPoolMap["100.100.100.150"].instanceName).To(Equal("netattdef/default/leftover"))
+
+		Expect(leader.syncLedger(false)).To(Succeed())
+		Expect(leader.ipPoolMap).To(HaveLen(2))
+		Expect(leader.ipPoolMap["100.100.100.150"].instanceName).To(Equal("netattdef/default/leftover"))
+	})
+})
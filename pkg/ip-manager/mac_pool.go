@@ -0,0 +1,131 @@
+package ip_manager
+
+import (
+	"fmt"
+	"net"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+	"github.com/wenwenxiong/kubeipfixed/pkg/utils"
+)
+
+// supportsMAC returns true for the cni types whose interface can be given a MAC address at runtime
+func supportsMAC(cniType ippoolv1alpha1.CNIType) bool {
+	switch cniType {
+	case ippoolv1alpha1.CNITypeSriov, ippoolv1alpha1.CNITypeMacvlan, ippoolv1alpha1.CNITypeOvs:
+		return true
+	}
+	return false
+}
+
+// assignMACs puts the requested MACs in their canonical form and gives the entries of a pool with a MAC range a MAC
+// address. An entry whose address already has a MAC, e.g. the address of a StatefulSet identity or of a Deployment
+// ip set, keeps it, the other entries get the first free MAC of the range. It returns true when an entry was completed.
+func (p *IPManager) assignMACs(networks *sriovNetwork, pool *ippoolv1alpha1.IPPool, instanceName string) (bool, error) {
+	changed := false
+	reserved := map[string]bool{}
+	for i := range networks.IPPool {
+		network := &networks.IPPool[i]
+		if mac, err := net.ParseMAC(network.MAC); err == nil {
+			changed = changed || network.MAC != mac.String()
+			network.MAC = mac.String()
+			reserved[network.MAC] = true
+		}
+	}
+	if pool == nil || pool.Spec.MACRange == nil {
+		return changed, nil
+	}
+
+	for i := range networks.IPPool {
+		network := &networks.IPPool[i]
+		if network.MAC != "" || !supportsMAC(network.cniType()) {
+			continue
+		}
+
+		if mac := p.heldMAC(network, instanceName); mac != "" {
+			network.MAC = mac
+			changed = true
+			continue
+		}
+
+		mac, err := p.nextFreeMAC(pool, reserved)
+		if err != nil {
+			return false, err
+		}
+		network.MAC = mac
+		reserved[mac] = true
+		changed = true
+	}
+	return changed, nil
+}
+
+// heldMAC returns the MAC reserved with the address of the entry when the instance may claim the address
+func (p *IPManager) heldMAC(network *sriovIpAddress, instanceName string) string {
+	ip, err := addressKey(network.Address)
+	if err != nil {
+		return ""
+	}
+	entry, exist := p.ipPoolMap[ip]
+	if !exist || entry.mac == "" {
+		return ""
+	}
+	if p.ipPoolMap.checkClaim(ip, ipEntry{instanceName: instanceName, netAttDef: network.netAttDefKey()}) != nil {
+		return ""
+	}
+	return entry.mac
+}
+
+// nextFreeMAC walks the MAC range of the pool and returns the first MAC neither allocated nor reserved
+func (p *IPManager) nextFreeMAC(pool *ippoolv1alpha1.IPPool, reserved map[string]bool) (string, error) {
+	start, end, err := macRangeBounds(pool)
+	if err != nil {
+		return "", err
+	}
+
+	allocated := p.ipPoolMap.allocatedMACs()
+	for value := start; value <= end; value++ {
+		mac := utils.ConvertInt64ToHwAddr(value).String()
+		if !allocated[mac] && !reserved[mac] {
+			return mac, nil
+		}
+	}
+
+	return "", &poolExhaustedError{poolName: pool.Name, mac: true}
+}
+
+// macRangeBounds returns the first and last MAC of the pool range as integers
+func macRangeBounds(pool *ippoolv1alpha1.IPPool) (int64, int64, error) {
+	bounds := []int64{}
+	for _, bound := range []string{pool.Spec.MACRange.Start, pool.Spec.MACRange.End} {
+		mac, err := net.ParseMAC(bound)
+		if err != nil || len(mac) != 6 {
+			return 0, 0, fmt.Errorf("ip pool %s has an invalid mac range %s-%s", pool.Name, pool.Spec.MACRange.Start, pool.Spec.MACRange.End)
+		}
+		value, err := utils.ConvertHwAddrToInt64(mac)
+		if err != nil {
+			return 0, 0, err
+		}
+		bounds = append(bounds, value)
+	}
+	if bounds[0] > bounds[1] {
+		return 0, 0, fmt.Errorf("ip pool %s has an invalid mac range %s-%s", pool.Name, pool.Spec.MACRange.Start, pool.Spec.MACRange.End)
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// validateMAC checks the MAC requested for an entry can be set on its interface
+func validateMAC(network *sriovIpAddress) error {
+	if network.MAC == "" {
+		return nil
+	}
+	mac, err := net.ParseMAC(network.MAC)
+	if err != nil || len(mac) != 6 {
+		return fmt.Errorf("mac %q of address %s is not a valid mac address", network.MAC, network.Address)
+	}
+	if mac[0]&1 == 1 {
+		return fmt.Errorf("mac %s of address %s is a multicast address", network.MAC, network.Address)
+	}
+	if !supportsMAC(network.cniType()) {
+		return fmt.Errorf("the %s interface of address %s can not be given a mac", network.cniType(), network.Address)
+	}
+	return nil
+}
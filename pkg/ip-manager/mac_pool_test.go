@@ -0,0 +1,137 @@
+package ip_manager
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kubevirt "kubevirt.io/api/core/v1"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+var _ = Describe("MAC Pool", func() {
+	const subnetRequest = `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`
+	var ipManager *IPManager
+	var pool *ippoolv1alpha1.IPPool
+
+	BeforeEach(func() {
+		pool = newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"})
+		pool.Spec.MACRange = &ippoolv1alpha1.MACRange{Start: "02:00:00:00:00:01", End: "02:00:00:00:00:02"}
+		ipManager = createTestIPManager(pool)
+	})
+
+	allocate := func(pod *corev1.Pod) sriovIpAddress {
+		ExpectWithOffset(1, ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		ExpectWithOffset(1, ipManager.MarkPodAsReady(pod)).To(Succeed())
+		networks, err := parsePodNetworkAnnotation(pod.Annotations[sriovNetworksAnnotation], pod.Namespace)
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		return networks.IPPool[0]
+	}
+
+	It("should allocate a MAC from the range of the pool together with the ip", func() {
+		pod := newTestPod("pod-1", subnetRequest)
+		address := allocate(pod)
+		Expect(address.MAC).To(Equal("02:00:00:00:00:01"))
+		Expect(ipManager.ipPoolMap["100.100.100.100"].mac).To(Equal("02:00:00:00:00:01"))
+		Expect(pod.Annotations[NetworksAnnotation]).To(MatchJSON(`[{"name": "sriov-n3-static-100-100-100-100", "namespace": "default",` +
+			` "mac": "02:00:00:00:00:01", "interface": "net1"}]`))
+
+		netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+		Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-100"}, netAttDef)).To(Succeed())
+		Expect(netAttDef.Annotations).To(HaveKeyWithValue(netAttDefMACAnnotation, "02:00:00:00:00:01"))
+		Expect(netAttDef.Spec.Config).To(ContainSubstring(`"capabilities": { "mac": true }`))
+
+		Expect(allocate(newTestPod("pod-2", subnetRequest)).MAC).To(Equal("02:00:00:00:00:02"))
+	})
+
+	It("should pass the MAC at runtime to the NetworkAttachmentDefinition shared by the pool", func() {
+		pool.Spec.NetAttDefMode = ippoolv1alpha1.NetAttDefModeShared
+		Expect(ipManager.kubeClient.Update(context.TODO(), pool)).To(Succeed())
+
+		pod := newTestPod("pod-1", subnetRequest)
+		allocate(pod)
+		Expect(pod.Annotations[NetworksAnnotation]).To(MatchJSON(`[{"name": "sriov-n3-shared", "namespace": "default",` +
+			` "ips": ["100.100.100.100/24"], "mac": "02:00:00:00:00:01", "interface": "net1"}]`))
+
+		netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+		Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "sriov-n3-shared"}, netAttDef)).To(Succeed())
+		Expect(netAttDef.Annotations).ToNot(HaveKey(netAttDefMACAnnotation))
+		Expect(netAttDef.Spec.Config).To(ContainSubstring(`"capabilities": { "ips": true, "mac": true }`))
+	})
+
+	It("should keep the requested MAC and skip it in the range", func() {
+		pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [`+
+			`{"name": "n3", "address": "100.100.100.150/24", "mac": "02:00:00:00:00:01"}]}`)
+		Expect(allocate(pod).MAC).To(Equal("02:00:00:00:00:01"))
+		Expect(allocate(newTestPod("pod-2", subnetRequest)).MAC).To(Equal("02:00:00:00:00:02"))
+	})
+
+	It("should refuse a MAC held by another workload", func() {
+		allocate(newTestPod("pod-1", subnetRequest))
+
+		pod := newTestPod("pod-2", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [`+
+			`{"name": "n3", "address": "100.100.100.150/24", "mac": "02:00:00:00:00:01"}]}`)
+		Expect(ipManager.ValidatePodNetworks(pod)).To(MatchError("address 02:00:00:00:00:01 is already held by pod/default/pod-1"))
+	})
+
+	It("should reject a MAC requested in the networks annotation other than the allocated one", func() {
+		pod := newTestPod("pod-1", subnetRequest)
+		pod.Annotations[NetworksAnnotation] = `[{"name": "sriov-n3-static-100-100-100-100", "mac": "02:00:00:00:00:09"}]`
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(ipManager.ValidatePodNetworks(pod)).To(MatchError("mac 02:00:00:00:00:09 requested for network" +
+			" default/sriov-n3-static-100-100-100-100 conflicts with the mac 02:00:00:00:00:01 allocated to address 100.100.100.100/24"))
+
+		pod = newTestPod("pod-2", subnetRequest)
+		pod.Annotations[NetworksAnnotation] = `[{"name": "sriov-n3-static-100-100-100-101", "mac": "02:00:00:00:00:02"}]`
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(ipManager.ValidatePodNetworks(pod)).To(Succeed())
+	})
+
+	It("should fail when the MAC range is exhausted and free the MAC with the ip", func() {
+		first := newTestPod("pod-1", subnetRequest)
+		allocate(first)
+		allocate(newTestPod("pod-2", subnetRequest))
+
+		err := ipManager.AllocatePodIP(newTestPod("pod-3", subnetRequest), &testTransactionTimestamp, true)
+		Expect(err).To(MatchError("mac range of ip pool sriov-n3 is exhausted"))
+		Expect(ipManager.ipPoolMap).To(HaveLen(2))
+
+		Expect(ipManager.ReleasePodIPs(first)).To(Succeed())
+		Expect(allocate(newTestPod("pod-3", subnetRequest)).MAC).To(Equal("02:00:00:00:00:01"))
+	})
+
+	It("should give a rescheduled StatefulSet pod the MAC of its predecessor", func() {
+		statefulSet := newTestStatefulSet("web", "uid-1", 2)
+		address := allocate(newTestStatefulSetPod(statefulSet, "web-1"))
+		Expect(ipManager.ReleasePodIPs(newTestStatefulSetPod(statefulSet, "web-1"))).To(Succeed())
+
+		Expect(allocate(newTestPod("other", subnetRequest)).MAC).To(Equal("02:00:00:00:00:02"))
+		rescheduled := allocate(newTestStatefulSetPod(statefulSet, "web-1"))
+		Expect(rescheduled.Address).To(Equal(address.Address))
+		Expect(rescheduled.MAC).To(Equal(address.MAC))
+	})
+
+	It("should set the MAC on the interface of the virtual machine", func() {
+		vm := newTestVirtualMachine("vm-1", subnetRequest)
+		patches, err := ipManager.AllocateVirtualMachineIP(vm, &testTransactionTimestamp, true)
+		Expect(err).ToNot(HaveOccurred())
+
+		interfaces := patches[2].Value.([]kubevirt.Interface)
+		Expect(interfaces[1].MacAddress).To(Equal("02:00:00:00:00:01"))
+		annotations := patches[0].Value.(map[string]string)
+		Expect(annotations[StatusAnnotation]).To(ContainSubstring(`"mac":"02:00:00:00:00:01"`))
+	})
+
+	It("should not give a MAC to the interfaces that can not take one", func() {
+		pool.Spec.CNIType = ippoolv1alpha1.CNITypeIPVlan
+		pool.Spec.Master = "eth1"
+		Expect(ipManager.kubeClient.Update(context.TODO(), pool)).To(Succeed())
+
+		Expect(allocate(newTestPod("pod-1", subnetRequest)).MAC).To(BeEmpty())
+	})
+})
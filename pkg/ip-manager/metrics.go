@@ -0,0 +1,198 @@
+package ip_manager
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+	"github.com/wenwenxiong/kubeipfixed/pkg/metrics"
+)
+
+// reasons of the allocations, where the addresses come from on success and why the allocation failed otherwise
+const (
+	allocationReasonPool      = "pool"
+	allocationReasonReused    = "reused"
+	allocationReasonRequested = "requested"
+	allocationReasonExhausted = "exhausted"
+	allocationReasonNoPool    = "no_pool"
+	allocationReasonConflict  = "conflict"
+	allocationReasonInvalid   = "invalid"
+	allocationReasonError     = "error"
+	releaseReasonExpired      = "expired"
+)
+
+func recordAllocationSuccess(isNotDryRun bool, reason string) {
+	if isNotDryRun {
+		metrics.Allocations.WithLabelValues(metrics.ResultSuccess, reason).Inc()
+	}
+}
+
+// recordAllocationFailure counts a failed allocation by the kind of its error, defaultReason for the other errors
+func recordAllocationFailure(isNotDryRun bool, err error, defaultReason string) {
+	if !isNotDryRun {
+		return
+	}
+
+	reason := defaultReason
+	var exhausted *poolExhaustedError
+	var noPool *noIPPoolError
+	var held *addressHeldError
+	switch {
+	case errors.As(err, &exhausted):
+		reason = allocationReasonExhausted
+	case errors.As(err, &noPool):
+		reason = allocationReasonNoPool
+	case errors.As(err, &held):
+		reason = allocationReasonConflict
+	}
+	metrics.Allocations.WithLabelValues(metrics.ResultFailure, reason).Inc()
+}
+
+// releaseReason returns the kind of workload that held the address, e.g. pod or statefulset
+func releaseReason(instanceName string) string {
+	kind, _, _ := strings.Cut(holderName(instanceName), "/")
+	return kind
+}
+
+var (
+	poolAddressesDesc = prometheus.NewDesc("kubeipfixed_pool_addresses",
+		"Number of allocatable addresses of the pool ranges by pool, family and state (total, allocated, free)",
+		[]string{"pool", "family", "state"}, nil)
+	pendingTransactionsDesc = prometheus.NewDesc("kubeipfixed_pending_transactions",
+		"Number of admissions whose workload was not created yet, i.e. the distinct transactions of the pending addresses", nil, nil)
+)
+
+// ipPoolCollector computes the pool utilization on scrape from the allocation state of the running IPManager
+type ipPoolCollector struct {
+	lock      sync.Mutex
+	ipManager *IPManager
+}
+
+var poolCollector = &ipPoolCollector{}
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(poolCollector)
+}
+
+func (c *ipPoolCollector) setIPManager(ipManager *IPManager) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ipManager = ipManager
+}
+
+func (c *ipPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolAddressesDesc
+	ch <- pendingTransactionsDesc
+}
+
+func (c *ipPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	ipManager := c.ipManager
+	c.lock.Unlock()
+	if ipManager == nil {
+		return
+	}
+
+	poolList := &ippoolv1alpha1.IPPoolList{}
+	err := ipManager.cachedKubeClient.List(context.TODO(), poolList)
+	if err != nil {
+		log.Error(err, "failed to list ip pools for the metrics")
+		return
+	}
+
+	ipManager.poolMutex.Lock()
+	defer ipManager.poolMutex.Unlock()
+
+	// an admission allocating several addresses is a single transaction
+	pending := map[int64]struct{}{}
+	for _, entry := range ipManager.ipPoolMap {
+		if entry.isPending() {
+			pending[entry.transactionTimestamp.UnixNano()] = struct{}{}
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(pendingTransactionsDesc, prometheus.GaugeValue, float64(len(pending)))
+
+	for i := range poolList.Items {
+		pool := &poolList.Items[i]
+		c.collectSubnet(ch, ipManager.ipPoolMap, pool.Name, pool.Spec.Subnet, pool.Spec.Ranges, pool.Spec.Gateway)
+		if pool.Spec.Subnet6 != "" {
+			c.collectSubnet(ch, ipManager.ipPoolMap, pool.Name, pool.Spec.Subnet6, pool.Spec.Ranges6, pool.Spec.Gateway6)
+		}
+	}
+}
+
+// collectSubnet reports the addresses of the ranges of a pool subnet, see subnetUsage
+func (c *ipPoolCollector) collectSubnet(ch chan<- prometheus.Metric, allocated ipMap, poolName, cidr string, poolRanges []ippoolv1alpha1.IPRange, gatewayAddress string) {
+	family, total, used, err := subnetUsage(allocated, poolName, cidr, poolRanges, gatewayAddress)
+	if err != nil {
+		return
+	}
+
+	totalValue, _ := new(big.Float).SetInt(total).Float64()
+	free := totalValue - float64(used)
+	if free < 0 {
+		free = 0
+	}
+	ch <- prometheus.MustNewConstMetric(poolAddressesDesc, prometheus.GaugeValue, totalValue, poolName, family, "total")
+	ch <- prometheus.MustNewConstMetric(poolAddressesDesc, prometheus.GaugeValue, float64(used), poolName, family, "allocated")
+	ch <- prometheus.MustNewConstMetric(poolAddressesDesc, prometheus.GaugeValue, free, poolName, family, "free")
+}
+
+// subnetUsage counts the allocatable addresses of the ranges of a pool subnet and the allocated ones, the pool gateway
+// is not allocatable. The explicitly requested addresses outside of the ranges and the ones allocated from another
+// pool do not count.
+func subnetUsage(allocated ipMap, poolName, cidr string, poolRanges []ippoolv1alpha1.IPRange, gatewayAddress string) (string, *big.Int, int, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	family := "ipv4"
+	if subnet.IP.To4() == nil {
+		family = "ipv6"
+	}
+	ranges, err := subnetRanges(poolName, poolRanges, subnet)
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	gateway := normalizeIP(net.ParseIP(poolGateway(cidr, gatewayAddress)))
+	total := big.NewInt(0)
+	for _, r := range ranges {
+		size := big.NewInt(0).Sub(big.NewInt(0).SetBytes(r.end), big.NewInt(0).SetBytes(r.start))
+		total.Add(total, size.Add(size, big.NewInt(1)))
+		if gateway != nil && inRange(gateway, r) {
+			total.Sub(total, big.NewInt(1))
+		}
+	}
+
+	used := 0
+	for ip, entry := range allocated {
+		if entry.poolName != "" && entry.poolName != poolName {
+			continue
+		}
+		address := normalizeIP(net.ParseIP(ip))
+		if address == nil || (gateway != nil && gateway.Equal(address)) {
+			continue
+		}
+		for _, r := range ranges {
+			if inRange(address, r) {
+				used++
+				break
+			}
+		}
+	}
+
+	return family, total, used, nil
+}
+
+func inRange(ip net.IP, r ipRange) bool {
+	return len(ip) == len(r.start) && bytes.Compare(ip, r.start) >= 0 && bytes.Compare(ip, r.end) <= 0
+}
@@ -0,0 +1,85 @@
+package ip_manager
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+	"github.com/wenwenxiong/kubeipfixed/pkg/metrics"
+)
+
+var _ = Describe("Metrics", func() {
+	const sriovNetworks = `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`
+
+	allocations := func(result, reason string) float64 {
+		return testutil.ToFloat64(metrics.Allocations.WithLabelValues(result, reason))
+	}
+
+	It("should count the allocations by result and reason", func() {
+		ipManager := createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.100"}))
+		fromPool := allocations(metrics.ResultSuccess, allocationReasonPool)
+		requested := allocations(metrics.ResultSuccess, allocationReasonRequested)
+		exhausted := allocations(metrics.ResultFailure, allocationReasonExhausted)
+		conflict := allocations(metrics.ResultFailure, allocationReasonConflict)
+
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-1", sriovNetworks), &testTransactionTimestamp, true)).To(Succeed())
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-2", sriovNetworks), &testTransactionTimestamp, true)).ToNot(Succeed())
+		explicit := `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "n3", "address": "100.100.100.150/24"}]}`
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-3", explicit), &testTransactionTimestamp, true)).To(Succeed())
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-4", explicit), &testTransactionTimestamp, true)).ToNot(Succeed())
+		// dry-run requests are not counted
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-5", sriovNetworks), &testTransactionTimestamp, false)).ToNot(Succeed())
+
+		Expect(allocations(metrics.ResultSuccess, allocationReasonPool) - fromPool).To(Equal(1.0))
+		Expect(allocations(metrics.ResultSuccess, allocationReasonRequested) - requested).To(Equal(1.0))
+		Expect(allocations(metrics.ResultFailure, allocationReasonExhausted) - exhausted).To(Equal(1.0))
+		Expect(allocations(metrics.ResultFailure, allocationReasonConflict) - conflict).To(Equal(1.0))
+	})
+
+	It("should count the released addresses by the kind of their holder", func() {
+		ipManager := createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24"))
+		released := testutil.ToFloat64(metrics.Releases.WithLabelValues(metrics.ResultSuccess, "pod"))
+
+		pod := newTestPod("pod-1", sriovNetworks)
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(ipManager.ReleasePodIPs(pod)).To(Succeed())
+		Expect(testutil.ToFloat64(metrics.Releases.WithLabelValues(metrics.ResultSuccess, "pod")) - released).To(Equal(1.0))
+	})
+
+	It("should report the utilization of the pools and the pending transactions", func() {
+		ipManager := createTestIPManager(
+			newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.109"}),
+			newTestDualStackIPPool("sriov-n6"))
+		ipManager.ipPoolMap.createOrUpdateEntry("100.100.100.100", ipEntry{instanceName: "pod/default/pod-1", poolName: "sriov-n3"})
+		ipManager.ipPoolMap.createOrUpdateEntry("100.100.100.101", ipEntry{instanceName: "pod/default/pod-2", poolName: "sriov-n3", transactionTimestamp: &testTransactionTimestamp})
+		ipManager.ipPoolMap.createOrUpdateEntry("100.100.100.103", ipEntry{instanceName: "pod/default/pod-2", poolName: "sriov-n3", transactionTimestamp: &testTransactionTimestamp})
+		// explicitly requested addresses outside of the ranges do not use the pool capacity
+		ipManager.ipPoolMap.createOrUpdateEntry("100.100.100.150", ipEntry{instanceName: "pod/default/pod-3", poolName: "sriov-n3"})
+		// the pools overlap, each one counts its own allocations
+		ipManager.ipPoolMap.createOrUpdateEntry("100.100.100.102", ipEntry{instanceName: "pod/default/pod-4", poolName: "sriov-n6"})
+		ipManager.ipPoolMap.createOrUpdateEntry("fd00:100::100", ipEntry{instanceName: "pod/default/pod-4", poolName: "sriov-n6"})
+
+		expected := `
+# HELP kubeipfixed_pending_transactions Number of admissions whose workload was not created yet, i.e. the distinct transactions of the pending addresses
+# TYPE kubeipfixed_pending_transactions gauge
+kubeipfixed_pending_transactions 1
+# HELP kubeipfixed_pool_addresses Number of allocatable addresses of the pool ranges by pool, family and state (total, allocated, free)
+# TYPE kubeipfixed_pool_addresses gauge
+kubeipfixed_pool_addresses{family="ipv4",pool="sriov-n3",state="allocated"} 3
+kubeipfixed_pool_addresses{family="ipv4",pool="sriov-n3",state="free"} 7
+kubeipfixed_pool_addresses{family="ipv4",pool="sriov-n3",state="total"} 10
+kubeipfixed_pool_addresses{family="ipv4",pool="sriov-n6",state="allocated"} 1
+kubeipfixed_pool_addresses{family="ipv4",pool="sriov-n6",state="free"} 100
+kubeipfixed_pool_addresses{family="ipv4",pool="sriov-n6",state="total"} 101
+kubeipfixed_pool_addresses{family="ipv6",pool="sriov-n6",state="allocated"} 1
+kubeipfixed_pool_addresses{family="ipv6",pool="sriov-n6",state="free"} 256
+kubeipfixed_pool_addresses{family="ipv6",pool="sriov-n6",state="total"} 257
+`
+		collector := &ipPoolCollector{ipManager: ipManager}
+		Expect(testutil.CollectAndCompare(collector, strings.NewReader(expected))).To(Succeed())
+	})
+})
@@ -0,0 +1,161 @@
+package ip_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+
+	"github.com/wenwenxiong/kubeipfixed/pkg/utils"
+)
+
+// parseMultusNetworks parses the k8s.v1.cni.cncf.io/networks annotation given either as a json list or as a comma
+// separated list of <namespace>/<name>@<interface> references
+func parseMultusNetworks(value, defaultNamespace string) ([]*netattdefv1.NetworkSelectionElement, error) {
+	var elements []*netattdefv1.NetworkSelectionElement
+	if strings.TrimSpace(value) == "" {
+		return elements, nil
+	}
+
+	if strings.IndexAny(value, "[{\"") >= 0 {
+		if err := json.Unmarshal([]byte(value), &elements); err != nil {
+			return nil, fmt.Errorf("failed to parse the %s annotation json format: %v", NetworksAnnotation, err)
+		}
+	} else {
+		for _, item := range strings.Split(value, ",") {
+			element, err := parseMultusNetworkReference(strings.TrimSpace(item))
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse the %s annotation: %v", NetworksAnnotation, err)
+			}
+			elements = append(elements, element)
+		}
+	}
+
+	for _, element := range elements {
+		if element.Namespace == "" {
+			element.Namespace = defaultNamespace
+		}
+	}
+
+	return elements, nil
+}
+
+// parseMultusNetworkReference parses a <namespace>/<name>@<interface> reference, namespace and interface are optional
+func parseMultusNetworkReference(reference string) (*netattdefv1.NetworkSelectionElement, error) {
+	element := &netattdefv1.NetworkSelectionElement{}
+
+	name := reference
+	slashItems := strings.Split(reference, "/")
+	switch len(slashItems) {
+	case 1:
+	case 2:
+		element.Namespace = strings.TrimSpace(slashItems[0])
+		name = slashItems[1]
+	default:
+		return nil, fmt.Errorf("invalid network reference %q", reference)
+	}
+
+	atItems := strings.Split(name, "@")
+	switch len(atItems) {
+	case 1:
+	case 2:
+		element.InterfaceRequest = strings.TrimSpace(atItems[1])
+	default:
+		return nil, fmt.Errorf("invalid network reference %q", reference)
+	}
+	element.Name = strings.TrimSpace(atItems[0])
+
+	if element.Name == "" {
+		return nil, fmt.Errorf("invalid network reference %q", reference)
+	}
+	return element, nil
+}
+
+// mergeMultusNetworks adds a network selection element for every address to the existing k8s.v1.cni.cncf.io/networks
+// annotation value, in the order of the addresses. Elements already referencing the NetworkAttachmentDefinition of an
+// address are kept, so the interface name, mac and default-route requested by the user are preserved. A mac other than
+// the allocated one is kept too and rejected by ValidatePodNetworks, see validateMultusMACs.
+// Every address gets a stable interface name, the one requested in the sriovnetworks annotation or net<position>.
+// The addresses using the NetworkAttachmentDefinition shared by their pool are passed in the ips of their element.
+func mergeMultusNetworks(value, defaultNamespace string, addresses []sriovIpAddress) (string, error) {
+	elements, err := parseMultusNetworks(value, defaultNamespace)
+	if err != nil {
+		return "", err
+	}
+
+	toName := []*netattdefv1.NetworkSelectionElement{}
+	for _, address := range addresses {
+		element := findMultusNetwork(elements, address)
+		if element == nil {
+			element = &netattdefv1.NetworkSelectionElement{
+				Name:      address.Name,
+				Namespace: address.Namespace,
+			}
+			if address.Shared {
+				element.IPRequest = address.addresses()
+			}
+			elements = append(elements, element)
+		}
+		if element.InterfaceRequest == "" {
+			element.InterfaceRequest = address.Interface
+		}
+		if element.MacRequest == "" {
+			element.MacRequest = address.MAC
+		}
+		if element.InterfaceRequest == "" {
+			toName = append(toName, element)
+		}
+	}
+
+	for _, element := range toName {
+		element.InterfaceRequest = stableInterfaceName(elements, element)
+	}
+
+	merged, err := json.Marshal(elements)
+	if err != nil {
+		return "", err
+	}
+	return string(merged), nil
+}
+
+// stableInterfaceName returns net<position> like multus would name the element, the next free net<n> if it is taken
+func stableInterfaceName(elements []*netattdefv1.NetworkSelectionElement, element *netattdefv1.NetworkSelectionElement) string {
+	index := 1
+	for i := range elements {
+		if elements[i] == element {
+			index = i + 1
+			break
+		}
+	}
+
+	for ; ; index++ {
+		name := fmt.Sprintf("net%d", index)
+		if !isInterfaceRequested(elements, name) {
+			return name
+		}
+	}
+}
+
+func isInterfaceRequested(elements []*netattdefv1.NetworkSelectionElement, name string) bool {
+	for _, element := range elements {
+		if element.InterfaceRequest == name {
+			return true
+		}
+	}
+	return false
+}
+
+// findMultusNetwork returns the element selecting the NetworkAttachmentDefinition of the address, for a shared one
+// the element has to request the address as well
+func findMultusNetwork(elements []*netattdefv1.NetworkSelectionElement, address sriovIpAddress) *netattdefv1.NetworkSelectionElement {
+	for _, element := range elements {
+		if element.Namespace != address.Namespace || element.Name != address.Name {
+			continue
+		}
+		if !address.Shared || utils.ContainsString(element.IPRequest, address.Address) {
+			return element
+		}
+	}
+	return nil
+}
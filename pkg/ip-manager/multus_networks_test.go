@@ -0,0 +1,76 @@
+package ip_manager
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+)
+
+var _ = Describe("Multus networks", func() {
+	address := sriovIpAddress{Name: "sriov-n3-static-100-100-100-100", Namespace: "default", Address: "100.100.100.100/24"}
+
+	parseMerged := func(value string) []netattdefv1.NetworkSelectionElement {
+		elements := []netattdefv1.NetworkSelectionElement{}
+		Expect(json.Unmarshal([]byte(value), &elements)).To(Succeed())
+		return elements
+	}
+
+	DescribeTable("should parse the networks annotation",
+		func(value string, expected []*netattdefv1.NetworkSelectionElement) {
+			elements, err := parseMultusNetworks(value, "default")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(elements).To(Equal(expected))
+		},
+		Entry("empty", "", []*netattdefv1.NetworkSelectionElement(nil)),
+		Entry("comma separated", "macvlan, other/bridge@eth2",
+			[]*netattdefv1.NetworkSelectionElement{
+				{Name: "macvlan", Namespace: "default"},
+				{Name: "bridge", Namespace: "other", InterfaceRequest: "eth2"},
+			}),
+		Entry("json", `[{"name": "macvlan", "interface": "eth1", "mac": "02:00:00:00:00:01"}]`,
+			[]*netattdefv1.NetworkSelectionElement{
+				{Name: "macvlan", Namespace: "default", InterfaceRequest: "eth1", MacRequest: "02:00:00:00:00:01"}}),
+	)
+
+	It("should reject an invalid network reference", func() {
+		_, err := parseMultusNetworks("a/b/c", "default")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should append the fixed ip network to the networks requested by the user", func() {
+		merged, err := mergeMultusNetworks(`[{"name": "macvlan", "interface": "eth1", "default-route": ["10.0.0.1"]}]`, "default", []sriovIpAddress{address})
+		Expect(err).ToNot(HaveOccurred())
+
+		elements := parseMerged(merged)
+		Expect(elements).To(HaveLen(2))
+		Expect(elements[0].Name).To(Equal("macvlan"))
+		Expect(elements[0].InterfaceRequest).To(Equal("eth1"))
+		Expect(elements[0].GatewayRequest).To(HaveLen(1))
+		Expect(elements[0].GatewayRequest[0].String()).To(Equal("10.0.0.1"))
+		Expect(elements[1].Name).To(Equal("sriov-n3-static-100-100-100-100"))
+		Expect(elements[1].Namespace).To(Equal("default"))
+		Expect(elements[1].InterfaceRequest).To(Equal("net2"))
+	})
+
+	It("should keep the element of a network the user already references", func() {
+		merged, err := mergeMultusNetworks("sriov-n3-static-100-100-100-100@n3", "default", []sriovIpAddress{address})
+		Expect(err).ToNot(HaveOccurred())
+
+		elements := parseMerged(merged)
+		Expect(elements).To(HaveLen(1))
+		Expect(elements[0].InterfaceRequest).To(Equal("n3"))
+	})
+
+	It("should not reuse an interface name requested by another network", func() {
+		merged, err := mergeMultusNetworks("macvlan@net2", "default", []sriovIpAddress{address})
+		Expect(err).ToNot(HaveOccurred())
+
+		elements := parseMerged(merged)
+		Expect(elements).To(HaveLen(2))
+		Expect(elements[1].InterfaceRequest).To(Equal("net3"))
+	})
+})
@@ -0,0 +1,145 @@
+package ip_manager
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/wenwenxiong/kubeipfixed/pkg/metrics"
+)
+
+// createOrUpdateNetAttDef makes sure the rendered NetworkAttachmentDefinition exists in the cluster
+func (p *IPManager) createOrUpdateNetAttDef(netAttDef *netattdefv1.NetworkAttachmentDefinition) error {
+	// Check if this NetworkAttachmentDefinition already exists
+	found := &netattdefv1.NetworkAttachmentDefinition{}
+	err := p.kubeClient.Get(context.TODO(), types.NamespacedName{Name: netAttDef.Name, Namespace: netAttDef.Namespace}, found)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			log.V(1).Info("NetworkAttachmentDefinition CR not exist, creating")
+			start := time.Now()
+			err = p.kubeClient.Create(context.TODO(), netAttDef)
+			observeNetAttDefRequest("create", start, err)
+			if err != nil {
+				log.V(1).Error(err, "Couldn't create NetworkAttachmentDefinition CR", "Namespace", netAttDef.Namespace, "Name", netAttDef.Name)
+				return err
+			}
+			return nil
+		}
+		log.V(1).Error(err, "Couldn't get NetworkAttachmentDefinition CR", "Namespace", netAttDef.Namespace, "Name", netAttDef.Name)
+		return err
+	}
+
+	log.V(1).Info("NetworkAttachmentDefinition CR already exist")
+	if !reflect.DeepEqual(found.Spec, netAttDef.Spec) || !reflect.DeepEqual(found.GetAnnotations(), netAttDef.GetAnnotations()) {
+		log.V(1).Info("Update NetworkAttachmentDefinition CR", "Namespace", netAttDef.Namespace, "Name", netAttDef.Name)
+		netAttDef.SetResourceVersion(found.GetResourceVersion())
+		start := time.Now()
+		err = p.kubeClient.Update(context.TODO(), netAttDef)
+		observeNetAttDefRequest("update", start, err)
+		if err != nil {
+			log.V(1).Error(err, "Couldn't update NetworkAttachmentDefinition CR", "Namespace", netAttDef.Namespace, "Name", netAttDef.Name)
+			return err
+		}
+	}
+	return nil
+}
+
+// initNetAttDefMap reserves the addresses of the NetworkAttachmentDefinitions rendered by kubeipfixed.
+// Workloads found later on take the ownership over the addresses they reference, the remaining ones are
+// kept as pending transactions and get rolled back if no workload shows up within the wait time.
+func (p *IPManager) initNetAttDefMap() error {
+	transactionTimestamp := CreateTransactionTimestamp()
+
+	netAttDefList := &netattdefv1.NetworkAttachmentDefinitionList{}
+	err := p.cachedKubeClient.List(context.TODO(), netAttDefList, client.MatchingLabels{managedNetAttDefLabel: "true"})
+	if err != nil {
+		return errors.Wrap(err, "failed to list network attachment definitions")
+	}
+
+	for _, netAttDef := range netAttDefList.Items {
+		value, exist := netAttDef.Annotations[netAttDefAddressAnnotation]
+		if !exist {
+			continue
+		}
+		// a dual-stack NetworkAttachmentDefinition lists both its addresses
+		for _, address := range strings.Split(value, ",") {
+			ip, err := addressKey(address)
+			if err != nil {
+				log.Error(err, "ignoring network attachment definition with an invalid address", "Namespace", netAttDef.Namespace, "Name", netAttDef.Name)
+				continue
+			}
+			entry := ipEntry{
+				instanceName: netAttDefNamespaced(&netAttDef),
+				poolName:     p.poolNameForAddress(ip, netAttDef.Annotations[netAttDefResourceNameAnnotation]),
+				netAttDef:    types.NamespacedName{Namespace: netAttDef.Namespace, Name: netAttDef.Name},
+				// the address may belong to a workload being created right now
+				transactionTimestamp: &transactionTimestamp,
+				mac:                  netAttDef.Annotations[netAttDefMACAnnotation],
+			}
+			// sticky addresses stay with their identity even when no pod currently uses them
+			if owner := netAttDef.Annotations[netAttDefOwnerAnnotation]; isStickyInstance(owner) {
+				entry.instanceName = owner
+				entry.transactionTimestamp = nil
+			}
+			p.ipPoolMap.createOrUpdateEntry(ip, entry)
+		}
+	}
+
+	return nil
+}
+
+// deleteNetAttDef removes a NetworkAttachmentDefinition rendered by kubeipfixed, missing or foreign ones are left alone
+func (p *IPManager) deleteNetAttDef(name types.NamespacedName) error {
+	if name.Name == "" {
+		return nil
+	}
+
+	netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+	err := p.kubeClient.Get(context.TODO(), name, netAttDef)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if netAttDef.Labels[managedNetAttDefLabel] != "true" {
+		log.V(1).Info("NetworkAttachmentDefinition CR is not managed by kubeipfixed, skipping removal", "Namespace", name.Namespace, "Name", name.Name)
+		return nil
+	}
+
+	start := time.Now()
+	err = p.kubeClient.Delete(context.TODO(), netAttDef)
+	if apierrors.IsNotFound(err) {
+		err = nil
+	}
+	observeNetAttDefRequest("delete", start, err)
+	if err != nil {
+		log.V(1).Error(err, "Couldn't delete NetworkAttachmentDefinition CR", "Namespace", name.Namespace, "Name", name.Name)
+		return err
+	}
+	return nil
+}
+
+func observeNetAttDefRequest(operation string, start time.Time, err error) {
+	metrics.NetAttDefDuration.WithLabelValues(operation, metrics.Result(err)).Observe(time.Since(start).Seconds())
+}
+
+// IsManagedNetAttDef returns true for the NetworkAttachmentDefinitions rendered by kubeipfixed
+func IsManagedNetAttDef(object client.Object) bool {
+	return object.GetLabels()[managedNetAttDefLabel] == "true"
+}
+
+const netAttDefInstancePrefix = "netattdef/"
+
+func netAttDefNamespaced(netAttDef *netattdefv1.NetworkAttachmentDefinition) string {
+	return fmt.Sprintf("%s%s/%s", netAttDefInstancePrefix, netAttDef.Namespace, netAttDef.Name)
+}
@@ -20,24 +20,34 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"reflect"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"strings"
+	"time"
 
-	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/types"
 	kubevirt "kubevirt.io/api/core/v1"
+
+	"github.com/wenwenxiong/kubeipfixed/pkg/utils"
 )
 
-const tempPodName = "tempPodName"
+// tempPodNamePrefix names the pods without a name yet, see podNamespaced
+const tempPodNamePrefix = "tempPodName-"
 
-func (p *IPManager) AllocatePodIP(pod *corev1.Pod, isNotDryRun bool) error {
+// AllocatePodIP allocates the fixed ips requested by the pod sriovnetworks annotation. The allocation stays pending,
+// marked with the transaction timestamp, until the pod controller sees the pod created and commits it.
+// A dry-run request gets the same mutation without any NetworkAttachmentDefinition created or address reserved.
+func (p *IPManager) AllocatePodIP(pod *corev1.Pod, transactionTimestamp *time.Time, isNotDryRun bool) error {
 	p.poolMutex.Lock()
 	defer p.poolMutex.Unlock()
 
+	// the update removing the release finalizer must not allocate again
+	if pod.DeletionTimestamp != nil {
+		return nil
+	}
+
 	networkValue, ok := pod.Annotations[sriovNetworksAnnotation]
 	if !ok {
 		return nil
@@ -47,13 +57,12 @@ func (p *IPManager) AllocatePodIP(pod *corev1.Pod, isNotDryRun bool) error {
 	if err != nil {
 		return err
 	}
-
-	log.V(1).Info("pod meta data", "podMetaData", (*pod).ObjectMeta)
-
-	if len(networks.ipPool) == 0 {
+	if networks == nil {
 		return nil
 	}
 
+	log.V(1).Info("pod meta data", "podMetaData", (*pod).ObjectMeta)
+
 	// validate if the pod is related to kubevirt
 	if p.isRelatedToKubevirt(pod) {
 		// nothing to do here. the mac is already by allocated by the virtual machine webhook
@@ -61,53 +70,230 @@ func (p *IPManager) AllocatePodIP(pod *corev1.Pod, isNotDryRun bool) error {
 		return nil
 	}
 
-	for _, network := range networks.ipPool {
-		raw, err := network.RenderNetAttDef(networks.resourceName)
+	// the pods created from a generateName are told apart by their transaction until they are committed
+	pod.Annotations[TransactionTimestampAnnotation] = transactionTimestamp.Format(time.RFC3339Nano)
+
+	podFullName, deployment, err := p.podInstanceName(pod)
+	if err != nil {
+		return err
+	}
+	completed, err := p.completeRequestedAddresses(networks)
+	if err != nil {
+		recordAllocationFailure(isNotDryRun, err, allocationReasonInvalid)
+		p.recordAllocationFailedEvents(pod, isNotDryRun, err)
+		return err
+	}
+	err = p.validateNetworks(networks, podFullName)
+	if err != nil {
+		recordAllocationFailure(isNotDryRun, err, allocationReasonInvalid)
+		p.recordAllocationFailedEvents(pod, isNotDryRun, err)
+		return err
+	}
+	reason := allocationReasonRequested
+	reused := false
+	if len(networks.IPPool) == 0 {
+		reason = allocationReasonPool
+		switch {
+		case deployment != nil:
+			reused, err = p.reuseDeploymentIPs(networks, podFullName, pod.Namespace, deployment)
+		case isStickyInstance(podFullName):
+			reused, err = p.reuseStatefulSetIPs(networks, podFullName, pod.Namespace)
+		}
 		if err != nil {
+			recordAllocationFailure(isNotDryRun, err, allocationReasonError)
+			p.recordAllocationFailedEvents(pod, isNotDryRun, err)
 			return err
 		}
-		netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
-
-		err = p.Scheme.Convert(raw, netAttDef, nil)
+		if reused {
+			reason = allocationReasonReused
+		}
+	}
+	networksChanged, err := p.allocateNetworks(networks, pod.Namespace, podFullName, transactionTimestamp, isNotDryRun)
+	if err != nil {
+		recordAllocationFailure(isNotDryRun, err, allocationReasonError)
+		p.recordAllocationFailedEvents(pod, isNotDryRun, err)
+		return err
+	}
+	recordAllocationSuccess(isNotDryRun, reason)
+	networksChanged = networksChanged || reused || completed
+	if networksChanged {
+		networkValue, err := json.Marshal(networks)
 		if err != nil {
 			return err
 		}
-		// Check if this NetworkAttachmentDefinition already exists
-		found := &netattdefv1.NetworkAttachmentDefinition{}
-		err = p.kubeClient.Get(context.TODO(), types.NamespacedName{Name: netAttDef.Name, Namespace: netAttDef.Namespace}, found)
+		pod.Annotations[sriovNetworksAnnotation] = string(networkValue)
+	}
+
+	multusNetworks, err := mergeMultusNetworks(pod.Annotations[NetworksAnnotation], pod.Namespace, networks.IPPool)
+	if err != nil {
+		return err
+	}
+	pod.Annotations[NetworksAnnotation] = multusNetworks
+
+	elements, err := parseMultusNetworks(multusNetworks, pod.Namespace)
+	if err != nil {
+		return err
+	}
+	status, err := networksStatus(networks, podInterfaceName(elements))
+	if err != nil {
+		return err
+	}
+	pod.Annotations[StatusAnnotation] = status
+
+	if !utils.ContainsString(pod.Finalizers, ReleaseIPFinalizer) {
+		pod.Finalizers = append(pod.Finalizers, ReleaseIPFinalizer)
+	}
+
+	return nil
+}
+
+// MarkPodAsReady commits the pending allocations of a pod once it exists in the cluster, the committed addresses are
+// recorded by an Event on the pod and on their pools
+func (p *IPManager) MarkPodAsReady(pod *corev1.Pod) error {
+	timestampValue, ok := pod.Annotations[TransactionTimestampAnnotation]
+	if !ok {
+		return nil
+	}
+	networkValue, ok := pod.Annotations[sriovNetworksAnnotation]
+	if !ok {
+		return nil
+	}
+
+	transactionTimestamp, err := parseTransactionTimestamp(timestampValue)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse the pod transaction timestamp")
+	}
+	networks, err := parsePodNetworkAnnotation(networkValue, pod.Namespace)
+	if err != nil || networks == nil {
+		return err
+	}
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	podFullName, deployment, err := p.podInstanceName(pod)
+	if err != nil {
+		return err
+	}
+	committed, err := p.commitAllocations(podFullName, networks, transactionTimestamp)
+	if err != nil {
+		return err
+	}
+	// the addresses of an ip set are freed by the pod using them, even once it is gone, see ReleasePodIPs
+	if deployment != nil {
+		err = p.markIPsInUse(podFullName, networks, podNamespaced(pod), true)
 		if err != nil {
-			if errors.IsNotFound(err) {
-				log.V(1).Info("NetworkAttachmentDefinition CR not exist, creating")
-				err = p.kubeClient.Create(context.TODO(), netAttDef)
-				if err != nil {
-					log.V(1).Error(err, "Couldn't create NetworkAttachmentDefinition CR", "Namespace", netAttDef.Namespace, "Name", netAttDef.Name)
-					return err
-				}
-			} else {
-				log.V(1).Error(err, "Couldn't get NetworkAttachmentDefinition CR", "Namespace", netAttDef.Namespace, "Name", netAttDef.Name)
-				return err
+			return err
+		}
+	}
+	p.recordWorkloadEvent(pod, eventReasonAllocated, "allocated", committed)
+	p.recordPoolEvents(podFullName, eventReasonAllocated, "allocated", committed)
+	return nil
+}
+
+// ReleasePodIPs releases the addresses held by the pod and removes the NetworkAttachmentDefinitions rendered for them.
+// The addresses of StatefulSet pods are held by their identity and released with it, see ReleaseStatefulSetIPs,
+// the ones of Deployment pods go back to the ip set of the Deployment for the next pod, see ReleaseDeploymentIPs,
+// also when only the name of the pod is known any more. It is safe to call it several times for the same pod.
+func (p *IPManager) ReleasePodIPs(pod *corev1.Pod) error {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	instanceName, deployment, err := p.knownPodInstanceName(pod)
+	if err != nil {
+		return err
+	}
+	if isStickyInstance(instanceName) {
+		if deployment != nil {
+			if networks, err := parsePodNetworkAnnotation(pod.Annotations[sriovNetworksAnnotation], pod.Namespace); err == nil && networks != nil {
+				return p.markIPsInUse(instanceName, networks, podNamespaced(pod), false)
 			}
-		} else {
-			log.V(1).Info("NetworkAttachmentDefinition CR already exist")
-			if !reflect.DeepEqual(found.Spec, netAttDef.Spec) || !reflect.DeepEqual(found.GetAnnotations(), netAttDef.GetAnnotations()) {
-				log.V(1).Info("Update NetworkAttachmentDefinition CR", "Namespace", netAttDef.Namespace, "Name", netAttDef.Name)
-				netAttDef.SetResourceVersion(found.GetResourceVersion())
-				err = p.kubeClient.Update(context.TODO(), netAttDef)
-				if err != nil {
-					log.V(1).Error(err, "Couldn't update NetworkAttachmentDefinition CR", "Namespace", netAttDef.Namespace, "Name", netAttDef.Name)
-					return err
+		}
+		return nil
+	}
+
+	podFullName := podNamespaced(pod)
+	toRelease := p.ipPoolMap.filterByInstanceName(podFullName)
+
+	// addresses allocated while the pod had no generated name yet are still recorded under the temporary name
+	if networkValue, ok := pod.Annotations[sriovNetworksAnnotation]; ok {
+		networks, err := parsePodNetworkAnnotation(networkValue, pod.Namespace)
+		if err == nil && networks != nil {
+			tempPodFullName := fmt.Sprintf("pod/%s/%s", pod.Namespace, tempPodName(pod))
+			for _, network := range networks.IPPool {
+				for _, address := range network.addresses() {
+					ip, err := addressKey(address)
+					if err != nil {
+						continue
+					}
+					if entry, exist := p.ipPoolMap[ip]; exist && entry.instanceName == tempPodFullName {
+						toRelease.createOrUpdateEntry(ip, entry)
+					}
 				}
 			}
 		}
 	}
 
-	name := networks.ipPool[0].Name
-	namespace := networks.ipPool[0].Namespace
+	err = p.releaseAllocations(podFullName, toRelease)
+	if err != nil {
+		return err
+	}
+	p.recordWorkloadEvent(pod, eventReasonReleased, "released", toRelease)
+
+	// the pod may be gone along with the owners telling its ip set
+	return p.freeIPSetAddresses(podFullName)
+}
 
-	networkListJson := "[{\"name\": \"" + name + "\", \"namespace\":\"" + namespace + "\"}]"
-	pod.Annotations[NetworksAnnotation] = networkListJson
+// podInstanceName returns the name the addresses of the pod are allocated to: the identity of a StatefulSet pod,
+// the ip set of the Deployment owning the pod, or the pod itself. The Deployment is returned for the pods of an ip set.
+func (p *IPManager) podInstanceName(pod *corev1.Pod) (string, *appsv1.Deployment, error) {
+	if identity := statefulSetIdentity(pod); identity != "" {
+		return identity, nil, nil
+	}
 
-	return nil
+	deployment, ipSetName, err := p.deploymentIPSet(pod)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to find the deployment owning the pod")
+	}
+	if deployment != nil {
+		return ipSetName, deployment, nil
+	}
+
+	return podNamespaced(pod), nil, nil
+}
+
+// knownPodInstanceName returns the podInstanceName of a pod that already holds its addresses, the pods whose
+// ReplicaSet or Deployment is gone, e.g. along with the ip set, hold them by their own name
+func (p *IPManager) knownPodInstanceName(pod *corev1.Pod) (string, *appsv1.Deployment, error) {
+	instanceName, deployment, err := p.podInstanceName(pod)
+	var ownerErr *ownerNotFoundError
+	if errors.As(err, &ownerErr) {
+		return podNamespaced(pod), nil, nil
+	}
+	return instanceName, deployment, err
+}
+
+// isStickyInstance returns true for the identities holding their addresses independently of the pods using them,
+// and for the reservations
+func isStickyInstance(instanceName string) bool {
+	return strings.HasPrefix(instanceName, statefulSetInstancePrefix) || strings.HasPrefix(instanceName, deploymentInstancePrefix) ||
+		strings.HasPrefix(instanceName, reservationInstancePrefix)
+}
+
+func podNamespaced(pod *corev1.Pod) string {
+	name := pod.Name
+	if name == "" {
+		// pods created from a generateName have no name yet at admission time
+		name = tempPodName(pod)
+	}
+	return fmt.Sprintf("pod/%s/%s", pod.Namespace, name)
+}
+
+// tempPodName returns the name the pending allocations of a pod are held by until the pod is created with its
+// generated name, it is unique to the admission of the pod through the transaction timestamp. The allocations are
+// handed over to the generated name on commit, see commitAllocations.
+func tempPodName(pod *corev1.Pod) string {
+	return tempPodNamePrefix + pod.Annotations[TransactionTimestampAnnotation]
 }
 
 func (p *IPManager) isRelatedToKubevirt(pod *corev1.Pod) bool {
@@ -147,14 +333,71 @@ func parsePodNetworkAnnotation(podNetworks, defaultNamespace string) (*sriovNetw
 		return networks, nil
 	}
 
-	for _, sriovIp := range networks.ipPool {
+	setNetworksDefaults(networks, defaultNamespace)
+
+	return networks, nil
+}
+
+// setNetworksDefaults puts the entries without namespace in the namespace of the workload and sets the default nameservers
+func setNetworksDefaults(networks *sriovNetwork, defaultNamespace string) {
+	for i := range networks.IPPool {
+		sriovIp := &networks.IPPool[i]
 		if sriovIp.Namespace == "" {
 			sriovIp.Namespace = defaultNamespace
 		}
-		if sriovIp.Nameservers == "" {
-			sriovIp.Nameservers = defaultNameservers
+		if len(sriovIp.Nameservers) == 0 {
+			sriovIp.Nameservers = nameserverList{defaultNameservers}
 		}
 	}
+}
 
-	return networks, nil
+// initPodMap reserves the addresses held by the existing pods
+func (p *IPManager) initPodMap() error {
+	pods := &corev1.PodList{}
+	err := p.cachedKubeClient.List(context.TODO(), pods)
+	if err != nil {
+		return err
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		networkValue, ok := pod.Annotations[sriovNetworksAnnotation]
+		if !ok {
+			continue
+		}
+
+		// the addresses of virt-launcher pods are owned by their virtual machine
+		if p.isRelatedToKubevirt(pod) {
+			continue
+		}
+
+		networks, err := parsePodNetworkAnnotation(networkValue, pod.Namespace)
+		if err != nil || networks == nil {
+			log.Error(err, "ignoring pod with an invalid sriovnetworks annotation", "podFullName", podNamespaced(pod))
+			continue
+		}
+
+		instanceName, deployment, err := p.knownPodInstanceName(pod)
+		if err != nil {
+			return err
+		}
+		allocations, err := p.networksAllocations(instanceName, networks)
+		if err != nil {
+			log.Error(err, "ignoring pod with an invalid address", "podFullName", podNamespaced(pod))
+			continue
+		}
+		for ip, entry := range allocations {
+			// a terminating pod hands its address of the ip set over to the next pod
+			entry.inUse = deployment != nil && pod.DeletionTimestamp == nil
+			if entry.inUse {
+				entry.podName = podNamespaced(pod)
+			}
+			err := p.ipPoolMap.claim(ip, entry)
+			if err != nil {
+				log.Error(err, "duplicate ip found while rebuilding the allocation state, keeping the first holder", "podFullName", podNamespaced(pod))
+			}
+		}
+	}
+
+	return nil
 }
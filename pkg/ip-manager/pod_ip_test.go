@@ -0,0 +1,233 @@
+package ip_manager
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+var _ = Describe("Pod IP", func() {
+	const sriovNetworks = `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`
+	var ipManager *IPManager
+
+	BeforeEach(func() {
+		ipManager = createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}))
+	})
+
+	netAttDefExists := func(name string) bool {
+		err := ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: name}, &netattdefv1.NetworkAttachmentDefinition{})
+		if apierrors.IsNotFound(err) {
+			return false
+		}
+		Expect(err).ToNot(HaveOccurred())
+		return true
+	}
+
+	It("should add the release finalizer to pods that got a fixed ip", func() {
+		pod := newTestPod("pod-1", sriovNetworks)
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(pod.Finalizers).To(ConsistOf(ReleaseIPFinalizer))
+
+		Expect(ipManager.AllocatePodIP(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "plain", Namespace: "default"}}, &testTransactionTimestamp, true)).To(Succeed())
+	})
+
+	It("should keep the secondary networks already requested by the pod", func() {
+		pod := newTestPod("pod-1", sriovNetworks)
+		pod.Annotations[NetworksAnnotation] = "macvlan@eth1"
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(pod.Annotations[NetworksAnnotation]).To(MatchJSON(`[{"name": "macvlan", "namespace": "default", "interface": "eth1"}, {"name": "sriov-n3-static-100-100-100-100", "namespace": "default", "interface": "net2"}]`))
+	})
+
+	It("should attach every requested address with a stable interface name", func() {
+		pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [`+
+			`{"name": "n3", "address": "100.100.100.150/24", "gateway": "100.100.100.1"},`+
+			`{"name": "n6", "address": "100.100.100.151/24", "gateway": "100.100.100.1", "interface": "n6"},`+
+			`{"name": "n9", "address": "100.100.100.152/24", "gateway": "100.100.100.1"}]}`)
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(pod.Annotations[NetworksAnnotation]).To(MatchJSON(`[` +
+			`{"name": "n3", "namespace": "default", "interface": "net1"},` +
+			`{"name": "n6", "namespace": "default", "interface": "n6"},` +
+			`{"name": "n9", "namespace": "default", "interface": "net3"}]`))
+		Expect(netAttDefExists("n3")).To(BeTrue())
+		Expect(netAttDefExists("n6")).To(BeTrue())
+		Expect(netAttDefExists("n9")).To(BeTrue())
+	})
+
+	It("should render the routes, nameservers and search domains of the entry", func() {
+		pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [`+
+			`{"name": "n3", "address": "100.100.100.150/24", "nameservers": "10.0.0.53, 10.0.1.53", "search": ["upf.local"],`+
+			` "routes": [{"dst": "10.10.0.0/16", "gw": "100.100.100.254"}, {"dst": "10.20.0.0/16"}]}]}`)
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+
+		netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+		Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "n3"}, netAttDef)).To(Succeed())
+		config := map[string]interface{}{}
+		Expect(json.Unmarshal([]byte(netAttDef.Spec.Config), &config)).To(Succeed())
+		Expect(config["ipam"]).To(Equal(map[string]interface{}{
+			"type":      "static",
+			"addresses": []interface{}{map[string]interface{}{"address": "100.100.100.150/24", "gateway": "100.100.100.1"}},
+			"routes": []interface{}{
+				map[string]interface{}{"dst": "10.10.0.0/16", "gw": "100.100.100.254"},
+				map[string]interface{}{"dst": "10.20.0.0/16"},
+			},
+			"dns": map[string]interface{}{"nameservers": []interface{}{"10.0.0.53", "10.0.1.53"}, "search": []interface{}{"upf.local"}},
+		}))
+		Expect(pod.Annotations[sriovNetworksAnnotation]).To(ContainSubstring(`"nameservers":["10.0.0.53","10.0.1.53"]`))
+	})
+
+	It("should give the routes and search domains of the pool to the entries without any", func() {
+		pool := newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"})
+		pool.Spec.Nameservers = []string{"10.0.0.53", "10.0.1.53"}
+		pool.Spec.Search = []string{"upf.local"}
+		pool.Spec.Routes = []ippoolv1alpha1.Route{{Dst: "10.10.0.0/16", Gw: "100.100.100.254"}}
+		ipManager = createTestIPManager(pool)
+
+		pod := newTestPod("pod-1", sriovNetworks)
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(pod.Annotations[sriovNetworksAnnotation]).To(ContainSubstring(
+			`"nameservers":["10.0.0.53","10.0.1.53"]`))
+		Expect(pod.Annotations[sriovNetworksAnnotation]).To(ContainSubstring(
+			`"search":["upf.local"],"routes":[{"dst":"10.10.0.0/16","gw":"100.100.100.254"}]`))
+
+		explicit := newTestPod("pod-2", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "n3", "address": "100.100.100.150"}]}`)
+		Expect(ipManager.AllocatePodIP(explicit, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(explicit.Annotations[sriovNetworksAnnotation]).To(ContainSubstring(`"routes":[{"dst":"10.10.0.0/16","gw":"100.100.100.254"}]`))
+	})
+
+	It("should mutate a dry-run pod without creating NetworkAttachmentDefinitions or reserving the ip", func() {
+		dryRunPod := newTestPod("pod-1", sriovNetworks)
+		Expect(ipManager.AllocatePodIP(dryRunPod, &testTransactionTimestamp, false)).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(BeEmpty())
+		Expect(netAttDefExists("sriov-n3-static-100-100-100-100")).To(BeFalse())
+
+		pod := newTestPod("pod-1", sriovNetworks)
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(dryRunPod.Annotations).To(Equal(pod.Annotations))
+		Expect(dryRunPod.Finalizers).To(Equal(pod.Finalizers))
+		Expect(netAttDefExists("sriov-n3-static-100-100-100-100")).To(BeTrue())
+	})
+
+	It("should release the ip and its NetworkAttachmentDefinition idempotently", func() {
+		pod := newTestPod("pod-1", sriovNetworks)
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(netAttDefExists("sriov-n3-static-100-100-100-100")).To(BeTrue())
+
+		Expect(ipManager.ReleasePodIPs(pod)).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(BeEmpty())
+		Expect(netAttDefExists("sriov-n3-static-100-100-100-100")).To(BeFalse())
+
+		Expect(ipManager.ReleasePodIPs(pod)).To(Succeed())
+	})
+
+	It("should release ips allocated before the pod got its generated name", func() {
+		pod := newTestPod("", sriovNetworks)
+		pod.GenerateName = "web-"
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+
+		pod.Name = "web-x5f2k"
+		Expect(ipManager.ReleasePodIPs(pod)).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(BeEmpty())
+	})
+
+	It("should not remove NetworkAttachmentDefinitions it did not render", func() {
+		foreign := &netattdefv1.NetworkAttachmentDefinition{ObjectMeta: metav1.ObjectMeta{Name: "user-network", Namespace: "default"}}
+		Expect(ipManager.kubeClient.Create(context.TODO(), foreign)).To(Succeed())
+
+		Expect(ipManager.deleteNetAttDef(types.NamespacedName{Namespace: "default", Name: "user-network"})).To(Succeed())
+		Expect(netAttDefExists("user-network")).To(BeTrue())
+	})
+})
+
+var _ = Describe("Pod IP transactions", func() {
+	const sriovNetworks = `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`
+	var ipManager *IPManager
+
+	BeforeEach(func() {
+		ipManager = createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}))
+	})
+
+	AfterEach(func() {
+		now = time.Now
+	})
+
+	It("should commit the pending allocation once the pod is created", func() {
+		pod := newTestPod("", sriovNetworks)
+		pod.GenerateName = "web-"
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(pod.Annotations[TransactionTimestampAnnotation]).To(Equal(testTransactionTimestamp.Format(time.RFC3339Nano)))
+		Expect(ipManager.ipPoolMap["100.100.100.100"].isPending()).To(BeTrue())
+
+		pod.Name = "web-x5f2k"
+		Expect(ipManager.MarkPodAsReady(pod)).To(Succeed())
+		entry := ipManager.ipPoolMap["100.100.100.100"]
+		Expect(entry.isPending()).To(BeFalse())
+		Expect(entry.instanceName).To(Equal("pod/default/web-x5f2k"))
+	})
+
+	It("should tell apart the pods admitted before they got their generated name", func() {
+		const requested = `{"subnet": "100.100.100.0/24", "ippool": [{"name": "n1", "address": "100.100.100.150/24"}]}`
+		first := newTestPod("", requested)
+		first.GenerateName = "web-"
+		Expect(ipManager.AllocatePodIP(first, &testTransactionTimestamp, true)).To(Succeed())
+
+		otherTransactionTimestamp := testTransactionTimestamp.Add(time.Millisecond)
+		second := newTestPod("", requested)
+		second.GenerateName = "web-"
+		Expect(ipManager.AllocatePodIP(second, &otherTransactionTimestamp, true)).To(MatchError(
+			"address 100.100.100.150 is already held by pod/default/tempPodName-" + testTransactionTimestamp.Format(time.RFC3339Nano)))
+
+		// the commit of another pod admitted without name does not take the pending allocation over
+		second.Name = "web-b"
+		Expect(ipManager.MarkPodAsReady(second)).To(Succeed())
+		Expect(ipManager.ipPoolMap["100.100.100.150"].isPending()).To(BeTrue())
+
+		first.Name = "web-a"
+		Expect(ipManager.MarkPodAsReady(first)).To(Succeed())
+		Expect(ipManager.ipPoolMap["100.100.100.150"].instanceName).To(Equal("pod/default/web-a"))
+	})
+
+	It("should roll back allocations whose pod never showed up within the wait time", func() {
+		committed := newTestPod("pod-1", sriovNetworks)
+		Expect(ipManager.AllocatePodIP(committed, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(ipManager.MarkPodAsReady(committed)).To(Succeed())
+
+		rejected := newTestPod("pod-2", sriovNetworks)
+		Expect(ipManager.AllocatePodIP(rejected, &testTransactionTimestamp, true)).To(Succeed())
+
+		now = func() time.Time {
+			return testTransactionTimestamp.Add(time.Duration(ipManager.waitTime-1) * time.Second)
+		}
+		ipManager.rollbackExpiredTransactions()
+		Expect(ipManager.ipPoolMap).To(HaveLen(2))
+
+		now = func() time.Time {
+			return testTransactionTimestamp.Add(time.Duration(ipManager.waitTime+1) * time.Second)
+		}
+		ipManager.rollbackExpiredTransactions()
+		Expect(ipManager.ipPoolMap).To(HaveLen(1))
+		Expect(ipManager.ipPoolMap).To(HaveKey("100.100.100.100"))
+		err := ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-101"}, &netattdefv1.NetworkAttachmentDefinition{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("should re-reserve the ip of a pod created after its transaction expired", func() {
+		pod := newTestPod("pod-1", sriovNetworks)
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		ipManager.ipPoolMap.removeEntry("100.100.100.100")
+
+		Expect(ipManager.MarkPodAsReady(pod)).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(HaveKey("100.100.100.100"))
+		Expect(ipManager.ipPoolMap["100.100.100.100"].isPending()).To(BeFalse())
+	})
+})
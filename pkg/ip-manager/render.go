@@ -60,11 +60,44 @@ func RenderDir(manifestDir string, d *RenderData) ([]*unstructured.Unstructured,
 // RenderTemplate reads, renders, and attempts to parse a yaml or
 // json file representing one or more k8s api objects
 func RenderTemplate(path string, d *RenderData) ([]*unstructured.Unstructured, error) {
-	rendered, err := renderTemplate(path, d)
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read manifest %s", path)
+	}
+
+	tmpl, err := parseTemplate(path, string(source), d.Funcs)
 	if err != nil {
 		return nil, err
 	}
 
+	return renderParsedTemplate(tmpl, d)
+}
+
+// parseTemplate parses a manifest template with the universal functions, so it can be rendered several times
+func parseTemplate(name, source string, funcs template.FuncMap) (*template.Template, error) {
+	tmpl := template.New(name).Option("missingkey=error")
+	if funcs != nil {
+		tmpl.Funcs(funcs)
+	}
+
+	// Add universal functions
+	tmpl.Funcs(template.FuncMap{"getOr": getOr, "isSet": isSet})
+	tmpl.Funcs(sprig.TxtFuncMap())
+
+	if _, err := tmpl.Parse(source); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse manifest %s as template", name)
+	}
+
+	return tmpl, nil
+}
+
+// renderParsedTemplate renders a parsed template and attempts to parse the output as k8s api objects
+func renderParsedTemplate(tmpl *template.Template, d *RenderData) ([]*unstructured.Unstructured, error) {
+	rendered := bytes.Buffer{}
+	if err := tmpl.Execute(&rendered, d.Data); err != nil {
+		return nil, errors.Wrapf(err, "failed to render manifest %s", tmpl.Name())
+	}
+
 	out := []*unstructured.Unstructured{}
 
 	// special case - if the entire file is whitespace, skip
@@ -72,44 +105,17 @@ func RenderTemplate(path string, d *RenderData) ([]*unstructured.Unstructured, e
 		return out, nil
 	}
 
-	decoder := yaml.NewYAMLOrJSONDecoder(rendered, 4096)
+	decoder := yaml.NewYAMLOrJSONDecoder(&rendered, 4096)
 	for {
 		u := unstructured.Unstructured{}
 		if err := decoder.Decode(&u); err != nil {
 			if err == io.EOF {
 				break
 			}
-			return nil, errors.Wrapf(err, "failed to unmarshal manifest %s", path)
+			return nil, errors.Wrapf(err, "failed to unmarshal manifest %s", tmpl.Name())
 		}
 		out = append(out, &u)
 	}
 
 	return out, nil
 }
-
-func renderTemplate(path string, d *RenderData) (*bytes.Buffer, error) {
-	tmpl := template.New(path).Option("missingkey=error")
-	if d.Funcs != nil {
-		tmpl.Funcs(d.Funcs)
-	}
-
-	// Add universal functions
-	tmpl.Funcs(template.FuncMap{"getOr": getOr, "isSet": isSet})
-	tmpl.Funcs(sprig.TxtFuncMap())
-
-	source, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to read manifest %s", path)
-	}
-
-	if _, err := tmpl.Parse(string(source)); err != nil {
-		return nil, errors.Wrapf(err, "failed to parse manifest %s as template", path)
-	}
-
-	rendered := bytes.Buffer{}
-	if err := tmpl.Execute(&rendered, d.Data); err != nil {
-		return nil, errors.Wrapf(err, "failed to render manifest %s", path)
-	}
-
-	return &rendered, nil
-}
@@ -0,0 +1,144 @@
+package ip_manager
+
+import (
+	"fmt"
+	"strings"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// reservations keep addresses out of the pools without any workload, e.g. for a device outside of the cluster. The
+// NetworkAttachmentDefinition rendered for the addresses records the reservation in its owner annotation.
+const reservationInstancePrefix = "reservation/"
+
+func reservationNamespaced(name types.NamespacedName) string {
+	return fmt.Sprintf("%s%s/%s", reservationInstancePrefix, name.Namespace, name.Name)
+}
+
+// Reserve reserves the addresses requested by a sriovnetworks annotation under the name, a request without address
+// gets the next free address of its pool. It returns the reserved addresses.
+func (p *IPManager) Reserve(name types.NamespacedName, sriovNetworks string) ([]Allocation, error) {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	instanceName := reservationNamespaced(name)
+	if len(p.ipPoolMap.filterByInstanceName(instanceName)) != 0 {
+		return nil, fmt.Errorf("reservation %s already exists", name)
+	}
+
+	networks, err := parseSriovNetworks(sriovNetworks, name.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if networks.Subnet != "" {
+		pool, err := p.findIPPool(networks.Subnet, networks.ResourceName)
+		if err != nil {
+			return nil, err
+		}
+		// the NetworkAttachmentDefinition shared by the pool can not record the reservation
+		if pool != nil && isSharedNetAttDefPool(pool) {
+			return nil, fmt.Errorf("the addresses of the shared ip pool %s can not be reserved", pool.Name)
+		}
+	}
+	_, err = p.completeRequestedAddresses(networks)
+	if err != nil {
+		return nil, err
+	}
+	err = p.validateNetworks(networks, instanceName)
+	if err != nil {
+		return nil, err
+	}
+	_, err = p.allocateNetworks(networks, name.Namespace, instanceName, nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	reserved := p.ipPoolMap.filterByInstanceName(instanceName)
+	log.Info("reserved ips", "instanceName", instanceName, "addresses", sortedIPs(reserved))
+	return newAllocations(reserved), nil
+}
+
+// Release releases the address, given with or without prefix length, and the other addresses of its reservation or
+// of its orphaned NetworkAttachmentDefinition. The addresses of the workloads are released with them. It returns the
+// released addresses.
+func (p *IPManager) Release(address string) ([]Allocation, error) {
+	ip, err := addressKey(address)
+	if err != nil {
+		return nil, err
+	}
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	entry, exist := p.ipPoolMap[ip]
+	if !exist {
+		return nil, fmt.Errorf("address %s is not allocated", ip)
+	}
+	if !strings.HasPrefix(entry.instanceName, reservationInstancePrefix) && !strings.HasPrefix(entry.instanceName, netAttDefInstancePrefix) {
+		return nil, fmt.Errorf("address %s is held by %s, it is released with its workload", ip, holderName(entry.instanceName))
+	}
+
+	toRelease := p.ipPoolMap.filterByInstanceName(entry.instanceName)
+	err = p.releaseAllocations(entry.instanceName, toRelease)
+	if err != nil {
+		return nil, err
+	}
+	return newAllocations(toRelease), nil
+}
+
+// SyncReservation keeps the reservations of the allocation state in line with their NetworkAttachmentDefinitions,
+// netAttDef is nil once it is deleted. The reservations are made by the kubeipfixed CLI, the running manager learns
+// about them this way.
+func (p *IPManager) SyncReservation(name types.NamespacedName, netAttDef *netattdefv1.NetworkAttachmentDefinition) error {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	if netAttDef == nil {
+		toRelease := map[string]ipMap{}
+		for ip, entry := range p.ipPoolMap {
+			if entry.netAttDef != name || !strings.HasPrefix(entry.instanceName, reservationInstancePrefix) {
+				continue
+			}
+			if toRelease[entry.instanceName] == nil {
+				toRelease[entry.instanceName] = ipMap{}
+			}
+			toRelease[entry.instanceName].createOrUpdateEntry(ip, entry)
+		}
+		for instanceName, allocations := range toRelease {
+			err := p.releaseAllocations(instanceName, allocations)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	owner := netAttDef.Annotations[netAttDefOwnerAnnotation]
+	value, exist := netAttDef.Annotations[netAttDefAddressAnnotation]
+	if !strings.HasPrefix(owner, reservationInstancePrefix) || !exist {
+		return nil
+	}
+	allocations := ipMap{}
+	for _, address := range strings.Split(value, ",") {
+		ip, err := addressKey(address)
+		if err != nil {
+			return err
+		}
+		entry := ipEntry{
+			instanceName: owner,
+			poolName:     p.poolNameForAddress(ip, netAttDef.Annotations[netAttDefResourceNameAnnotation]),
+			netAttDef:    name,
+			mac:          netAttDef.Annotations[netAttDefMACAnnotation],
+		}
+		err = p.ipPoolMap.checkClaim(ip, entry)
+		if err != nil {
+			return err
+		}
+		allocations.createOrUpdateEntry(ip, entry)
+	}
+	for ip, entry := range allocations {
+		p.ipPoolMap.createOrUpdateEntry(ip, entry)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package ip_manager
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+var _ = Describe("Reservation", func() {
+	const subnetRequest = `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`
+	reservation := types.NamespacedName{Namespace: "default", Name: "keep-n3"}
+	var ipManager *IPManager
+
+	BeforeEach(func() {
+		ipManager = createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}))
+	})
+
+	It("should reserve the next free address of the pool and keep it out of the allocations", func() {
+		reserved, err := ipManager.Reserve(reservation, subnetRequest)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reserved).To(Equal([]Allocation{{IP: "100.100.100.100", Pool: "sriov-n3", Holder: "reservation/default/keep-n3",
+			NetAttDef: "default/sriov-n3-static-100-100-100-100"}}))
+
+		netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+		Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-100"}, netAttDef)).To(Succeed())
+		Expect(netAttDef.Annotations).To(HaveKeyWithValue(netAttDefOwnerAnnotation, "reservation/default/keep-n3"))
+
+		pod := newTestPod("pod-1", subnetRequest)
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(pod.Annotations[sriovNetworksAnnotation]).To(ContainSubstring("100.100.100.101/24"))
+
+		explicit := newTestPod("pod-2", `{"subnet": "100.100.100.0/24", "ippool": [{"name": "n3", "address": "100.100.100.100"}]}`)
+		Expect(ipManager.AllocatePodIP(explicit, &testTransactionTimestamp, true)).To(MatchError("address 100.100.100.100 is already held by reservation/default/keep-n3"))
+
+		_, err = ipManager.Reserve(reservation, subnetRequest)
+		Expect(err).To(MatchError("reservation default/keep-n3 already exists"))
+	})
+
+	It("should survive a restart of the manager", func() {
+		_, err := ipManager.Reserve(reservation, `{"subnet": "100.100.100.0/24", "ippool": [{"name": "keep-n3", "address": "100.100.100.150"}]}`)
+		Expect(err).ToNot(HaveOccurred())
+
+		// the reservation is rebuilt from its NetworkAttachmentDefinition alone, as before the ledger was written
+		Expect(ipManager.kubeClient.DeleteAllOf(context.TODO(), &corev1.ConfigMap{}, client.InNamespace("kubeipfixed-system"), client.MatchingLabels{ledgerLabel: "true"})).To(Succeed())
+		Expect(ipManager.InitMaps()).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(HaveKeyWithValue("100.100.100.150", ipEntry{
+			instanceName: "reservation/default/keep-n3",
+			poolName:     "sriov-n3",
+			netAttDef:    types.NamespacedName{Namespace: "default", Name: "keep-n3"},
+		}))
+	})
+
+	It("should refuse to reserve from a shared pool", func() {
+		pool := newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"})
+		pool.Spec.NetAttDefMode = ippoolv1alpha1.NetAttDefModeShared
+		ipManager = createTestIPManager(pool)
+
+		_, err := ipManager.Reserve(reservation, subnetRequest)
+		Expect(err).To(MatchError("the addresses of the shared ip pool sriov-n3 can not be reserved"))
+	})
+
+	It("should release a reservation but not the address of a workload", func() {
+		_, err := ipManager.Reserve(reservation, subnetRequest)
+		Expect(err).ToNot(HaveOccurred())
+		pod := newTestPod("pod-1", subnetRequest)
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+
+		_, err = ipManager.Release("100.100.100.101/24")
+		Expect(err).To(MatchError("address 100.100.100.101 is held by pod/default/pod-1, it is released with its workload"))
+		_, err = ipManager.Release("100.100.100.102")
+		Expect(err).To(MatchError("address 100.100.100.102 is not allocated"))
+
+		released, err := ipManager.Release("100.100.100.100")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(released).To(HaveLen(1))
+		Expect(ipManager.ipPoolMap).ToNot(HaveKey("100.100.100.100"))
+		err = ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-100"}, &netattdefv1.NetworkAttachmentDefinition{})
+		Expect(err).To(HaveOccurred())
+	})
+
+	Context("when the reservation is made by another process", func() {
+		var other *IPManager
+		netAttDefName := types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-100"}
+
+		BeforeEach(func() {
+			var err error
+			other, err = NewIPManager(ipManager.kubeClient, ipManager.cachedKubeClient, "kubeipfixed-system", false, 600, ipManager.Scheme, nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = other.Reserve(reservation, subnetRequest)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("should track it from its NetworkAttachmentDefinition", func() {
+			netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+			Expect(ipManager.kubeClient.Get(context.TODO(), netAttDefName, netAttDef)).To(Succeed())
+
+			Expect(ipManager.SyncReservation(netAttDefName, netAttDef)).To(Succeed())
+			Expect(ipManager.ipPoolMap["100.100.100.100"].instanceName).To(Equal("reservation/default/keep-n3"))
+
+			Expect(ipManager.SyncReservation(netAttDefName, nil)).To(Succeed())
+			Expect(ipManager.ipPoolMap).ToNot(HaveKey("100.100.100.100"))
+		})
+
+		It("should keep the reserved address from the workloads before tracking it", func() {
+			pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "ippool": [{"name": "n3", "address": "100.100.100.100"}]}`)
+			Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(MatchError("address 100.100.100.100 is already held by reservation/default/keep-n3"))
+			Expect(ipManager.ipPoolMap["100.100.100.100"].instanceName).To(Equal("reservation/default/keep-n3"))
+		})
+
+		It("should not hand over an address held by a workload", func() {
+			ipManager.ipPoolMap.createOrUpdateEntry("100.100.100.100", ipEntry{instanceName: "pod/default/pod-1", poolName: "sriov-n3"})
+
+			netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+			Expect(ipManager.kubeClient.Get(context.TODO(), netAttDefName, netAttDef)).To(Succeed())
+			Expect(ipManager.SyncReservation(netAttDefName, netAttDef)).To(MatchError("address 100.100.100.100 is already held by pod/default/pod-1"))
+			Expect(ipManager.ipPoolMap["100.100.100.100"].instanceName).To(Equal("pod/default/pod-1"))
+		})
+	})
+})
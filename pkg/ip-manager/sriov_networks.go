@@ -2,39 +2,199 @@ package ip_manager
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"text/template"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
 	uns "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
 )
 
-var ManifestsPath = "./bindata/manifests/cni-config"
-
 type sriovNetwork struct {
-	subnet       string           `json:"subnet"`
-	resourceName string           `json:"resourcename"`
-	ipPool       []sriovIpAddress `json:"ippool,omitempty"`
+	Subnet       string           `json:"subnet"`
+	ResourceName string           `json:"resourcename"`
+	IPPool       []sriovIpAddress `json:"ippool,omitempty"`
+	// Subnet6 is the IPv6 subnet of a dual-stack network
+	Subnet6 string `json:"subnet6,omitempty"`
 }
 
 type sriovIpAddress struct {
-	Name        string `json:"name"`
-	Namespace   string `json:"namespace,omitempty"`
-	Address     string `json:"address"`
-	Gateway     string `json:"gateway"`
-	Nameservers string `json:"nameservers,omitempty"`
-	Vlan        int    `json:"vlan,omitempty"`
-	VlanQoS     int    `json:"vlanQoS,omitempty"`
-	SpoofChk    string `json:"spoofChk,omitempty"`
-	Trust       string `json:"trust,omitempty"`
-	LinkState   string `json:"linkState,omitempty"`
-	MinTxRate   *int   `json:"minTxRate,omitempty"`
-	MaxTxRate   *int   `json:"maxTxRate,omitempty"`
+	Name        string         `json:"name"`
+	Namespace   string         `json:"namespace,omitempty"`
+	Address     string         `json:"address"`
+	Gateway     string         `json:"gateway"`
+	Nameservers nameserverList `json:"nameservers,omitempty"`
+	Vlan        int            `json:"vlan,omitempty"`
+	VlanQoS     int            `json:"vlanQoS,omitempty"`
+	SpoofChk    string         `json:"spoofChk,omitempty"`
+	Trust       string         `json:"trust,omitempty"`
+	LinkState   string         `json:"linkState,omitempty"`
+	MinTxRate   *int           `json:"minTxRate,omitempty"`
+	MaxTxRate   *int           `json:"maxTxRate,omitempty"`
+	// Interface is the name of the interface inside the workload, e.g. the guest nic name of a virtual machine
+	Interface string `json:"interface,omitempty"`
+	// Shared is set when the address is passed at runtime to the NetworkAttachmentDefinition shared by its pool
+	Shared bool `json:"shared,omitempty"`
+	// Address6 and Gateway6 are the IPv6 side of a dual-stack entry, configured on the same interface as Address
+	Address6 string `json:"address6,omitempty"`
+	Gateway6 string `json:"gateway6,omitempty"`
+	// Search domains of the resolver
+	Search []string `json:"search,omitempty"`
+	// Routes are the static routes of the interface
+	Routes []ippoolv1alpha1.Route `json:"routes,omitempty"`
+	// CNIType is the plugin attaching the interface, sriov when empty. Master, Mode and Bridge are the settings of
+	// the other types, see ippoolv1alpha1.IPPoolSpec.
+	CNIType ippoolv1alpha1.CNIType `json:"cniType,omitempty"`
+	Master  string                 `json:"master,omitempty"`
+	Mode    string                 `json:"mode,omitempty"`
+	Bridge  string                 `json:"bridge,omitempty"`
+	// MAC is the fixed MAC address of the interface, requested or allocated from the MAC range of the pool
+	MAC string `json:"mac,omitempty"`
+}
+
+// cniType returns the plugin attaching the interface of the entry
+func (si *sriovIpAddress) cniType() ippoolv1alpha1.CNIType {
+	if si.CNIType == "" {
+		return ippoolv1alpha1.CNITypeSriov
+	}
+	return si.CNIType
+}
+
+// cniTypes are the CNI plugins a NetworkAttachmentDefinition template is shipped for
+var cniTypes = []ippoolv1alpha1.CNIType{
+	ippoolv1alpha1.CNITypeSriov,
+	ippoolv1alpha1.CNITypeMacvlan,
+	ippoolv1alpha1.CNITypeIPVlan,
+	ippoolv1alpha1.CNITypeHostDevice,
+	ippoolv1alpha1.CNITypeOvs,
+}
+
+func isSupportedCNIType(cniType ippoolv1alpha1.CNIType) bool {
+	for _, supported := range cniTypes {
+		if cniType == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// cniConfigTemplate returns the default template rendering the NetworkAttachmentDefinitions of a cni type,
+// e.g. macvlan-cni-config.yaml
+func cniConfigTemplate(cniType ippoolv1alpha1.CNIType) string {
+	return fmt.Sprintf("%s-cni-config.yaml", cniType)
+}
+
+// nameserverList is given as a json list or, like in the first versions of the annotation, as a comma separated string
+type nameserverList []string
+
+func (n *nameserverList) UnmarshalJSON(data []byte) error {
+	list := []string{}
+	if err := json.Unmarshal(data, &list); err == nil {
+		*n = list
+		return nil
+	}
+
+	value := ""
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("nameservers must be a list or a comma separated string: %v", err)
+	}
+	*n = nil
+	for _, nameserver := range strings.Split(value, ",") {
+		if nameserver = strings.TrimSpace(nameserver); nameserver != "" {
+			*n = append(*n, nameserver)
+		}
+	}
+	return nil
 }
 
-// RenderNetAttDef renders a net-att-def for sriov CNI
-func (si *sriovIpAddress) RenderNetAttDef(resourceName string) (*uns.Unstructured, error) {
+// netAttDefKey returns the NetworkAttachmentDefinition owned by the address, none for the shared ones
+func (si *sriovIpAddress) netAttDefKey() types.NamespacedName {
+	if si.Shared {
+		return types.NamespacedName{}
+	}
+	return types.NamespacedName{Namespace: si.Namespace, Name: si.Name}
+}
+
+// addresses returns the addresses of the entry, the IPv6 one of a dual-stack entry last
+func (si *sriovIpAddress) addresses() []string {
+	addresses := []string{si.Address}
+	if si.Address6 != "" {
+		addresses = append(addresses, si.Address6)
+	}
+	return addresses
+}
+
+// ipamAddress is an address of the static ipam with its own gateway
+type ipamAddress struct {
+	Address string
+	Gateway string
+}
+
+// ipamRoute is a route of the static ipam, Gw is optional
+type ipamRoute struct {
+	Dst string
+	Gw  string
+}
+
+// ipamAddresses returns the addresses configured by the static ipam of a per address NetworkAttachmentDefinition
+func (si *sriovIpAddress) ipamAddresses() []ipamAddress {
+	addresses := []ipamAddress{{Address: si.Address, Gateway: si.Gateway}}
+	if si.Address6 != "" {
+		addresses = append(addresses, ipamAddress{Address: si.Address6, Gateway: si.Gateway6})
+	}
+	return addresses
+}
+
+// ipamRoutes returns the routes of the static ipam: the default routes of a shared NetworkAttachmentDefinition, one per
+// gateway family, followed by the static routes of the entry
+func (si *sriovIpAddress) ipamRoutes() []ipamRoute {
+	routes := []ipamRoute{}
+	for _, gateway := range []string{si.Gateway, si.Gateway6} {
+		if !si.Shared || gateway == "" {
+			continue
+		}
+		dst := "0.0.0.0/0"
+		if ip := net.ParseIP(gateway); ip != nil && ip.To4() == nil {
+			dst = "::/0"
+		}
+		routes = append(routes, ipamRoute{Dst: dst, Gw: gateway})
+	}
+	for _, route := range si.Routes {
+		routes = append(routes, ipamRoute{Dst: route.Dst, Gw: route.Gw})
+	}
+	return routes
+}
+
+// RenderNetAttDef renders a net-att-def for the CNI type of the address with the template of its pool, see cniTemplates
+func (si *sriovIpAddress) RenderNetAttDef(resourceName string, tmpl *template.Template) (*uns.Unstructured, error) {
 	logger := log.WithName("renderNetAttDef")
-	logger.Info("Start to render SRIOV CNI NetworkAttachementDefinition")
+	logger.Info("Start to render CNI NetworkAttachementDefinition", "cniType", si.cniType(), "template", tmpl.Name())
 	// render RawCNIConfig manifests
+	data := si.renderData(resourceName)
+	objs, err := renderParsedTemplate(tmpl, &data)
+	if err != nil {
+		return nil, err
+	}
+	if len(objs) == 0 {
+		return nil, fmt.Errorf("template %s rendered no NetworkAttachementDefinition", tmpl.Name())
+	}
+	for _, obj := range objs {
+		raw, _ := json.Marshal(obj)
+		logger.Info("render NetworkAttachementDefinition output", "raw", string(raw))
+	}
+	return objs[0], nil
+}
+
+// renderData returns the data available to the NetworkAttachmentDefinition templates
+func (si *sriovIpAddress) renderData(resourceName string) RenderData {
 	data := MakeRenderData()
-	data.Data["CniType"] = "sriov"
+	data.Data["CniType"] = string(si.cniType())
+	data.Data["CniMaster"] = si.Master
+	data.Data["CniMode"] = si.Mode
+	data.Data["CniBridge"] = si.Bridge
+	data.Data["CniMac"] = si.MAC
 	data.Data["SriovNetworkName"] = si.Name
 	data.Data["SriovNetworkNamespace"] = si.Namespace
 
@@ -96,17 +256,12 @@ func (si *sriovIpAddress) RenderNetAttDef(resourceName string) (*uns.Unstructure
 		}
 	}
 
-	data.Data["SriovCniAddress"] = si.Address
-	data.Data["SriovCniGateway"] = si.Gateway
-	data.Data["SriovCniNameservers"] = si.Nameservers
+	data.Data["SharedNetAttDef"] = si.Shared
+	data.Data["SriovCniAddress"] = strings.Join(si.addresses(), ",")
+	data.Data["SriovCniIPAMAddresses"] = si.ipamAddresses()
+	data.Data["SriovCniRoutes"] = si.ipamRoutes()
+	data.Data["SriovCniNameservers"] = []string(si.Nameservers)
+	data.Data["SriovCniSearch"] = si.Search
 
-	objs, err := RenderDir(ManifestsPath, &data)
-	if err != nil {
-		return nil, err
-	}
-	for _, obj := range objs {
-		raw, _ := json.Marshal(obj)
-		logger.Info("render NetworkAttachementDefinition output", "raw", string(raw))
-	}
-	return objs[0], nil
+	return data
 }
@@ -0,0 +1,100 @@
+package ip_manager
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	uns "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+var _ = Describe("NetworkAttachmentDefinition rendering", func() {
+	var templates *cniTemplates
+
+	BeforeEach(func() {
+		var err error
+		templates, err = newCNITemplates()
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	renderConfig := func(address *sriovIpAddress, resourceName string) (map[string]string, map[string]interface{}) {
+		tmpl, err := templates.lookup("", address.cniType())
+		Expect(err).ToNot(HaveOccurred())
+		obj, err := address.RenderNetAttDef(resourceName, tmpl)
+		Expect(err).ToNot(HaveOccurred())
+		config, _, err := uns.NestedString(obj.Object, "spec", "config")
+		Expect(err).ToNot(HaveOccurred())
+		parsed := map[string]interface{}{}
+		Expect(json.Unmarshal([]byte(config), &parsed)).To(Succeed())
+		return obj.GetAnnotations(), parsed
+	}
+
+	newAddress := func(cniType ippoolv1alpha1.CNIType) *sriovIpAddress {
+		return &sriovIpAddress{
+			Name:        "n3",
+			Namespace:   "default",
+			Address:     "100.100.100.150/24",
+			Gateway:     "100.100.100.1",
+			Nameservers: nameserverList{"8.8.8.8"},
+			CNIType:     cniType,
+		}
+	}
+
+	DescribeTable("should render the cni config of the type",
+		func(address *sriovIpAddress, resourceName string, expected map[string]interface{}) {
+			annotations, config := renderConfig(address, resourceName)
+			for key, value := range expected {
+				Expect(config).To(HaveKeyWithValue(key, value))
+			}
+			Expect(config["ipam"]).To(HaveKeyWithValue("addresses",
+				[]interface{}{map[string]interface{}{"address": "100.100.100.150/24", "gateway": "100.100.100.1"}}))
+			Expect(annotations).To(HaveKeyWithValue(netAttDefAddressAnnotation, "100.100.100.150/24"))
+			if resourceName == "" {
+				Expect(annotations).ToNot(HaveKey(netAttDefResourceNameAnnotation))
+			}
+		},
+		Entry("sriov by default", newAddress(""), "mecdev.com/intel2v2nics",
+			map[string]interface{}{"type": "sriov", "vlan": float64(0)}),
+		Entry("macvlan", func() *sriovIpAddress {
+			address := newAddress(ippoolv1alpha1.CNITypeMacvlan)
+			address.Master, address.Mode = "eth1", "bridge"
+			return address
+		}(), "", map[string]interface{}{"type": "macvlan", "master": "eth1", "mode": "bridge"}),
+		Entry("ipvlan", func() *sriovIpAddress {
+			address := newAddress(ippoolv1alpha1.CNITypeIPVlan)
+			address.Master, address.Mode = "eth1", "l3"
+			return address
+		}(), "", map[string]interface{}{"type": "ipvlan", "master": "eth1", "mode": "l3"}),
+		Entry("host-device", func() *sriovIpAddress {
+			address := newAddress(ippoolv1alpha1.CNITypeHostDevice)
+			address.Master = "ens2f0"
+			return address
+		}(), "", map[string]interface{}{"type": "host-device", "device": "ens2f0"}),
+		Entry("host-device from a device plugin", newAddress(ippoolv1alpha1.CNITypeHostDevice), "mecdev.com/intel2v2nics",
+			map[string]interface{}{"type": "host-device"}),
+		Entry("ovs", func() *sriovIpAddress {
+			address := newAddress(ippoolv1alpha1.CNITypeOvs)
+			address.Bridge, address.Vlan = "br1", 100
+			return address
+		}(), "", map[string]interface{}{"type": "ovs", "bridge": "br1", "vlan": float64(100)}),
+	)
+
+	It("should render a shared NetworkAttachmentDefinition without device plugin resource", func() {
+		address := newAddress(ippoolv1alpha1.CNITypeMacvlan)
+		address.Master, address.Shared = "eth1", true
+
+		annotations, config := renderConfig(address, "")
+		Expect(annotations).To(BeEmpty())
+		Expect(config).To(HaveKeyWithValue("capabilities", map[string]interface{}{"ips": true}))
+		Expect(config).To(HaveKeyWithValue("master", "eth1"))
+	})
+
+	It("should refuse a cni type without template", func() {
+		_, err := templates.lookup("", newAddress("../sriov").cniType())
+		Expect(err).To(MatchError(`unsupported cni type "../sriov"`))
+	})
+})
@@ -0,0 +1,154 @@
+package ip_manager
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const statefulSetInstancePrefix = "statefulset/"
+
+// statefulSetIdentity returns the identity a StatefulSet pod keeps across evictions and rolling updates,
+// statefulset/<namespace>/<name>/<uid>/<ordinal>, empty for the pods not owned by a StatefulSet
+func statefulSetIdentity(pod *corev1.Pod) string {
+	for _, ref := range pod.OwnerReferences {
+		if ref.Kind != "StatefulSet" || ref.Controller == nil || !*ref.Controller {
+			continue
+		}
+		ordinal, err := strconv.Atoi(strings.TrimPrefix(pod.Name, ref.Name+"-"))
+		if err != nil || !strings.HasPrefix(pod.Name, ref.Name+"-") {
+			return ""
+		}
+		return fmt.Sprintf("%s%s/%s/%s/%d", statefulSetInstancePrefix, pod.Namespace, ref.Name, ref.UID, ordinal)
+	}
+	return ""
+}
+
+// parseStatefulSetIdentity splits a StatefulSet identity into the StatefulSet, its uid and the ordinal
+func parseStatefulSetIdentity(instanceName string) (types.NamespacedName, types.UID, int, bool) {
+	if !strings.HasPrefix(instanceName, statefulSetInstancePrefix) {
+		return types.NamespacedName{}, "", 0, false
+	}
+	parts := strings.Split(strings.TrimPrefix(instanceName, statefulSetInstancePrefix), "/")
+	if len(parts) != 4 {
+		return types.NamespacedName{}, "", 0, false
+	}
+	ordinal, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return types.NamespacedName{}, "", 0, false
+	}
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, types.UID(parts[2]), ordinal, true
+}
+
+// reuseStatefulSetIPs completes the networks with the addresses already held by the StatefulSet identity, so a
+// rescheduled StatefulSet pod gets the address of its predecessor. It returns true when the networks were completed.
+func (p *IPManager) reuseStatefulSetIPs(networks *sriovNetwork, instanceName, defaultNamespace string) (bool, error) {
+	held := p.ipPoolMap.filterByInstanceName(instanceName)
+	if len(held) == 0 {
+		return false, nil
+	}
+
+	ips := []string{}
+	for ip := range held {
+		ips = append(ips, ip)
+	}
+	sortIPs(ips)
+
+	err := p.completeWithPoolAddresses(networks, ips, defaultNamespace)
+	if err != nil {
+		return false, err
+	}
+	log.Info("reusing sticky ips", "instanceName", instanceName, "addresses", ips)
+	return len(networks.IPPool) != 0, nil
+}
+
+// ReleaseStatefulSetIPs releases the addresses of the StatefulSet identities that are gone: all of them when the
+// StatefulSet was deleted (statefulSet is nil), the ones of a previous StatefulSet with the same name, and the
+// ordinals at or above the replicas once their pod is gone.
+func (p *IPManager) ReleaseStatefulSetIPs(name types.NamespacedName, statefulSet *appsv1.StatefulSet) error {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	return p.releaseStatefulSetIPs(name, statefulSet)
+}
+
+func (p *IPManager) releaseStatefulSetIPs(name types.NamespacedName, statefulSet *appsv1.StatefulSet) error {
+	toRelease := map[string]ipMap{}
+	for ip, entry := range p.ipPoolMap {
+		owner, uid, ordinal, ok := parseStatefulSetIdentity(entry.instanceName)
+		if !ok || owner != name {
+			continue
+		}
+
+		if statefulSet != nil && statefulSet.UID == uid {
+			replicas := int32(1)
+			if statefulSet.Spec.Replicas != nil {
+				replicas = *statefulSet.Spec.Replicas
+			}
+			if int32(ordinal) < replicas {
+				continue
+			}
+
+			// the pod of a removed ordinal may still be terminating, keep its address until it is gone
+			pod := &corev1.Pod{}
+			err := p.cachedKubeClient.Get(context.TODO(), types.NamespacedName{Namespace: name.Namespace, Name: fmt.Sprintf("%s-%d", name.Name, ordinal)}, pod)
+			if err == nil {
+				continue
+			}
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+		}
+
+		if toRelease[entry.instanceName] == nil {
+			toRelease[entry.instanceName] = ipMap{}
+		}
+		toRelease[entry.instanceName].createOrUpdateEntry(ip, entry)
+	}
+
+	for instanceName, allocations := range toRelease {
+		err := p.releaseAllocations(instanceName, allocations)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseOrphanedStatefulSetIPs releases the sticky addresses of the StatefulSets removed while kubeipfixed was down
+func (p *IPManager) releaseOrphanedStatefulSetIPs() error {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	owners := map[types.NamespacedName]bool{}
+	for _, entry := range p.ipPoolMap {
+		if owner, _, _, ok := parseStatefulSetIdentity(entry.instanceName); ok {
+			owners[owner] = true
+		}
+	}
+
+	for owner := range owners {
+		statefulSet := &appsv1.StatefulSet{}
+		err := p.cachedKubeClient.Get(context.TODO(), owner, statefulSet)
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+			statefulSet = nil
+		}
+
+		err = p.releaseStatefulSetIPs(owner, statefulSet)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package ip_manager
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+func newTestStatefulSet(name string, uid types.UID, replicas int32) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: uid},
+		Spec:       appsv1.StatefulSetSpec{Replicas: &replicas},
+	}
+}
+
+func newTestStatefulSetPod(statefulSet *appsv1.StatefulSet, name string) *corev1.Pod {
+	isController := true
+	pod := newTestPod(name, `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+	pod.OwnerReferences = []metav1.OwnerReference{{
+		APIVersion: "apps/v1",
+		Kind:       "StatefulSet",
+		Name:       statefulSet.Name,
+		UID:        statefulSet.UID,
+		Controller: &isController,
+	}}
+	return pod
+}
+
+var _ = Describe("StatefulSet IP", func() {
+	var ipManager *IPManager
+	statefulSet := newTestStatefulSet("web", "uid-1", 4)
+
+	BeforeEach(func() {
+		ipManager = createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}))
+	})
+
+	allocate := func(pod *corev1.Pod) string {
+		ExpectWithOffset(1, ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		ExpectWithOffset(1, ipManager.MarkPodAsReady(pod)).To(Succeed())
+		networks, err := parsePodNetworkAnnotation(pod.Annotations[sriovNetworksAnnotation], pod.Namespace)
+		ExpectWithOffset(1, err).ToNot(HaveOccurred())
+		return networks.IPPool[0].Address
+	}
+
+	It("should key the identity on the owner uid and the ordinal", func() {
+		instanceName, _, err := ipManager.podInstanceName(newTestStatefulSetPod(statefulSet, "web-3"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(instanceName).To(Equal("statefulset/default/web/uid-1/3"))
+		instanceName, _, err = ipManager.podInstanceName(newTestPod("web-3", ""))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(instanceName).To(Equal("pod/default/web-3"))
+
+		owner, uid, ordinal, ok := parseStatefulSetIdentity("statefulset/default/web/uid-1/3")
+		Expect(ok).To(BeTrue())
+		Expect(owner).To(Equal(types.NamespacedName{Namespace: "default", Name: "web"}))
+		Expect(uid).To(Equal(types.UID("uid-1")))
+		Expect(ordinal).To(Equal(3))
+	})
+
+	It("should give a rescheduled pod the ip of its predecessor", func() {
+		address := allocate(newTestStatefulSetPod(statefulSet, "web-3"))
+
+		deleted := newTestStatefulSetPod(statefulSet, "web-3")
+		Expect(ipManager.ReleasePodIPs(deleted)).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(HaveKey("100.100.100.100"))
+
+		Expect(allocate(newTestPod("other", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`))).ToNot(Equal(address))
+		Expect(allocate(newTestStatefulSetPod(statefulSet, "web-3"))).To(Equal(address))
+		Expect(ipManager.ipPoolMap["100.100.100.100"].isPending()).To(BeFalse())
+	})
+
+	It("should keep the ip of a recreated pod committed when its admission is denied", func() {
+		defer func() { now = time.Now }()
+		allocate(newTestStatefulSetPod(statefulSet, "web-3"))
+
+		denied := newTestStatefulSetPod(statefulSet, "web-3")
+		Expect(ipManager.AllocatePodIP(denied, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(ipManager.ipPoolMap["100.100.100.100"].isPending()).To(BeFalse())
+
+		now = func() time.Time {
+			return testTransactionTimestamp.Add(time.Duration(ipManager.waitTime+1) * time.Second)
+		}
+		ipManager.rollbackExpiredTransactions()
+		Expect(ipManager.ipPoolMap).To(HaveKey("100.100.100.100"))
+		netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+		Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-100"}, netAttDef)).To(Succeed())
+	})
+
+	It("should release the ordinals removed by a scale down once their pod is gone", func() {
+		allocate(newTestStatefulSetPod(statefulSet, "web-2"))
+		allocate(newTestStatefulSetPod(statefulSet, "web-3"))
+
+		remaining := newTestStatefulSetPod(statefulSet, "web-3")
+		Expect(ipManager.kubeClient.Create(context.TODO(), remaining)).To(Succeed())
+		Expect(ipManager.ReleaseStatefulSetIPs(types.NamespacedName{Namespace: "default", Name: "web"}, newTestStatefulSet("web", "uid-1", 3))).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(HaveLen(2))
+
+		Expect(ipManager.kubeClient.Delete(context.TODO(), remaining)).To(Succeed())
+		Expect(ipManager.ReleaseStatefulSetIPs(types.NamespacedName{Namespace: "default", Name: "web"}, newTestStatefulSet("web", "uid-1", 3))).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(HaveLen(1))
+		Expect(ipManager.ipPoolMap["100.100.100.100"].instanceName).To(Equal("statefulset/default/web/uid-1/2"))
+	})
+
+	It("should release all the ips of a deleted or replaced statefulset", func() {
+		allocate(newTestStatefulSetPod(statefulSet, "web-0"))
+		Expect(ipManager.ReleaseStatefulSetIPs(types.NamespacedName{Namespace: "default", Name: "web"}, newTestStatefulSet("web", "uid-2", 4))).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(BeEmpty())
+
+		allocate(newTestStatefulSetPod(statefulSet, "web-0"))
+		Expect(ipManager.ReleaseStatefulSetIPs(types.NamespacedName{Namespace: "default", Name: "web"}, nil)).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(BeEmpty())
+		Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-100"}, &netattdefv1.NetworkAttachmentDefinition{})).ToNot(Succeed())
+	})
+
+	It("should keep the sticky ips of existing statefulsets across restarts", func() {
+		allocate(newTestStatefulSetPod(statefulSet, "web-0"))
+		netAttDef := &netattdefv1.NetworkAttachmentDefinition{}
+		Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "sriov-n3-static-100-100-100-100"}, netAttDef)).To(Succeed())
+		Expect(netAttDef.Annotations).To(HaveKeyWithValue(netAttDefOwnerAnnotation, "statefulset/default/web/uid-1/0"))
+
+		restarted := createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24"), netAttDef.DeepCopy(), newTestStatefulSet("web", "uid-1", 1))
+		Expect(restarted.Start()).To(Succeed())
+		Expect(restarted.InitLeader(context.TODO())).To(Succeed())
+		Expect(restarted.ipPoolMap).To(HaveKey("100.100.100.100"))
+		Expect(restarted.ipPoolMap["100.100.100.100"].isPending()).To(BeFalse())
+
+		netAttDef.ResourceVersion = ""
+		orphaned := createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24"), netAttDef.DeepCopy())
+		Expect(orphaned.Start()).To(Succeed())
+		Expect(orphaned.ipPoolMap).To(HaveKey("100.100.100.100"))
+		Expect(orphaned.InitLeader(context.TODO())).To(Succeed())
+		Expect(orphaned.ipPoolMap).To(BeEmpty())
+	})
+})
@@ -0,0 +1,250 @@
+package ip_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	kubevirt "kubevirt.io/api/core/v1"
+)
+
+// networkStatus is the resolved allocation of an entry of the sriovnetworks annotation, the StatusAnnotation lists
+// one per entry
+type networkStatus struct {
+	// NetAttDef is the NetworkAttachmentDefinition attaching the address, namespace/name
+	NetAttDef string `json:"netAttDef"`
+	// Interface is the interface of the pod, e.g. net1, the requested one until multus reports it, or the interface
+	// of the virtual machine spec, e.g. sriov-net0
+	Interface string `json:"interface,omitempty"`
+	Address   string `json:"address"`
+	Gateway   string `json:"gateway,omitempty"`
+	Address6  string `json:"address6,omitempty"`
+	Gateway6  string `json:"gateway6,omitempty"`
+	// MAC and IPs are the ones the interface actually got, as reported by multus, see UpdatePodNetworkStatus, MAC is
+	// the fixed MAC of the entry until then
+	MAC string   `json:"mac,omitempty"`
+	IPs []string `json:"ips,omitempty"`
+	// Mismatch is set when the interface did not get the fixed addresses
+	Mismatch bool `json:"mismatch,omitempty"`
+}
+
+// fixedIPs returns the fixed addresses of the entry without their prefix length
+func (s *networkStatus) fixedIPs() []string {
+	ips := []string{}
+	for _, address := range []string{s.Address, s.Address6} {
+		if address == "" {
+			continue
+		}
+		if ip, err := addressKey(address); err == nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// hasIP returns true when one of the runtime addresses, given with or without prefix length, is the ip
+func hasIP(runtimeIPs []string, ip string) bool {
+	for _, runtimeIP := range runtimeIPs {
+		if key, err := addressKey(runtimeIP); err == nil && key == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// networksStatus renders the StatusAnnotation of the networks, interfaceName gives the interface of an entry
+func networksStatus(networks *sriovNetwork, interfaceName func(address sriovIpAddress) string) (string, error) {
+	statuses := []networkStatus{}
+	for _, network := range networks.IPPool {
+		statuses = append(statuses, networkStatus{
+			NetAttDef: fmt.Sprintf("%s/%s", network.Namespace, network.Name),
+			Interface: interfaceName(network),
+			Address:   network.Address,
+			Gateway:   network.Gateway,
+			Address6:  network.Address6,
+			Gateway6:  network.Gateway6,
+			MAC:       network.MAC,
+		})
+	}
+
+	value, err := json.Marshal(statuses)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// podInterfaceName returns the interface multus attaches the entry to, see mergeMultusNetworks
+func podInterfaceName(elements []*netattdefv1.NetworkSelectionElement) func(address sriovIpAddress) string {
+	return func(address sriovIpAddress) string {
+		if element := findMultusNetwork(elements, address); element != nil {
+			return element.InterfaceRequest
+		}
+		return address.Interface
+	}
+}
+
+// vmInterfaceName returns the interface of the virtual machine spec attached to the multus network of the entry
+func vmInterfaceName(vmNetworks []kubevirt.Network) func(address sriovIpAddress) string {
+	return func(address sriovIpAddress) string {
+		multusNetworkName := fmt.Sprintf("%s/%s", address.Namespace, address.Name)
+		for _, vmNetwork := range vmNetworks {
+			if vmNetwork.Multus != nil && vmNetwork.Multus.NetworkName == multusNetworkName {
+				return vmNetwork.Name
+			}
+		}
+		return ""
+	}
+}
+
+// UpdatePodNetworkStatus completes the StatusAnnotation of a pod with the interface, MAC and addresses reported by multus
+// in the network-status annotation once the networks of the pod sandbox are attached. An interface that did not get
+// its fixed addresses is flagged as a mismatch and reported by a warning Event. It returns true when the annotation
+// changed and has to be written back to the pod.
+func (p *IPManager) UpdatePodNetworkStatus(pod *corev1.Pod) (bool, error) {
+	statusValue, ok := pod.Annotations[StatusAnnotation]
+	if !ok {
+		return false, nil
+	}
+	runtimeValue, ok := pod.Annotations[netattdefv1.NetworkStatusAnnot]
+	if !ok {
+		return false, nil
+	}
+
+	statuses := []networkStatus{}
+	err := json.Unmarshal([]byte(statusValue), &statuses)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to parse the %s annotation", StatusAnnotation)
+	}
+	runtimeStatuses := []netattdefv1.NetworkStatus{}
+	err = json.Unmarshal([]byte(runtimeValue), &runtimeStatuses)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to parse the %s annotation", netattdefv1.NetworkStatusAnnot)
+	}
+
+	changed := false
+	observed := []networkStatus{}
+	for i := range statuses {
+		status := &statuses[i]
+		runtimeStatus := findNetworkStatus(runtimeStatuses, status)
+		if runtimeStatus == nil {
+			continue
+		}
+
+		updated := *status
+		if runtimeStatus.Interface != "" {
+			updated.Interface = runtimeStatus.Interface
+		}
+		updated.MAC = runtimeStatus.Mac
+		updated.IPs = runtimeStatus.IPs
+		updated.Mismatch = false
+		for _, ip := range status.fixedIPs() {
+			if !hasIP(runtimeStatus.IPs, ip) {
+				updated.Mismatch = true
+			}
+		}
+		observed = append(observed, updated)
+		if reflect.DeepEqual(updated, *status) {
+			continue
+		}
+
+		if updated.Mismatch && !status.Mismatch {
+			log.Info("the pod interface did not get its fixed ips", "podFullName", podNamespaced(pod), "interface", updated.Interface, "fixed", status.fixedIPs(), "runtime", updated.IPs)
+			p.recordEvent(pod, corev1.EventTypeWarning, eventReasonMismatch, "interface %s of %s got ips [%s] instead of the fixed [%s]",
+				updated.Interface, updated.NetAttDef, strings.Join(updated.IPs, ", "), strings.Join(status.fixedIPs(), ", "))
+		}
+		*status = updated
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+
+	err = p.recordObservedNetworks(observed)
+	if err != nil {
+		return false, err
+	}
+	value, err := json.Marshal(statuses)
+	if err != nil {
+		return false, err
+	}
+	pod.Annotations[StatusAnnotation] = string(value)
+	return true, nil
+}
+
+// recordObservedNetworks stores the interface and MAC reported by multus for the entries on their allocations
+func (p *IPManager) recordObservedNetworks(statuses []networkStatus) error {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	// observe records the observations on the allocations and returns the ones it changed
+	observe := func(allocations ipMap) ipMap {
+		changed := ipMap{}
+		for i := range statuses {
+			status := &statuses[i]
+			for _, ip := range status.fixedIPs() {
+				entry, exist := allocations[ip]
+				if !exist || !entry.isAttachedBy(status.NetAttDef) {
+					continue
+				}
+				if entry.interfaceName == status.Interface && entry.observedMAC == status.MAC {
+					continue
+				}
+				entry.interfaceName = status.Interface
+				entry.observedMAC = status.MAC
+				allocations.createOrUpdateEntry(ip, entry)
+				changed.createOrUpdateEntry(ip, entry)
+			}
+		}
+		return changed
+	}
+
+	// the ledger is only written when the observation is new to this replica
+	known := ipMap{}
+	for ip, entry := range p.ipPoolMap {
+		known[ip] = entry
+	}
+	changed := observe(known)
+	if len(changed) == 0 {
+		return nil
+	}
+	return p.updateLedger(changed, func(ledger, _ ipMap) error {
+		observe(ledger)
+		return nil
+	})
+}
+
+// findNetworkStatus returns the multus status of the interface attaching the entry. The entries sharing the
+// NetworkAttachmentDefinition of their pool are told apart by their address, then by their interface.
+func findNetworkStatus(runtimeStatuses []netattdefv1.NetworkStatus, status *networkStatus) *netattdefv1.NetworkStatus {
+	candidates := []*netattdefv1.NetworkStatus{}
+	for i := range runtimeStatuses {
+		if runtimeStatuses[i].Name == status.NetAttDef {
+			candidates = append(candidates, &runtimeStatuses[i])
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		return candidates[0]
+	}
+
+	for _, candidate := range candidates {
+		for _, ip := range status.fixedIPs() {
+			if hasIP(candidate.IPs, ip) {
+				return candidate
+			}
+		}
+	}
+	for _, candidate := range candidates {
+		if candidate.Interface == status.Interface {
+			return candidate
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package ip_manager
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+var _ = Describe("Status Annotation", func() {
+	var ipManager *IPManager
+
+	BeforeEach(func() {
+		ipManager = createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}))
+	})
+
+	It("should report the address, gateway, NetworkAttachmentDefinition and interface of the pod entries", func() {
+		pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [`+
+			`{"name": "n3", "address": "100.100.100.150/24", "gateway": "100.100.100.1"},`+
+			`{"name": "n6", "address": "100.100.100.151/24", "interface": "n6"}]}`)
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		Expect(pod.Annotations[StatusAnnotation]).To(MatchJSON(`[` +
+			`{"netAttDef": "default/n3", "interface": "net1", "address": "100.100.100.150/24", "gateway": "100.100.100.1"},` +
+			`{"netAttDef": "default/n6", "interface": "n6", "address": "100.100.100.151/24", "gateway": "100.100.100.1"}]`))
+	})
+
+	It("should report the address picked from the pool on dry-run requests too", func() {
+		pod := newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+		Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, false)).To(Succeed())
+		Expect(pod.Annotations[StatusAnnotation]).To(MatchJSON(`[` +
+			`{"netAttDef": "default/sriov-n3-static-100-100-100-100", "interface": "net1", "address": "100.100.100.100/24", "gateway": "100.100.100.1"}]`))
+	})
+
+	It("should report the interface of the virtual machine spec", func() {
+		vm := newTestVirtualMachine("vm-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+		patches, err := ipManager.AllocateVirtualMachineIP(vm, &testTransactionTimestamp, true)
+		Expect(err).ToNot(HaveOccurred())
+
+		annotations := patches[0].Value.(map[string]string)
+		Expect(annotations[StatusAnnotation]).To(MatchJSON(`[` +
+			`{"netAttDef": "default/sriov-n3-static-100-100-100-100", "interface": "sriov-net0", "address": "100.100.100.100/24", "gateway": "100.100.100.1"}]`))
+	})
+
+	Context("when multus reports the network status of the pod", func() {
+		const netAttDef = "default/sriov-n3-static-100-100-100-100"
+		var pod *corev1.Pod
+		var recorder *record.FakeRecorder
+
+		BeforeEach(func() {
+			recorder = record.NewFakeRecorder(10)
+			ipManager.recorder = recorder
+			pod = newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+			Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+		})
+
+		It("should wait for the network-status annotation", func() {
+			Expect(ipManager.UpdatePodNetworkStatus(pod)).To(BeFalse())
+		})
+
+		It("should record the interface, MAC and ips the pod got", func() {
+			pod.Annotations[netattdefv1.NetworkStatusAnnot] = `[` +
+				`{"name": "cbr0", "interface": "eth0", "ips": ["10.244.0.7"], "mac": "0a:58:0a:f4:00:07", "default": true},` +
+				`{"name": "` + netAttDef + `", "interface": "net1", "ips": ["100.100.100.100"], "mac": "6e:1c:2a:3b:4c:5d"}]`
+
+			Expect(ipManager.UpdatePodNetworkStatus(pod)).To(BeTrue())
+			Expect(pod.Annotations[StatusAnnotation]).To(MatchJSON(`[{"netAttDef": "` + netAttDef + `", "interface": "net1",` +
+				` "address": "100.100.100.100/24", "gateway": "100.100.100.1", "mac": "6e:1c:2a:3b:4c:5d", "ips": ["100.100.100.100"]}]`))
+
+			Expect(ipManager.UpdatePodNetworkStatus(pod)).To(BeFalse())
+			Expect(recorder.Events).To(BeEmpty())
+
+			// the other replicas see them in the ledger
+			Expect(ipManager.syncLedger(false)).To(Succeed())
+			allocation, err := ipManager.Whois("100.100.100.100")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allocation.Interface).To(Equal("net1"))
+			Expect(allocation.ObservedMAC).To(Equal("6e:1c:2a:3b:4c:5d"))
+		})
+
+		It("should flag the interface that did not get its fixed ip", func() {
+			pod.Annotations[netattdefv1.NetworkStatusAnnot] = `[{"name": "` + netAttDef + `", "interface": "net1", "ips": ["100.100.100.7"], "mac": "6e:1c:2a:3b:4c:5d"}]`
+
+			Expect(ipManager.UpdatePodNetworkStatus(pod)).To(BeTrue())
+			Expect(pod.Annotations[StatusAnnotation]).To(ContainSubstring(`"mismatch":true`))
+			Expect(recorder.Events).To(Receive(Equal("Warning IPMismatch interface net1 of " + netAttDef + " got ips [100.100.100.7] instead of the fixed [100.100.100.100]")))
+
+			// the mismatch is reported once
+			Expect(ipManager.UpdatePodNetworkStatus(pod)).To(BeFalse())
+			Expect(recorder.Events).To(BeEmpty())
+		})
+
+		It("should record the interface and MAC of the address of a pool sharing its NetworkAttachmentDefinition", func() {
+			pool := &ippoolv1alpha1.IPPool{}
+			Expect(ipManager.kubeClient.Get(context.TODO(), types.NamespacedName{Name: "sriov-n3"}, pool)).To(Succeed())
+			pool.Spec.NetAttDefMode = ippoolv1alpha1.NetAttDefModeShared
+			Expect(ipManager.kubeClient.Update(context.TODO(), pool)).To(Succeed())
+			pod = newTestPod("pod-2", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+			Expect(ipManager.AllocatePodIP(pod, &testTransactionTimestamp, true)).To(Succeed())
+			Expect(ipManager.MarkPodAsReady(pod)).To(Succeed())
+
+			pod.Annotations[netattdefv1.NetworkStatusAnnot] = `[{"name": "default/sriov-n3-shared", "interface": "net1", "ips": ["100.100.100.101"], "mac": "6e:1c:2a:3b:4c:5d"}]`
+			Expect(ipManager.UpdatePodNetworkStatus(pod)).To(BeTrue())
+			Expect(ipManager.ipPoolMap["100.100.100.101"].interfaceName).To(Equal("net1"))
+
+			Expect(ipManager.syncLedger(false)).To(Succeed())
+			allocation, err := ipManager.Whois("100.100.100.101")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(allocation.Interface).To(Equal("net1"))
+			Expect(allocation.ObservedMAC).To(Equal("6e:1c:2a:3b:4c:5d"))
+		})
+
+		It("should fail on a network-status annotation that is not valid json", func() {
+			pod.Annotations[netattdefv1.NetworkStatusAnnot] = `[{"name"`
+			_, err := ipManager.UpdatePodNetworkStatus(pod)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	It("should tell apart the interfaces attached by the same shared NetworkAttachmentDefinition by their ips", func() {
+		runtimeStatuses := []netattdefv1.NetworkStatus{
+			{Name: "default/sriov-n3", Interface: "net1", IPs: []string{"100.100.100.100/24"}, Mac: "6e:1c:2a:3b:4c:01"},
+			{Name: "default/sriov-n3", Interface: "net2", IPs: []string{"100.100.100.101/24"}, Mac: "6e:1c:2a:3b:4c:02"},
+		}
+		Expect(findNetworkStatus(runtimeStatuses, &networkStatus{NetAttDef: "default/sriov-n3", Interface: "net1", Address: "100.100.100.101/24"})).To(Equal(&runtimeStatuses[1]))
+		Expect(findNetworkStatus(runtimeStatuses, &networkStatus{NetAttDef: "default/sriov-n3", Interface: "net1", Address: "100.100.100.7/24"})).To(Equal(&runtimeStatuses[0]))
+		Expect(findNetworkStatus(runtimeStatuses, &networkStatus{NetAttDef: "default/other", Address: "100.100.100.100/24"})).To(BeNil())
+	})
+})
@@ -1,7 +1,10 @@
 package ip_manager
 
 import (
+	"context"
 	"time"
+
+	"github.com/wenwenxiong/kubeipfixed/pkg/metrics"
 )
 
 func CreateTransactionTimestamp() time.Time {
@@ -11,3 +14,96 @@ func CreateTransactionTimestamp() time.Time {
 func parseTransactionTimestamp(timeStampAnnotation string) (time.Time, error) {
 	return time.Parse(time.RFC3339Nano, timeStampAnnotation)
 }
+
+// RunPendingCleanup rolls back the allocations whose workload was not created within the wait time until the context
+// is done, e.g. because another webhook or a quota rejected it after kubeipfixed admitted it. It only runs on the
+// leader, which commits the allocations made by all the replicas.
+func (p *IPManager) RunPendingCleanup(ctx context.Context) error {
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+	log.Info("starting cleanup loop for pending ip allocations")
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			p.rollbackExpiredTransactions()
+		}
+	}
+}
+
+func (p *IPManager) rollbackExpiredTransactions() {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	// the pending allocations of the other replicas are mirrored from the ledger, they expire here as well
+	deadline := now().Add(-time.Duration(p.waitTime) * time.Second)
+	for ip, entry := range p.ipPoolMap.filterPendingOlderThan(deadline) {
+		log.Info("rolling back an allocation whose workload was not created", "instanceName", entry.instanceName, "address", ip, "transactionTimestamp", entry.transactionTimestamp)
+		err := p.deleteNetAttDef(entry.netAttDef)
+		metrics.Releases.WithLabelValues(metrics.Result(err), releaseReasonExpired).Inc()
+		if err != nil {
+			log.Error(err, "failed to remove the NetworkAttachmentDefinition of an expired allocation", "address", ip)
+			continue
+		}
+		err = p.releaseInLedger(ipMap{ip: entry})
+		if err != nil {
+			log.Error(err, "failed to release an expired allocation from the ledger", "address", ip)
+			continue
+		}
+		p.recordPoolEvents(entry.instanceName, eventReasonReleased, "rolled back the expired", ipMap{ip: entry})
+	}
+
+	// the addresses of an ip set handed to a pod that was not created go back to the set
+	reused := p.ipPoolMap.filterReusedOlderThan(deadline)
+	if len(reused) != 0 {
+		log.Info("freeing the ip set addresses whose pod was not created", "addresses", sortedIPs(reused))
+		err := p.claimInLedger(freedIPSetAddresses(reused))
+		if err != nil {
+			log.Error(err, "failed to free the expired ip set addresses in the ledger")
+		}
+	}
+}
+
+// commitAllocations turns the pending allocations of the instance created with the given transaction into committed
+// ones, it returns the newly committed addresses
+func (p *IPManager) commitAllocations(instanceName string, networks *sriovNetwork, transactionTimestamp time.Time) (ipMap, error) {
+	allocations, err := p.networksAllocations(instanceName, networks)
+	if err != nil {
+		return nil, err
+	}
+	// the allocation may have been made by another replica, the watch of the ledger may not have delivered it yet
+	err = p.mirrorLedgerShards(allocations)
+	if err != nil {
+		return nil, err
+	}
+
+	committed := ipMap{}
+
+	for ip, allocation := range allocations {
+		entry, exist := p.ipPoolMap[ip]
+		switch {
+		case !exist:
+			// the pending allocation was already rolled back, but the instance is there and uses the address
+			log.Info("re-reserving the ip of an instance created after its transaction expired", "instanceName", instanceName, "address", ip)
+			if p.ipPoolMap.claim(ip, allocation) == nil {
+				committed.createOrUpdateEntry(ip, allocation)
+			}
+		case entry.isPending() && entry.transactionTimestamp.Equal(transactionTimestamp):
+			entry.instanceName = instanceName
+			entry.transactionTimestamp = nil
+			p.ipPoolMap.createOrUpdateEntry(ip, entry)
+			committed.createOrUpdateEntry(ip, entry)
+			log.V(1).Info("committed ip", "instanceName", instanceName, "address", ip)
+		case entry.instanceName != instanceName:
+			log.Error(nil, "the ip is held by another instance", "instanceName", instanceName, "address", ip, "holder", holderName(entry.instanceName))
+		}
+	}
+
+	// a committed allocation is not rolled back by the next leader
+	err = p.commitInLedger(committed, transactionTimestamp)
+	if err != nil {
+		return nil, err
+	}
+	return committed, nil
+}
@@ -0,0 +1,346 @@
+package ip_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	kubevirt "kubevirt.io/api/core/v1"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+// ValidatePodNetworks checks the sriovnetworks annotation of a pod, see validateNetworks
+func (p *IPManager) ValidatePodNetworks(pod *corev1.Pod) error {
+	if pod.DeletionTimestamp != nil {
+		return nil
+	}
+	networkValue, ok := pod.Annotations[sriovNetworksAnnotation]
+	if !ok {
+		return nil
+	}
+
+	networks, err := parseSriovNetworks(networkValue, pod.Namespace)
+	if err != nil {
+		return err
+	}
+	// the virt-launcher pods get their networks from the virtual machine webhook
+	if p.isRelatedToKubevirt(pod) {
+		return nil
+	}
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	podFullName, _, err := p.podInstanceName(pod)
+	if err != nil {
+		return err
+	}
+	_, err = p.completeRequestedAddresses(networks)
+	if err != nil {
+		return err
+	}
+	err = validateMultusMACs(pod.Annotations[NetworksAnnotation], pod.Namespace, networks)
+	if err != nil {
+		return err
+	}
+	return p.validateNetworks(networks, podFullName)
+}
+
+// ValidateVirtualMachineNetworks checks the sriovnetworks annotation of a virtual machine, see validateNetworks
+func (p *IPManager) ValidateVirtualMachineNetworks(virtualMachine *kubevirt.VirtualMachine) error {
+	if virtualMachine.DeletionTimestamp != nil {
+		return nil
+	}
+	networkValue, ok := virtualMachine.Annotations[sriovNetworksAnnotation]
+	if !ok {
+		return nil
+	}
+
+	networks, err := parseSriovNetworks(networkValue, virtualMachine.Namespace)
+	if err != nil {
+		return err
+	}
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	_, err = p.completeRequestedAddresses(networks)
+	if err != nil {
+		return err
+	}
+	return p.validateNetworks(networks, VmNamespaced(virtualMachine))
+}
+
+// parseSriovNetworks parses the sriovnetworks annotation, unlike parsePodNetworkAnnotation it fails on anything
+// that is not a json object
+func parseSriovNetworks(networkValue, defaultNamespace string) (*sriovNetwork, error) {
+	networks := &sriovNetwork{}
+	err := json.Unmarshal([]byte(networkValue), networks)
+	if err != nil {
+		return nil, fmt.Errorf("the %s annotation is not a valid json object: %v", sriovNetworksAnnotation, err)
+	}
+	setNetworksDefaults(networks, defaultNamespace)
+	return networks, nil
+}
+
+// validateNetworks checks the requested networks can be rendered and allocated to the instance: the addresses and
+// gateways belong to the requested subnets, the sriov settings are in range and no other workload holds the addresses
+// or the MACs
+func (p *IPManager) validateNetworks(networks *sriovNetwork, instanceName string) error {
+	err := validateNetworkSettings(networks)
+	if err != nil {
+		return err
+	}
+	return p.validateAddressesHolder(networks, instanceName)
+}
+
+// validateNetworkSettings checks the requested networks can be rendered, whoever holds their addresses
+func validateNetworkSettings(networks *sriovNetwork) error {
+	if networks.Subnet == "" && len(networks.IPPool) == 0 {
+		return fmt.Errorf("the %s annotation needs a subnet or an ippool", sriovNetworksAnnotation)
+	}
+	if networks.Subnet != "" {
+		if _, _, err := net.ParseCIDR(networks.Subnet); err != nil {
+			return fmt.Errorf("invalid subnet %q: %v", networks.Subnet, err)
+		}
+	}
+
+	err := validateRequestedAddresses(networks)
+	if err != nil {
+		return err
+	}
+
+	for _, network := range networks.IPPool {
+		err := validateGateway(network.Gateway, networks.Subnet)
+		if err != nil {
+			return err
+		}
+		err = validateGateway(network.Gateway6, networks.Subnet6)
+		if err != nil {
+			return err
+		}
+		err = validateSriovSettings(&network)
+		if err != nil {
+			return err
+		}
+		err = validateIPAMSettings(&network)
+		if err != nil {
+			return err
+		}
+		err = validateCNISettings(&network)
+		if err != nil {
+			return err
+		}
+		err = validateMAC(&network)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateGateway(gateway, cidr string) error {
+	if gateway == "" {
+		return nil
+	}
+	ip := net.ParseIP(gateway)
+	if ip == nil {
+		return fmt.Errorf("invalid gateway %q", gateway)
+	}
+	if cidr == "" {
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %q: %v", cidr, err)
+	}
+	if !subnet.Contains(ip) {
+		return fmt.Errorf("gateway %s is not inside subnet %s", gateway, cidr)
+	}
+	return nil
+}
+
+// validateSriovSettings checks the settings rendered into the sriov cni config, RenderNetAttDef silently drops the
+// out of range ones
+func validateSriovSettings(network *sriovIpAddress) error {
+	if network.Vlan < 0 || network.Vlan > 4094 {
+		return fmt.Errorf("vlan %d of address %s is not in the range 0-4094", network.Vlan, network.Address)
+	}
+	if network.VlanQoS < 0 || network.VlanQoS > 7 {
+		return fmt.Errorf("vlanQoS %d of address %s is not in the range 0-7", network.VlanQoS, network.Address)
+	}
+	if !isOneOf(network.SpoofChk, "", "on", "off") {
+		return fmt.Errorf("spoofChk %q of address %s must be on or off", network.SpoofChk, network.Address)
+	}
+	if !isOneOf(network.Trust, "", "on", "off") {
+		return fmt.Errorf("trust %q of address %s must be on or off", network.Trust, network.Address)
+	}
+	if !isOneOf(network.LinkState, "", "enable", "disable", "auto") {
+		return fmt.Errorf("linkState %q of address %s must be enable, disable or auto", network.LinkState, network.Address)
+	}
+	if network.MinTxRate != nil && *network.MinTxRate < 0 {
+		return fmt.Errorf("minTxRate %d of address %s is negative", *network.MinTxRate, network.Address)
+	}
+	if network.MaxTxRate != nil && *network.MaxTxRate < 0 {
+		return fmt.Errorf("maxTxRate %d of address %s is negative", *network.MaxTxRate, network.Address)
+	}
+	if network.MinTxRate != nil && network.MaxTxRate != nil && *network.MinTxRate > *network.MaxTxRate {
+		return fmt.Errorf("minTxRate %d of address %s is above its maxTxRate %d", *network.MinTxRate, network.Address, *network.MaxTxRate)
+	}
+	return nil
+}
+
+// validateIPAMSettings checks the nameservers, search domains and static routes rendered into the static ipam
+func validateIPAMSettings(network *sriovIpAddress) error {
+	for _, nameserver := range network.Nameservers {
+		if net.ParseIP(nameserver) == nil {
+			return fmt.Errorf("nameserver %q of address %s is not an ip address", nameserver, network.Address)
+		}
+	}
+	err := validateSearchDomains(network.Search, "address "+network.Address)
+	if err != nil {
+		return err
+	}
+	for _, route := range network.Routes {
+		if _, _, err := net.ParseCIDR(route.Dst); err != nil {
+			return fmt.Errorf("route destination %q of address %s is not in CIDR notation", route.Dst, network.Address)
+		}
+		if route.Gw != "" && net.ParseIP(route.Gw) == nil {
+			return fmt.Errorf("route gateway %q of address %s is not an ip address", route.Gw, network.Address)
+		}
+	}
+	return nil
+}
+
+// validateIPPoolSettings checks the settings of a pool rendered into the networks of the workloads it serves
+func validateIPPoolSettings(pool *ippoolv1alpha1.IPPool) error {
+	return validateSearchDomains(pool.Spec.Search, "ip pool "+pool.Name)
+}
+
+// validateSearchDomains rejects the search domains that are not DNS subdomains, the templates render them as json strings
+func validateSearchDomains(search []string, owner string) error {
+	for _, domain := range search {
+		if errs := validation.IsDNS1123Subdomain(domain); len(errs) != 0 {
+			return fmt.Errorf("search domain %q of %s is not a valid DNS subdomain: %s", domain, owner, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// validateCNISettings checks the cni type of the address has a template and the settings of the type
+func validateCNISettings(network *sriovIpAddress) error {
+	if !isSupportedCNIType(network.cniType()) {
+		return fmt.Errorf("cni type %q of address %s is not one of %v", network.CNIType, network.Address, cniTypes)
+	}
+	switch network.cniType() {
+	case ippoolv1alpha1.CNITypeMacvlan:
+		if !isOneOf(network.Mode, "", "bridge", "private", "vepa", "passthru") {
+			return fmt.Errorf("macvlan mode %q of address %s must be bridge, private, vepa or passthru", network.Mode, network.Address)
+		}
+	case ippoolv1alpha1.CNITypeIPVlan:
+		if !isOneOf(network.Mode, "", "l2", "l3", "l3s") {
+			return fmt.Errorf("ipvlan mode %q of address %s must be l2, l3 or l3s", network.Mode, network.Address)
+		}
+	case ippoolv1alpha1.CNITypeOvs:
+		if network.Bridge == "" {
+			return fmt.Errorf("ovs address %s needs a bridge", network.Address)
+		}
+	}
+	return nil
+}
+
+func isOneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAddressesHolder rejects the requested addresses and MACs held by another instance, see ipMap.checkClaim
+func (p *IPManager) validateAddressesHolder(networks *sriovNetwork, instanceName string) error {
+	for _, network := range networks.IPPool {
+		for _, address := range network.addresses() {
+			ip, err := addressKey(address)
+			if err != nil {
+				return err
+			}
+			err = p.ipPoolMap.checkClaim(ip, ipEntry{instanceName: instanceName, netAttDef: network.netAttDefKey(), mac: network.MAC})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateMultusMACs rejects a mac requested in the k8s.v1.cni.cncf.io/networks element of an address other than the
+// one allocated to it, the interface would not get the mac recorded for the address
+func validateMultusMACs(multusNetworks, defaultNamespace string, networks *sriovNetwork) error {
+	elements, err := parseMultusNetworks(multusNetworks, defaultNamespace)
+	if err != nil {
+		return err
+	}
+	for _, address := range networks.IPPool {
+		if address.MAC == "" {
+			continue
+		}
+		element := findMultusNetwork(elements, address)
+		if element != nil && element.MacRequest != "" && !strings.EqualFold(element.MacRequest, address.MAC) {
+			return fmt.Errorf("mac %s requested for network %s/%s conflicts with the mac %s allocated to address %s",
+				element.MacRequest, element.Namespace, element.Name, address.MAC, address.Address)
+		}
+	}
+	return nil
+}
+
+// validateRequestedAddresses checks the explicitly requested addresses belong to the requested subnets and the
+// second address of a dual-stack entry is the IPv6 one of an IPv4 address
+func validateRequestedAddresses(networks *sriovNetwork) error {
+	for _, network := range networks.IPPool {
+		err := validateRequestedAddress(network.Address, networks.Subnet)
+		if err != nil {
+			return err
+		}
+		if network.Address6 == "" {
+			continue
+		}
+
+		err = validateRequestedAddress(network.Address6, networks.Subnet6)
+		if err != nil {
+			return err
+		}
+		ip, _ := addressKey(network.Address)
+		ip6, _ := addressKey(network.Address6)
+		if net.ParseIP(ip).To4() == nil || net.ParseIP(ip6).To4() != nil {
+			return fmt.Errorf("dual-stack address %s,%s must pair an ipv4 address with an ipv6 one", network.Address, network.Address6)
+		}
+	}
+	return nil
+}
+
+func validateRequestedAddress(address, cidr string) error {
+	ip, err := addressKey(address)
+	if err != nil {
+		return err
+	}
+	if cidr == "" {
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse subnet %q", cidr)
+	}
+	if !subnet.Contains(net.ParseIP(ip)) {
+		return fmt.Errorf("address %s is not inside subnet %s", address, cidr)
+	}
+	return nil
+}
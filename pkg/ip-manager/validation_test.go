@@ -0,0 +1,123 @@
+package ip_manager
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+const dns1123SubdomainError = "a lowercase RFC 1123 subdomain must consist of lower case alphanumeric characters, '-' or '.'," +
+	" and must start and end with an alphanumeric character (e.g. 'example.com', regex used for validation is" +
+	" '[a-z0-9]([-a-z0-9]*[a-z0-9])?(\\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*')"
+
+var _ = Describe("Validation", func() {
+	var ipManager *IPManager
+
+	BeforeEach(func() {
+		ipManager = createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}))
+	})
+
+	withEntry := func(entry string) string {
+		return `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [` + entry + `]}`
+	}
+
+	DescribeTable("should reject an invalid sriovnetworks annotation",
+		func(sriovNetworks, expectedError string) {
+			Expect(ipManager.ValidatePodNetworks(newTestPod("pod-1", sriovNetworks))).To(MatchError(expectedError))
+			Expect(ipManager.ValidateVirtualMachineNetworks(newTestVirtualMachine("vm-1", sriovNetworks))).To(MatchError(expectedError))
+		},
+		Entry("not json", "sriov-n3",
+			"the k8s.v1.cni.cncf.io/sriovnetworks annotation is not a valid json object: invalid character 's' looking for beginning of value"),
+		Entry("without subnet nor ippool", `{"resourcename": "mecdev.com/intel2v2nics"}`,
+			"the k8s.v1.cni.cncf.io/sriovnetworks annotation needs a subnet or an ippool"),
+		Entry("bare address without subnet", `{"resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "n3", "address": "100.100.100.150"}]}`,
+			"address 100.100.100.150 has no prefix length and no subnet to take it from"),
+		Entry("address outside of the subnet", withEntry(`{"name": "n3", "address": "100.100.101.150/24"}`),
+			"address 100.100.101.150/24 is not inside subnet 100.100.100.0/24"),
+		Entry("gateway outside of the subnet", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "gateway": "100.100.101.1"}`),
+			"gateway 100.100.101.1 is not inside subnet 100.100.100.0/24"),
+		Entry("vlan out of range", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "vlan": 4095}`),
+			"vlan 4095 of address 100.100.100.150/24 is not in the range 0-4094"),
+		Entry("vlanQoS out of range", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "vlanQoS": 8}`),
+			"vlanQoS 8 of address 100.100.100.150/24 is not in the range 0-7"),
+		Entry("unknown spoofChk", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "spoofChk": "yes"}`),
+			`spoofChk "yes" of address 100.100.100.150/24 must be on or off`),
+		Entry("unknown trust", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "trust": "true"}`),
+			`trust "true" of address 100.100.100.150/24 must be on or off`),
+		Entry("unknown linkState", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "linkState": "up"}`),
+			`linkState "up" of address 100.100.100.150/24 must be enable, disable or auto`),
+		Entry("nameserver that is not an ip", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "nameservers": ["dns.local"]}`),
+			`nameserver "dns.local" of address 100.100.100.150/24 is not an ip address`),
+		Entry("search domain that is not a DNS subdomain", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "search": ["upf.local\", \"x"]}`),
+			`search domain "upf.local\", \"x" of address 100.100.100.150/24 is not a valid DNS subdomain: `+dns1123SubdomainError),
+		Entry("route destination that is not a CIDR", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "routes": [{"dst": "10.10.0.1"}]}`),
+			`route destination "10.10.0.1" of address 100.100.100.150/24 is not in CIDR notation`),
+		Entry("unsupported cni type", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "cniType": "bridge"}`),
+			`cni type "bridge" of address 100.100.100.150/24 is not one of [sriov macvlan ipvlan host-device ovs]`),
+		Entry("macvlan mode", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "cniType": "macvlan", "mode": "l2"}`),
+			`macvlan mode "l2" of address 100.100.100.150/24 must be bridge, private, vepa or passthru`),
+		Entry("ipvlan mode", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "cniType": "ipvlan", "mode": "bridge"}`),
+			`ipvlan mode "bridge" of address 100.100.100.150/24 must be l2, l3 or l3s`),
+		Entry("ovs without bridge", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "cniType": "ovs"}`),
+			"ovs address 100.100.100.150/24 needs a bridge"),
+		Entry("minTxRate above maxTxRate", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "minTxRate": 200, "maxTxRate": 100}`),
+			"minTxRate 200 of address 100.100.100.150/24 is above its maxTxRate 100"),
+		Entry("mac that is not a mac", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "mac": "02:00:00:00:01"}`),
+			`mac "02:00:00:00:01" of address 100.100.100.150/24 is not a valid mac address`),
+		Entry("multicast mac", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "mac": "03:00:00:00:00:01"}`),
+			"mac 03:00:00:00:00:01 of address 100.100.100.150/24 is a multicast address"),
+		Entry("mac on an ipvlan interface", withEntry(`{"name": "n3", "address": "100.100.100.150/24", "cniType": "ipvlan", "mac": "02:00:00:00:00:01"}`),
+			"the ipvlan interface of address 100.100.100.150/24 can not be given a mac"),
+	)
+
+	It("should accept a valid sriovnetworks annotation", func() {
+		sriovNetworks := withEntry(`{"name": "n3", "address": "100.100.100.150/24", "gateway": "100.100.100.1", "vlan": 100, "vlanQoS": 7,` +
+			` "spoofChk": "off", "trust": "on", "linkState": "auto", "minTxRate": 100, "maxTxRate": 200}`)
+		Expect(ipManager.ValidatePodNetworks(newTestPod("pod-1", sriovNetworks))).To(Succeed())
+		Expect(ipManager.ValidatePodNetworks(newTestPod("pod-2", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`))).To(Succeed())
+	})
+
+	It("should reject the search domains of a pool that are not DNS subdomains", func() {
+		pool := newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"})
+		pool.Spec.Search = []string{"upf.local", "UPF_local"}
+		ipManager = createTestIPManager(pool)
+
+		err := ipManager.AllocatePodIP(newTestPod("pod-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`), &testTransactionTimestamp, true)
+		Expect(err).To(MatchError(`search domain "UPF_local" of ip pool sriov-n3 is not a valid DNS subdomain: ` + dns1123SubdomainError))
+		Expect(ipManager.ipPoolMap).To(BeEmpty())
+
+		err = ipManager.AllocatePodIP(newTestPod("pod-2", withEntry(`{"name": "n3", "address": "100.100.100.150/24"}`)), &testTransactionTimestamp, true)
+		Expect(err).To(MatchError(`search domain "UPF_local" of address 100.100.100.150/24 is not a valid DNS subdomain: ` + dns1123SubdomainError))
+	})
+
+	It("should reject an address held by another workload", func() {
+		sriovNetworks := withEntry(`{"name": "n3", "address": "100.100.100.150/24"}`)
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-1", sriovNetworks), &testTransactionTimestamp, true)).To(Succeed())
+
+		Expect(ipManager.ValidatePodNetworks(newTestPod("pod-1", sriovNetworks))).To(Succeed())
+		Expect(ipManager.ValidatePodNetworks(newTestPod("pod-2", sriovNetworks))).To(MatchError("address 100.100.100.150 is already held by pod/default/pod-1"))
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-2", sriovNetworks), &testTransactionTimestamp, true)).To(MatchError("address 100.100.100.150 is already held by pod/default/pod-1"))
+	})
+
+	It("should refuse a second claim on an address across pods and virtual machines", func() {
+		sriovNetworks := withEntry(`{"name": "n3", "address": "100.100.100.150/24"}`)
+		_, err := ipManager.AllocateVirtualMachineIP(newTestVirtualMachine("vm-1", sriovNetworks), &testTransactionTimestamp, true)
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(ipManager.AllocatePodIP(newTestPod("pod-1", sriovNetworks), &testTransactionTimestamp, true)).To(MatchError("address 100.100.100.150 is already held by virtualmachine/default/vm-1"))
+		Expect(ipManager.ipPoolMap["100.100.100.150"].instanceName).To(Equal("vm/default/vm-1"))
+	})
+
+	DescribeTable("should name the holder of an address by its workload",
+		func(instanceName, expected string) {
+			Expect(holderName(instanceName)).To(Equal(expected))
+		},
+		Entry("pod", "pod/default/pod-1", "pod/default/pod-1"),
+		Entry("virtual machine", "vm/default/vm-1", "virtualmachine/default/vm-1"),
+		Entry("restored NetworkAttachmentDefinition", "netattdef/default/sriov-n3-static-100-100-100-100", "networkattachmentdefinition/default/sriov-n3-static-100-100-100-100"),
+		Entry("statefulset identity", "statefulset/default/web/uid-1/0", "statefulset/default/web (pod web-0)"),
+		Entry("deployment ip set", "deployment/default/web/uid-1", "deployment/default/web"),
+	)
+})
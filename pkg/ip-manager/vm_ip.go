@@ -1,10 +1,272 @@
 package ip_manager
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"gomodules.xyz/jsonpatch/v2"
 	kubevirt "kubevirt.io/api/core/v1"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+	"github.com/wenwenxiong/kubeipfixed/pkg/utils"
 )
 
 func VmNamespaced(machine *kubevirt.VirtualMachine) string {
 	return fmt.Sprintf("vm/%s/%s", machine.Namespace, machine.Name)
 }
+
+// AllocateVirtualMachineIP allocates or validates the fixed ips requested by the virtual machine sriovnetworks annotation,
+// renders their NetworkAttachmentDefinitions and returns the json patches attaching them to the virtual machine template
+// as multus networks bound according to their cni type. The allocation stays pending until the virtual machine controller commits it.
+func (p *IPManager) AllocateVirtualMachineIP(virtualMachine *kubevirt.VirtualMachine, transactionTimestamp *time.Time, isNotDryRun bool) ([]jsonpatch.Operation, error) {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	// the update removing the release finalizer must not allocate again
+	if virtualMachine.DeletionTimestamp != nil {
+		return nil, nil
+	}
+
+	networkValue, ok := virtualMachine.Annotations[sriovNetworksAnnotation]
+	if !ok {
+		return nil, nil
+	}
+
+	networks, err := parsePodNetworkAnnotation(networkValue, virtualMachine.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if networks == nil {
+		return nil, nil
+	}
+
+	completed, err := p.completeRequestedAddresses(networks)
+	if err != nil {
+		recordAllocationFailure(isNotDryRun, err, allocationReasonInvalid)
+		p.recordAllocationFailedEvents(virtualMachine, isNotDryRun, err)
+		return nil, err
+	}
+	err = p.validateNetworks(networks, VmNamespaced(virtualMachine))
+	if err != nil {
+		recordAllocationFailure(isNotDryRun, err, allocationReasonInvalid)
+		p.recordAllocationFailedEvents(virtualMachine, isNotDryRun, err)
+		return nil, err
+	}
+
+	// kubevirt builds the multus networks of the virt-launcher pod itself, the address can not be passed at runtime
+	if pool, err := p.findIPPool(networks.Subnet, networks.ResourceName); err == nil && pool != nil && isSharedNetAttDefPool(pool) {
+		err = fmt.Errorf("ip pool %s uses a shared NetworkAttachmentDefinition, virtual machines need one per address", pool.Name)
+		recordAllocationFailure(isNotDryRun, err, allocationReasonInvalid)
+		p.recordAllocationFailedEvents(virtualMachine, isNotDryRun, err)
+		return nil, err
+	}
+
+	reason := allocationReasonRequested
+	if len(networks.IPPool) == 0 {
+		reason = allocationReasonPool
+	}
+	vmFullName := VmNamespaced(virtualMachine)
+	networksChanged, err := p.allocateNetworks(networks, virtualMachine.Namespace, vmFullName, transactionTimestamp, isNotDryRun)
+	if err != nil {
+		recordAllocationFailure(isNotDryRun, err, allocationReasonError)
+		p.recordAllocationFailedEvents(virtualMachine, isNotDryRun, err)
+		return nil, err
+	}
+	recordAllocationSuccess(isNotDryRun, reason)
+
+	annotations := map[string]string{}
+	for key, value := range virtualMachine.Annotations {
+		annotations[key] = value
+	}
+	if networksChanged || completed {
+		networkValue, err := json.Marshal(networks)
+		if err != nil {
+			return nil, err
+		}
+		annotations[sriovNetworksAnnotation] = string(networkValue)
+	}
+	annotations[TransactionTimestampAnnotation] = transactionTimestamp.Format(time.RFC3339Nano)
+
+	var interfaces []kubevirt.Interface
+	var vmNetworks []kubevirt.Network
+	changed := false
+	if virtualMachine.Spec.Template != nil {
+		interfaces, vmNetworks, changed = attachSriovNetworks(&virtualMachine.Spec.Template.Spec, networks)
+	}
+	status, err := networksStatus(networks, vmInterfaceName(vmNetworks))
+	if err != nil {
+		return nil, err
+	}
+	annotations[StatusAnnotation] = status
+
+	patches := []jsonpatch.Operation{jsonpatch.NewOperation("add", "/metadata/annotations", annotations)}
+
+	if !utils.ContainsString(virtualMachine.Finalizers, ReleaseIPFinalizer) {
+		finalizers := append(append([]string{}, virtualMachine.Finalizers...), ReleaseIPFinalizer)
+		patches = append(patches, jsonpatch.NewOperation("add", "/metadata/finalizers", finalizers))
+	}
+
+	if virtualMachine.Spec.Template == nil {
+		return patches, nil
+	}
+	if changed {
+		patches = append(patches,
+			jsonpatch.NewOperation("add", "/spec/template/spec/domain/devices/interfaces", interfaces),
+			jsonpatch.NewOperation("add", "/spec/template/spec/networks", vmNetworks))
+	}
+
+	// configure the fixed ips inside the guest through the cloud-init network data
+	ethernets := netplanEthernets(networks, interfaces, vmNetworks)
+	if len(ethernets) == 0 {
+		return patches, nil
+	}
+	volumes, disks, err := mergeCloudInitNetworkData(&virtualMachine.Spec.Template.Spec, ethernets)
+	if err != nil {
+		return nil, err
+	}
+	if volumes != nil {
+		patches = append(patches, jsonpatch.NewOperation("add", "/spec/template/spec/volumes", volumes))
+		if len(disks) != len(virtualMachine.Spec.Template.Spec.Domain.Devices.Disks) {
+			patches = append(patches, jsonpatch.NewOperation("add", "/spec/template/spec/domain/devices/disks", disks))
+		}
+	}
+
+	return patches, nil
+}
+
+// attachSriovNetworks returns the interfaces and networks of the virtual machine with a multus network for every
+// address that is not attached yet, sriov bound for the sriov addresses and bridge bound for the other cni types
+func attachSriovNetworks(spec *kubevirt.VirtualMachineInstanceSpec, networks *sriovNetwork) ([]kubevirt.Interface, []kubevirt.Network, bool) {
+	interfaces := append([]kubevirt.Interface{}, spec.Domain.Devices.Interfaces...)
+	vmNetworks := append([]kubevirt.Network{}, spec.Networks...)
+
+	// kubevirt only attaches the pod network on its own when no network is set at all
+	autoAttach := spec.Domain.Devices.AutoattachPodInterface
+	if len(vmNetworks) == 0 && (autoAttach == nil || *autoAttach) {
+		interfaces = append(interfaces, *kubevirt.DefaultBridgeNetworkInterface())
+		vmNetworks = append(vmNetworks, *kubevirt.DefaultPodNetwork())
+	}
+
+	changed := false
+	for i, network := range networks.IPPool {
+		multusNetworkName := fmt.Sprintf("%s/%s", network.Namespace, network.Name)
+		if isMultusNetworkAttached(vmNetworks, multusNetworkName) {
+			continue
+		}
+
+		name := fmt.Sprintf("sriov-net%d", i)
+		binding := kubevirt.InterfaceBindingMethod{SRIOV: &kubevirt.InterfaceSRIOV{}}
+		if network.cniType() != ippoolv1alpha1.CNITypeSriov {
+			binding = kubevirt.InterfaceBindingMethod{Bridge: &kubevirt.InterfaceBridge{}}
+		}
+		interfaces = append(interfaces, kubevirt.Interface{
+			Name:                   name,
+			InterfaceBindingMethod: binding,
+			MacAddress:             network.MAC,
+		})
+		vmNetworks = append(vmNetworks, kubevirt.Network{
+			Name:          name,
+			NetworkSource: kubevirt.NetworkSource{Multus: &kubevirt.MultusNetwork{NetworkName: multusNetworkName}},
+		})
+		changed = true
+	}
+
+	return interfaces, vmNetworks, changed
+}
+
+func isMultusNetworkAttached(vmNetworks []kubevirt.Network, multusNetworkName string) bool {
+	for _, vmNetwork := range vmNetworks {
+		if vmNetwork.Multus != nil && vmNetwork.Multus.NetworkName == multusNetworkName {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkVMAsReady commits the pending allocations of a virtual machine once it exists in the cluster, the committed
+// addresses are recorded by an Event on the virtual machine and on their pools
+func (p *IPManager) MarkVMAsReady(virtualMachine *kubevirt.VirtualMachine) error {
+	timestampValue, ok := virtualMachine.Annotations[TransactionTimestampAnnotation]
+	if !ok {
+		return nil
+	}
+	networkValue, ok := virtualMachine.Annotations[sriovNetworksAnnotation]
+	if !ok {
+		return nil
+	}
+
+	transactionTimestamp, err := parseTransactionTimestamp(timestampValue)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse the virtual machine transaction timestamp")
+	}
+	networks, err := parsePodNetworkAnnotation(networkValue, virtualMachine.Namespace)
+	if err != nil || networks == nil {
+		return err
+	}
+
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	committed, err := p.commitAllocations(VmNamespaced(virtualMachine), networks, transactionTimestamp)
+	if err != nil {
+		return err
+	}
+	p.recordWorkloadEvent(virtualMachine, eventReasonAllocated, "allocated", committed)
+	p.recordPoolEvents(VmNamespaced(virtualMachine), eventReasonAllocated, "allocated", committed)
+	return nil
+}
+
+// ReleaseVirtualMachineIPs releases the addresses held by the virtual machine and removes their NetworkAttachmentDefinitions.
+// It is safe to call it several times for the same virtual machine.
+func (p *IPManager) ReleaseVirtualMachineIPs(virtualMachine *kubevirt.VirtualMachine) error {
+	p.poolMutex.Lock()
+	defer p.poolMutex.Unlock()
+
+	toRelease := p.ipPoolMap.filterByInstanceName(VmNamespaced(virtualMachine))
+	err := p.releaseAllocations(VmNamespaced(virtualMachine), toRelease)
+	if err != nil {
+		return err
+	}
+	p.recordWorkloadEvent(virtualMachine, eventReasonReleased, "released", toRelease)
+	return nil
+}
+
+// initVirtualMachineMap reserves the addresses held by the existing virtual machines
+func (p *IPManager) initVirtualMachineMap() error {
+	vms := &kubevirt.VirtualMachineList{}
+	err := p.cachedKubeClient.List(context.TODO(), vms)
+	if err != nil {
+		return err
+	}
+
+	for i := range vms.Items {
+		vm := &vms.Items[i]
+		networkValue, ok := vm.Annotations[sriovNetworksAnnotation]
+		if !ok {
+			continue
+		}
+
+		networks, err := parsePodNetworkAnnotation(networkValue, vm.Namespace)
+		if err != nil || networks == nil {
+			log.Error(err, "ignoring virtual machine with an invalid sriovnetworks annotation", "vmFullName", VmNamespaced(vm))
+			continue
+		}
+
+		allocations, err := p.networksAllocations(VmNamespaced(vm), networks)
+		if err != nil {
+			log.Error(err, "ignoring virtual machine with an invalid address", "vmFullName", VmNamespaced(vm))
+			continue
+		}
+		for ip, entry := range allocations {
+			err := p.ipPoolMap.claim(ip, entry)
+			if err != nil {
+				log.Error(err, "duplicate ip found while rebuilding the allocation state, keeping the first holder", "vmFullName", VmNamespaced(vm))
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package ip_manager
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubevirt "kubevirt.io/api/core/v1"
+
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
+)
+
+func newTestVirtualMachine(name, sriovNetworks string) *kubevirt.VirtualMachine {
+	return &kubevirt.VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Annotations: map[string]string{sriovNetworksAnnotation: sriovNetworks},
+		},
+		Spec: kubevirt.VirtualMachineSpec{
+			Template: &kubevirt.VirtualMachineInstanceTemplateSpec{},
+		},
+	}
+}
+
+var _ = Describe("Virtual Machine IP", func() {
+	var ipManager *IPManager
+
+	BeforeEach(func() {
+		ipManager = createTestIPManager(newTestIPPool("sriov-n3", "100.100.100.0/24", ippoolv1alpha1.IPRange{Start: "100.100.100.100", End: "100.100.100.200"}))
+	})
+
+	It("should allocate an ip and attach it as a sriov multus network next to the pod network", func() {
+		vm := newTestVirtualMachine("vm-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+
+		patches, err := ipManager.AllocateVirtualMachineIP(vm, &testTransactionTimestamp, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(patches).To(HaveLen(6))
+
+		annotations := patches[0].Value.(map[string]string)
+		Expect(annotations[sriovNetworksAnnotation]).To(ContainSubstring(`"address":"100.100.100.100/24"`))
+		Expect(patches[1].Value).To(ConsistOf(ReleaseIPFinalizer))
+
+		Expect(patches[2].Path).To(Equal("/spec/template/spec/domain/devices/interfaces"))
+		interfaces := patches[2].Value.([]kubevirt.Interface)
+		Expect(interfaces).To(HaveLen(2))
+		Expect(interfaces[0].Bridge).ToNot(BeNil())
+		Expect(interfaces[1].Name).To(Equal("sriov-net0"))
+		Expect(interfaces[1].SRIOV).ToNot(BeNil())
+
+		Expect(patches[3].Path).To(Equal("/spec/template/spec/networks"))
+		networks := patches[3].Value.([]kubevirt.Network)
+		Expect(networks).To(HaveLen(2))
+		Expect(networks[0].Pod).ToNot(BeNil())
+		Expect(networks[1].Multus.NetworkName).To(Equal("default/sriov-n3-static-100-100-100-100"))
+
+		Expect(patches[4].Path).To(Equal("/spec/template/spec/volumes"))
+		volumes := patches[4].Value.([]kubevirt.Volume)
+		Expect(volumes).To(HaveLen(1))
+		Expect(volumes[0].CloudInitNoCloud.NetworkData).To(ContainSubstring("- 100.100.100.100/24"))
+		Expect(patches[5].Path).To(Equal("/spec/template/spec/domain/devices/disks"))
+
+		Expect(ipManager.ipPoolMap["100.100.100.100"].instanceName).To(Equal("vm/default/vm-1"))
+	})
+
+	It("should bind the networks of the other cni types as bridge", func() {
+		vm := newTestVirtualMachine("vm-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "n3", "address": "100.100.100.150/24", "cniType": "ovs", "bridge": "br1"}]}`)
+
+		patches, err := ipManager.AllocateVirtualMachineIP(vm, &testTransactionTimestamp, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(patches[2].Path).To(Equal("/spec/template/spec/domain/devices/interfaces"))
+		interfaces := patches[2].Value.([]kubevirt.Interface)
+		Expect(interfaces).To(HaveLen(2))
+		Expect(interfaces[1].SRIOV).To(BeNil())
+		Expect(interfaces[1].Bridge).ToNot(BeNil())
+	})
+
+	It("should not attach the network twice", func() {
+		vm := newTestVirtualMachine("vm-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "sriov-n3-static-100-100-100-150", "address": "100.100.100.150/24", "gateway": "100.100.100.1"}]}`)
+		vm.Finalizers = []string{ReleaseIPFinalizer}
+		vm.Spec.Template.Spec.Networks = []kubevirt.Network{{Name: "sriov", NetworkSource: kubevirt.NetworkSource{Multus: &kubevirt.MultusNetwork{NetworkName: "default/sriov-n3-static-100-100-100-150"}}}}
+
+		patches, err := ipManager.AllocateVirtualMachineIP(vm, &testTransactionTimestamp, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(patches).To(HaveLen(3))
+		Expect(patches[1].Path).To(Equal("/spec/template/spec/volumes"))
+		Expect(patches[2].Path).To(Equal("/spec/template/spec/domain/devices/disks"))
+	})
+
+	It("should return the same patches on dry-run without reserving the ip", func() {
+		dryRunPatches, err := ipManager.AllocateVirtualMachineIP(newTestVirtualMachine("vm-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`), &testTransactionTimestamp, false)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ipManager.ipPoolMap).To(BeEmpty())
+
+		patches, err := ipManager.AllocateVirtualMachineIP(newTestVirtualMachine("vm-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`), &testTransactionTimestamp, true)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dryRunPatches).To(Equal(patches))
+	})
+
+	It("should reject pools sharing their NetworkAttachmentDefinition", func() {
+		pool := newTestIPPool("sriov-n3", "100.100.100.0/24")
+		pool.Spec.NetAttDefMode = ippoolv1alpha1.NetAttDefModeShared
+		ipManager = createTestIPManager(pool)
+
+		_, err := ipManager.AllocateVirtualMachineIP(newTestVirtualMachine("vm-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`), &testTransactionTimestamp, true)
+		Expect(err).To(HaveOccurred())
+		Expect(ipManager.ipPoolMap).To(BeEmpty())
+	})
+
+	It("should reject an address outside of the requested subnet", func() {
+		vm := newTestVirtualMachine("vm-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "static", "address": "100.100.101.150/24"}]}`)
+
+		_, err := ipManager.AllocateVirtualMachineIP(vm, &testTransactionTimestamp, true)
+		Expect(err).To(MatchError("address 100.100.101.150/24 is not inside subnet 100.100.100.0/24"))
+	})
+
+	It("should reject a dual-stack entry that does not pair an ipv4 address with an ipv6 one", func() {
+		vm := newTestVirtualMachine("vm-1", `{"subnet": "100.100.100.0/24", "subnet6": "fd00:100::/64", "resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "static", "address": "100.100.100.150/24", "address6": "fd00:101::150/64"}]}`)
+		_, err := ipManager.AllocateVirtualMachineIP(vm, &testTransactionTimestamp, true)
+		Expect(err).To(MatchError("address fd00:101::150/64 is not inside subnet fd00:100::/64"))
+
+		vm = newTestVirtualMachine("vm-1", `{"resourcename": "mecdev.com/intel2v2nics", "ippool": [{"name": "static", "address": "100.100.100.150/24", "address6": "100.100.100.151/24"}]}`)
+		_, err = ipManager.AllocateVirtualMachineIP(vm, &testTransactionTimestamp, true)
+		Expect(err).To(MatchError("dual-stack address 100.100.100.150/24,100.100.100.151/24 must pair an ipv4 address with an ipv6 one"))
+	})
+
+	It("should commit and release the virtual machine ips", func() {
+		vm := newTestVirtualMachine("vm-1", `{"subnet": "100.100.100.0/24", "resourcename": "mecdev.com/intel2v2nics"}`)
+		patches, err := ipManager.AllocateVirtualMachineIP(vm, &testTransactionTimestamp, true)
+		Expect(err).ToNot(HaveOccurred())
+		vm.Annotations = patches[0].Value.(map[string]string)
+
+		Expect(ipManager.MarkVMAsReady(vm)).To(Succeed())
+		Expect(ipManager.ipPoolMap["100.100.100.100"].isPending()).To(BeFalse())
+
+		Expect(ipManager.ReleaseVirtualMachineIPs(vm)).To(Succeed())
+		Expect(ipManager.ipPoolMap).To(BeEmpty())
+	})
+})
@@ -3,8 +3,10 @@ package manager
 import (
 	"context"
 	"fmt"
+	ippoolv1alpha1 "github.com/wenwenxiong/kubeipfixed/pkg/apis/kubeippool/v1alpha1"
 	"github.com/wenwenxiong/kubeipfixed/pkg/controller"
 	ip_manager "github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+	"github.com/wenwenxiong/kubeipfixed/pkg/names"
 	"github.com/wenwenxiong/kubeipfixed/pkg/webhook"
 	"os"
 	"os/signal"
@@ -13,6 +15,7 @@ import (
 	"time"
 
 	"github.com/go-logr/logr"
+	netattdefv1 "github.com/k8snetworkplumbingwg/network-attachment-definition-client/pkg/apis/k8s.cni.cncf.io/v1"
 	"github.com/pkg/errors"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -37,10 +40,11 @@ type KubeIPPoolManager struct {
 	podNamespace             string             // manager pod namespace
 	podName                  string             // manager pod name
 	waitingTime              int                // Duration in second to free macs of allocated vms that failed to start.
+	leaderElection           bool               // only the elected replica runs the controllers, all of them serve the webhooks
 	runtimeManager           manager.Manager    // Delegated controller-runtime manager
 }
 
-func NewKubeIPPoolManager(podNamespace, podName, metricsAddr string, waitingTime int) *KubeIPPoolManager {
+func NewKubeIPPoolManager(podNamespace, podName, metricsAddr string, waitingTime int, leaderElection bool) *KubeIPPoolManager {
 	kubeippoolManager := &KubeIPPoolManager{
 		continueToRunManager:     true,
 		kubevirtInstalledChannel: make(chan struct{}),
@@ -48,7 +52,8 @@ func NewKubeIPPoolManager(podNamespace, podName, metricsAddr string, waitingTime
 		podNamespace:             podNamespace,
 		podName:                  podName,
 		metricsAddr:              metricsAddr,
-		waitingTime:              waitingTime}
+		waitingTime:              waitingTime,
+		leaderElection:           leaderElection}
 
 	signal.Notify(kubeippoolManager.stopSignalChannel, os.Interrupt, os.Kill)
 
@@ -80,6 +85,16 @@ func (k *KubeIPPoolManager) Run() error {
 			return errors.Wrap(err, "unable to register kubevirt scheme")
 		}
 
+		err = netattdefv1.AddToScheme(k.runtimeManager.GetScheme())
+		if err != nil {
+			return errors.Wrap(err, "unable to register network attachment definition scheme")
+		}
+
+		err = ippoolv1alpha1.AddToScheme(k.runtimeManager.GetScheme())
+		if err != nil {
+			return errors.Wrap(err, "unable to register ip pool scheme")
+		}
+
 		isKubevirtInstalled := checkForKubevirt(k.clientset)
 
 		log.Info("Constructing cache")
@@ -116,7 +131,7 @@ func (k *KubeIPPoolManager) Run() error {
 		if err != nil {
 			return errors.Wrap(err, "failed creating pool manager client")
 		}
-		ipManager, err := ip_manager.NewIPManager(client, cachedClient, k.podNamespace, isKubevirtInstalled, k.waitingTime, k.runtimeManager.GetScheme())
+		ipManager, err := ip_manager.NewIPManager(client, cachedClient, k.podNamespace, isKubevirtInstalled, k.waitingTime, k.runtimeManager.GetScheme(), k.runtimeManager.GetEventRecorderFor("kubeipfixed"))
 		if err != nil {
 			return errors.Wrap(err, "unable to create pool manager")
 		}
@@ -146,6 +161,31 @@ func (k *KubeIPPoolManager) Run() error {
 			return errors.Wrap(err, "failed to start pool manager routines")
 		}
 
+		// the leader records the rebuilt allocations and releases the addresses of the workloads removed while
+		// kubeipfixed was down once the caches synced
+		err = k.runtimeManager.Add(manager.RunnableFunc(ipManager.InitLeader))
+		if err != nil {
+			return errors.Wrap(err, "unable to register the leader initialization to the manager")
+		}
+
+		// the leader rolls back the expired allocations of all the replicas
+		err = k.runtimeManager.Add(manager.RunnableFunc(ipManager.RunPendingCleanup))
+		if err != nil {
+			return errors.Wrap(err, "unable to register the pending allocations cleanup to the manager")
+		}
+
+		// every replica mirrors the allocations of the others
+		err = ipManager.WatchLedger(k.runtimeManager)
+		if err != nil {
+			return errors.Wrap(err, "unable to register the allocation ledger watch to the manager")
+		}
+
+		// every replica renders the NetworkAttachmentDefinitions of the workloads it admits
+		err = ipManager.WatchCNITemplates(k.runtimeManager)
+		if err != nil {
+			return errors.Wrap(err, "unable to register the NetworkAttachmentDefinition templates reload to the manager")
+		}
+
 		err = k.runtimeManager.Start(ctx)
 		if err != nil {
 			log.Error(err, "unable to run the manager")
@@ -171,7 +211,11 @@ func (k *KubeIPPoolManager) initRuntimeManager() error {
 	log.Info("Setting up Manager")
 	var err error
 	k.runtimeManager, err = manager.New(k.config, manager.Options{
-		MetricsBindAddress: k.metricsAddr,
+		MetricsBindAddress:            k.metricsAddr,
+		LeaderElection:                k.leaderElection,
+		LeaderElectionID:              names.LEADER_ID,
+		LeaderElectionNamespace:       k.podNamespace,
+		LeaderElectionReleaseOnCancel: true,
 	})
 	return err
 }
@@ -0,0 +1,73 @@
+// Package metrics holds the prometheus metrics of kubeipfixed, served with the controller-runtime ones on --metrics-addr
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+var (
+	// Allocations counts the allocations of the mutating webhooks by result and reason: where the addresses come
+	// from on success, why the allocation failed otherwise. Dry-run requests are not counted.
+	Allocations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubeipfixed_allocations_total",
+		Help: "Number of address allocations by result and reason",
+	}, []string{"result", "reason"})
+
+	// Releases counts the released addresses by result and reason, the kind of workload that held them or expired
+	// for the allocations rolled back because their workload was never created
+	Releases = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubeipfixed_releases_total",
+		Help: "Number of released addresses by result and reason",
+	}, []string{"result", "reason"})
+
+	// WebhookDuration observes the handling time of the admission requests by webhook path and result
+	WebhookDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kubeipfixed_webhook_duration_seconds",
+		Help:    "Handling time of the admission requests by webhook and result",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"webhook", "result"})
+
+	// NetAttDefDuration observes the latency of the NetworkAttachmentDefinition requests to the api server by
+	// operation (create, update, delete) and result
+	NetAttDefDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kubeipfixed_netattdef_request_duration_seconds",
+		Help:    "Latency of the NetworkAttachmentDefinition requests by operation and result",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "result"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(Allocations, Releases, WebhookDuration, NetAttDefDuration)
+}
+
+// Result returns the result label of an operation
+func Result(err error) string {
+	if err != nil {
+		return ResultFailure
+	}
+	return ResultSuccess
+}
+
+// ObserveWebhook records the handling time of an admission request since start, the result is allowed, denied or
+// error when the webhook could not handle the request
+func ObserveWebhook(webhook string, start time.Time, response admission.Response) {
+	result := "allowed"
+	switch {
+	case response.Allowed:
+	case response.Result != nil && response.Result.Code == http.StatusForbidden:
+		result = "denied"
+	default:
+		result = "error"
+	}
+	WebhookDuration.WithLabelValues(webhook, result).Observe(time.Since(start).Seconds())
+}
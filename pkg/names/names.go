@@ -22,6 +22,10 @@ const WAITING_VMS_CONFIGMAP = "kubemacpool-vm-configmap"
 
 const WAIT_TIME_ARG = "wait-time"
 
+const LEADER_ELECT_ARG = "leader-elect"
+
+const LEADER_ID = "kubeipfixed-election"
+
 // Relationship labels
 const COMPONENT_LABEL_KEY = "app.kubernetes.io/component"
 const PART_OF_LABEL_KEY = "app.kubernetes.io/part-of"
@@ -55,3 +55,13 @@ func ConvertHwAddrToInt64(address net.HardwareAddr) (int64, error) {
 
 	return addressValue, nil
 }
+
+// ConvertInt64ToHwAddr is the reverse of ConvertHwAddrToInt64, the value gives the 48 bits of the mac address
+func ConvertInt64ToHwAddr(value int64) net.HardwareAddr {
+	address := make(net.HardwareAddr, 6)
+	for i := len(address) - 1; i >= 0; i-- {
+		address[i] = byte(value & 0xff)
+		value >>= 8
+	}
+	return address
+}
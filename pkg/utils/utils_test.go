@@ -28,5 +28,18 @@ var _ = Describe("Utils", func() {
 			table.Entry("00:00:00:00:00:00 -> 0", "00:00:00:00:00:00", float64(0)),
 			table.Entry("FF:FF:FF:FF:FF:FF -> 0", "FF:FF:FF:FF:FF:FF", math.Pow(2, 12*4)-1),
 		)
+
+		table.DescribeTable("should convert from int64 back to the mac address", func(macAddr string) {
+			macAddrHW, err := net.ParseMAC(macAddr)
+			Expect(err).ToNot(HaveOccurred(), "should succeed parsing the mac address")
+			convertedMacAddrValue, err := ConvertHwAddrToInt64(macAddrHW)
+			Expect(err).ToNot(HaveOccurred(), "should succeed converting the mac address to int64 value")
+			Expect(ConvertInt64ToHwAddr(convertedMacAddrValue)).To(Equal(macAddrHW), "should give back the mac address")
+		},
+			table.Entry("02:00:00:00:00:01", "02:00:00:00:00:01"),
+			table.Entry("02:00:00:00:01:00", "02:00:00:00:01:00"),
+			table.Entry("00:00:00:00:00:00", "00:00:00:00:00:00"),
+			table.Entry("ff:ff:ff:ff:ff:ff", "ff:ff:ff:ff:ff:ff"),
+		)
 	})
 })
@@ -18,9 +18,12 @@ package pod
 
 import (
 	"context"
+	"fmt"
 	ip_manager "github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
 	"gomodules.xyz/jsonpatch/v2"
 	"net/http"
+	"reflect"
+	"time"
 
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -30,6 +33,8 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	kawwebhook "github.com/qinqon/kube-admission-webhook/pkg/webhook"
+
+	"github.com/wenwenxiong/kubeipfixed/pkg/metrics"
 )
 
 var log = logf.Log.WithName("Webhook mutatepods")
@@ -44,11 +49,18 @@ type podAnnotator struct {
 func Add(s *kawwebhook.Server, ipManager *ip_manager.IPManager) error {
 	podAnnotator := &podAnnotator{ipManager: ipManager}
 	s.Register("/mutate-pods", &webhook.Admission{Handler: podAnnotator})
+	s.Register("/validate-pods", &webhook.Admission{Handler: &podValidator{ipManager: ipManager}})
 	return nil
 }
 
 // Handle podAnnotator adds an annotation to every incoming pods.
-func (a *podAnnotator) Handle(ctx context.Context, req admission.Request) admission.Response {
+func (a *podAnnotator) Handle(ctx context.Context, req admission.Request) (response admission.Response) {
+	defer func(start time.Time) { metrics.ObserveWebhook("mutate-pods", start, response) }(time.Now())
+
+	if !a.ipManager.IsReady() {
+		return admission.Errored(http.StatusServiceUnavailable, fmt.Errorf("kubeipfixed is still rebuilding its allocation state"))
+	}
+
 	pod := &corev1.Pod{}
 
 	err := a.decoder.Decode(req, pod)
@@ -65,7 +77,7 @@ func (a *podAnnotator) Handle(ctx context.Context, req admission.Request) admiss
 	transactionTimestamp := ip_manager.CreateTransactionTimestamp()
 	log.V(1).Info("got a create pod event", "podName", pod.Name, "podNamespace", pod.Namespace, "transactionTimestamp", transactionTimestamp)
 
-	err = a.ipManager.AllocatePodIP(pod, isNotDryRun)
+	err = a.ipManager.AllocatePodIP(pod, &transactionTimestamp, isNotDryRun)
 	if err != nil {
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
@@ -78,13 +90,16 @@ func (a *podAnnotator) Handle(ctx context.Context, req admission.Request) admiss
 func patchPodChanges(originalPod, currentPod *corev1.Pod) admission.Response {
 	kubeIPJsonPatches := []jsonpatch.Operation{}
 
-	currentNetworkAnnotation := currentPod.GetAnnotations()[ip_manager.NetworksAnnotation]
-	originalPodNetworkAnnotation := originalPod.GetAnnotations()[ip_manager.NetworksAnnotation]
-	if originalPodNetworkAnnotation != currentNetworkAnnotation {
+	if !reflect.DeepEqual(originalPod.GetAnnotations(), currentPod.GetAnnotations()) {
 		annotationPatch := jsonpatch.NewOperation("replace", "/metadata/annotations", currentPod.GetAnnotations())
 		kubeIPJsonPatches = append(kubeIPJsonPatches, annotationPatch)
 	}
 
+	if !reflect.DeepEqual(originalPod.GetFinalizers(), currentPod.GetFinalizers()) {
+		finalizerPatch := jsonpatch.NewOperation("add", "/metadata/finalizers", currentPod.GetFinalizers())
+		kubeIPJsonPatches = append(kubeIPJsonPatches, finalizerPatch)
+	}
+
 	log.Info("patchPodChanges", "kubemapcoolJsonPatches", kubeIPJsonPatches)
 	if len(kubeIPJsonPatches) == 0 {
 		return admission.Response{
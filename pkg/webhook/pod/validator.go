@@ -0,0 +1,54 @@
+package pod
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	ip_manager "github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/wenwenxiong/kubeipfixed/pkg/metrics"
+)
+
+type podValidator struct {
+	decoder   *admission.Decoder
+	ipManager *ip_manager.IPManager
+}
+
+// Handle podValidator rejects the pods with an invalid sriovnetworks annotation.
+func (v *podValidator) Handle(ctx context.Context, req admission.Request) (response admission.Response) {
+	defer func(start time.Time) { metrics.ObserveWebhook("validate-pods", start, response) }(time.Now())
+
+	if req.Operation == admissionv1.Delete {
+		return admission.Allowed("")
+	}
+	if !v.ipManager.IsReady() {
+		return admission.Errored(http.StatusServiceUnavailable, fmt.Errorf("kubeipfixed is still rebuilding its allocation state"))
+	}
+
+	pod := &corev1.Pod{}
+	err := v.decoder.Decode(req, pod)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+
+	err = v.ipManager.ValidatePodNetworks(pod)
+	if err != nil {
+		log.Info("rejecting the pod sriovnetworks annotation", "podName", pod.Name, "podNamespace", pod.Namespace, "reason", err.Error())
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+// InjectDecoder injects the decoder.
+func (v *podValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
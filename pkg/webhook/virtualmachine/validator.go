@@ -0,0 +1,54 @@
+package virtualmachine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	ip_manager "github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+	admissionv1 "k8s.io/api/admission/v1"
+	kubevirt "kubevirt.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/wenwenxiong/kubeipfixed/pkg/metrics"
+)
+
+type virtualMachineValidator struct {
+	decoder     *admission.Decoder
+	poolManager *ip_manager.IPManager
+}
+
+// Handle virtualMachineValidator rejects the virtual machines with an invalid sriovnetworks annotation.
+func (v *virtualMachineValidator) Handle(ctx context.Context, req admission.Request) (response admission.Response) {
+	defer func(start time.Time) { metrics.ObserveWebhook("validate-virtualmachines", start, response) }(time.Now())
+
+	if req.Operation == admissionv1.Delete {
+		return admission.Allowed("")
+	}
+	if !v.poolManager.IsReady() {
+		return admission.Errored(http.StatusServiceUnavailable, fmt.Errorf("kubeipfixed is still rebuilding its allocation state"))
+	}
+
+	virtualMachine := &kubevirt.VirtualMachine{}
+	err := v.decoder.Decode(req, virtualMachine)
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if virtualMachine.Namespace == "" {
+		virtualMachine.Namespace = req.AdmissionRequest.Namespace
+	}
+
+	err = v.poolManager.ValidateVirtualMachineNetworks(virtualMachine)
+	if err != nil {
+		log.Info("rejecting the virtual machine sriovnetworks annotation", "virtualMachineFullName", ip_manager.VmNamespaced(virtualMachine), "reason", err.Error())
+		return admission.Denied(err.Error())
+	}
+	return admission.Allowed("")
+}
+
+// InjectDecoder injects the decoder.
+func (v *virtualMachineValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
@@ -18,8 +18,8 @@ package virtualmachine
 
 import (
 	"context"
+	"fmt"
 	ip_manager "github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
-	"gomodules.xyz/jsonpatch/v2"
 	admissionv1 "k8s.io/api/admission/v1"
 	kubevirt "kubevirt.io/api/core/v1"
 	"math/rand"
@@ -28,8 +28,11 @@ import (
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"time"
 
 	kawwebhook "github.com/qinqon/kube-admission-webhook/pkg/webhook"
+
+	"github.com/wenwenxiong/kubeipfixed/pkg/metrics"
 )
 
 var log = logf.Log.WithName("Webhook mutatevirtualmachines")
@@ -44,11 +47,18 @@ type virtualMachineAnnotator struct {
 func Add(s *kawwebhook.Server, poolManager *ip_manager.IPManager) error {
 	virtualMachineAnnotator := &virtualMachineAnnotator{poolManager: poolManager}
 	s.Register("/mutate-virtualmachines", &webhook.Admission{Handler: virtualMachineAnnotator})
+	s.Register("/validate-virtualmachines", &webhook.Admission{Handler: &virtualMachineValidator{poolManager: poolManager}})
 	return nil
 }
 
-// podAnnotator adds an annotation to every incoming pods.
-func (a *virtualMachineAnnotator) Handle(ctx context.Context, req admission.Request) admission.Response {
+// Handle virtualMachineAnnotator allocates the fixed ips of every incoming virtual machine.
+func (a *virtualMachineAnnotator) Handle(ctx context.Context, req admission.Request) (response admission.Response) {
+	defer func(start time.Time) { metrics.ObserveWebhook("mutate-virtualmachines", start, response) }(time.Now())
+
+	if !a.poolManager.IsReady() {
+		return admission.Errored(http.StatusServiceUnavailable, fmt.Errorf("kubeipfixed is still rebuilding its allocation state"))
+	}
+
 	virtualMachine := &kubevirt.VirtualMachine{}
 
 	err := a.decoder.Decode(req, virtualMachine)
@@ -66,15 +76,43 @@ func (a *virtualMachineAnnotator) Handle(ctx context.Context, req admission.Requ
 		virtualMachine.Namespace = req.AdmissionRequest.Namespace
 	}
 
-	logger.V(1).Info("got a virtual machine event")
+	isNotDryRun := (req.DryRun == nil || *req.DryRun == false)
+	transactionTimestamp := ip_manager.CreateTransactionTimestamp()
+	logger.V(1).Info("got a virtual machine event", "transactionTimestamp", transactionTimestamp)
+
+	kubeIPJsonPatches, err := a.poolManager.AllocateVirtualMachineIP(virtualMachine, &transactionTimestamp, isNotDryRun)
+	if err != nil {
+		logger.Error(err, "failed to allocate the virtual machine fixed ips")
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
 
+	logger.V(1).Info("patchVirtualMachineChanges", "kubeIPJsonPatches", kubeIPJsonPatches)
+	if len(kubeIPJsonPatches) == 0 {
+		return admission.Response{
+			Patches: kubeIPJsonPatches,
+			AdmissionResponse: admissionv1.AdmissionResponse{
+				Allowed: true,
+			},
+		}
+	}
 	// admission.PatchResponse generates a Response containing patches.
-	kubemapcoolJsonPatches := []jsonpatch.Operation{}
 	return admission.Response{
-		Patches: kubemapcoolJsonPatches,
+		Patches: kubeIPJsonPatches,
 		AdmissionResponse: admissionv1.AdmissionResponse{
 			Allowed:   true,
 			PatchType: func() *admissionv1.PatchType { pt := admissionv1.PatchTypeJSONPatch; return &pt }(),
 		},
 	}
 }
+
+// InjectClient injects the client into the virtualMachineAnnotator
+func (a *virtualMachineAnnotator) InjectClient(c client.Client) error {
+	a.client = c
+	return nil
+}
+
+// InjectDecoder injects the decoder.
+func (a *virtualMachineAnnotator) InjectDecoder(d *admission.Decoder) error {
+	a.decoder = d
+	return nil
+}
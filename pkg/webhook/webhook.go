@@ -2,6 +2,7 @@ package webhook
 
 import (
 	ip_manager "github.com/wenwenxiong/kubeipfixed/pkg/ip-manager"
+	"net/http"
 	"os"
 	"strings"
 
@@ -21,12 +22,18 @@ const (
 // +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations;validatingwebhookconfigurations,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;update;create;delete
-// +kubebuilder:rbac:groups="",resources=events,verbs=get;list;create;update
+// +kubebuilder:rbac:groups="",resources=events,verbs=get;list;create;update;patch
 // +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;patch
 // +kubebuilder:rbac:groups="apiextensions.k8s.io",resources=customresourcedefinitions,verbs=get;list
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;create;update;patch;list;watch
+// +kubebuilder:rbac:groups=apps,resources=statefulsets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apps,resources=replicasets,verbs=get;list;watch
 // +kubebuilder:rbac:groups="kubevirt.io",resources=virtualmachines,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups="kubevirt.io",resources=virtualmachines/finalizers,verbs=update
+// +kubebuilder:rbac:groups="k8s.cni.cncf.io",resources=network-attachment-definitions,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="kubeippool.io",resources=ippools,verbs=get;list;watch
+// +kubebuilder:rbac:groups="coordination.k8s.io",resources=leases,verbs=get;list;watch;create;update;patch;delete
 var AddToWebhookFuncs []func(*kawwebhook.Server, *ip_manager.IPManager) error
 
 // AddToManager adds all Controllers to the Manager
@@ -37,7 +44,7 @@ func AddToManager(mgr manager.Manager, ipManager *ip_manager.IPManager) error {
 		TLSMinVersion: tlsMinVersion(),
 		CipherSuites:  cipherSuites(),
 	}
-	s.Register("/readyz", healthz.CheckHandler{Checker: healthz.Ping})
+	s.Register("/readyz", healthz.CheckHandler{Checker: readyzChecker(ipManager)})
 
 	for _, f := range AddToWebhookFuncs {
 		if err := f(s, ipManager); err != nil {
@@ -52,6 +59,17 @@ func AddToManager(mgr manager.Manager, ipManager *ip_manager.IPManager) error {
 	return nil
 }
 
+// readyzChecker keeps the webhook server out of the service endpoints until the
+// ip manager rebuilt its allocation state from the cluster.
+func readyzChecker(ipManager *ip_manager.IPManager) healthz.Checker {
+	return func(_ *http.Request) error {
+		if !ipManager.IsReady() {
+			return errors.New("ip manager allocation state is not rebuilt yet")
+		}
+		return nil
+	}
+}
+
 // cipherSuites read the TLS handshake ciphers from a environment variable if
 // empty the decision is delegated to go tls package.
 func cipherSuites() []string {